@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/pkg/errors"
 	"gopkg.in/ldap.v2"
@@ -8,43 +9,61 @@ import (
 )
 
 // pLDAPConnect connects to LDAP
-func pLDAPConnect() (*ldap.Conn, error) {
-	l, err := ldap.Dial("tcp", configuration.LDAPServer+":"+configuration.LDAPPort)
-	return l, err
+func pLDAPConnect(ctx context.Context) (*ldapConn, error) {
+	return dialLDAP(ctx)
 }
 
 // pLDAPConnectAnon binds to LDAP anonymously (only read access)
-func pLDAPConnectAnon() (*ldap.Conn, error) {
-	l, err := pLDAPConnect()
+func pLDAPConnectAnon(ctx context.Context) (*ldapConn, error) {
+	l, err := pLDAPConnect(ctx)
 	if err != nil {
 		return nil, err
 	}
 	// Bind with anonymous user
-	err = l.Bind("", "")
-	return l, err
+	if err = l.Bind("", ""); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
 // pLDAPConnectAdmin binds to LDAP with editing permissions
-func pLDAPConnectAdmin() (*ldap.Conn, error) {
-	l, err := pLDAPConnect()
+func pLDAPConnectAdmin(ctx context.Context) (*ldapConn, error) {
+	l, err := pLDAPConnect(ctx)
 	if err != nil {
 		return nil, err
 	}
 	// Bind with Admin credentials
-	err = l.Bind(configuration.LDAPAdmin, configuration.LDAPPass)
-	return l, err
+	if err = l.Bind(configuration().LDAPAdmin, configuration().LDAPPass); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
 }
 
 // LDAPAuthenticateAdmin checks whether given user has admin permissions
-func LDAPAuthenticateAdmin(admin User) (bool, error) {
+func LDAPAuthenticateAdmin(ctx context.Context, admin User) (bool, error) {
+	return pLDAPAuthenticate(ctx, configuration().LDAPAdminfilter, admin)
+}
+
+// LDAPAuthenticateUser checks the credentials of any user matching LDAPUserfilter
+func LDAPAuthenticateUser(ctx context.Context, user User) (bool, error) {
+	return pLDAPAuthenticate(ctx, configuration().LDAPUserfilter, user)
+}
+
+func pLDAPAuthenticate(ctx context.Context, filter string, user User) (bool, error) {
+	if user.Password == "" {
+		// an empty password would be an unauthenticated bind, which succeeds
+		return false, nil
+	}
 	// Connect to LDAP
-	l, err := pLDAPConnectAnon()
+	l, err := pLDAPConnectAnon(ctx)
 	if err != nil {
 		return false, err
 	}
 	defer l.Close()
 
-	sr, err := pLDAPSearch([]string{"dn"}, fmt.Sprintf(configuration.LDAPAdminfilter, admin.Username))
+	sr, err := pLDAPSearch(ctx, []string{"dn"}, fmt.Sprintf(filter, ldap.EscapeFilter(user.Username)))
 	if err != nil {
 		return false, nil
 	}
@@ -54,7 +73,7 @@ func LDAPAuthenticateAdmin(admin User) (bool, error) {
 	}
 
 	// Bind as the user to verify their password
-	err = l.Bind(sr[0].DN, admin.Password)
+	err = l.Bind(sr[0].DN, user.Password)
 	if err != nil {
 		return false, nil
 		// Wrong password
@@ -62,12 +81,37 @@ func LDAPAuthenticateAdmin(admin User) (bool, error) {
 	return true, nil
 }
 
-// LDAPAddUser adds user with given dn to LDAP
-func LDAPAddUser(dn string, user User) error {
-	l, err := pLDAPConnectAdmin()
+// LDAPAddUser adds user with given dn to LDAP and to the group user.Fs.
+// If adding to the group fails, the entry is removed again
+func LDAPAddUser(ctx context.Context, dn string, user User) error {
+	_, err := addUserOperation(ctx, dn, user).run()
+	return err
+}
+
+// addUserOperation creates the entry of user and adds it to user.Fs and the given additional groups
+func addUserOperation(ctx context.Context, dn string, user User, groups ...string) *operation {
+	op := newOperation("add user")
+	op.step("create user "+user.Username,
+		func() error { return pLDAPAddUserEntry(ctx, dn, user) },
+		func() error { return LDAPDeleteDN(ctx, dn) })
+	if user.Fs != "" {
+		groups = append([]string{user.Fs}, groups...)
+	}
+	for _, group := range groups {
+		group := group
+		op.step("add "+user.Username+" to group "+group,
+			func() error { return LDAPAddUserToGroup(ctx, user.Username, group) },
+			func() error { return LDAPRemoveUserFromGroup(ctx, user.Username, group) })
+	}
+	return op
+}
+
+func pLDAPAddUserEntry(ctx context.Context, dn string, user User) error {
+	l, err := pLDAPConnectAdmin(ctx)
 	if err != nil {
 		return err
 	}
+	defer l.Close()
 
 	password, err := ldapEncodePassword(user.Password)
 	if err != nil {
@@ -79,26 +123,27 @@ func LDAPAddUser(dn string, user User) error {
 	ar.Attribute("objectclass", []string{"inetOrgPerson", "person", "top", "organizationalPerson"})
 	ar.Attribute("cn", []string{user.Username})
 	ar.Attribute("sn", []string{user.Username})
-	ar.Attribute("displayName", []string{user.Username})
-	ar.Attribute("userPassword", password)
-	err = l.Add(ar)
-	l.Close()
-	if err != nil {
-		return err
+	if user.Name != "" {
+		ar.Attribute("displayName", []string{user.Name})
+	} else {
+		ar.Attribute("displayName", []string{user.Username})
 	}
-	// Add User to appropriate Group
-	err = LDAPAddUserToGroup(user.Username, user.Fs)
-	return err
+	if user.Mail != "" {
+		ar.Attribute("mail", []string{user.Mail})
+	}
+	ar.Attribute("userPassword", password)
+	return l.Add(ar)
 }
 
 // LDAPAddUserToGroup adds user to Group
-func LDAPAddUserToGroup(username, groupname string) error {
-	l, err := pLDAPConnectAdmin()
+func LDAPAddUserToGroup(ctx context.Context, username, groupname string) error {
+	l, err := pLDAPConnectAdmin(ctx)
 	if err != nil {
 		return err
 	}
+	defer l.Close()
 	// Validate User
-	sr, err := pLDAPSearch([]string{"dn"}, fmt.Sprintf(configuration.LDAPUserfilter, username))
+	sr, err := pLDAPSearch(ctx, []string{"dn"}, fmt.Sprintf(configuration().LDAPUserfilter, username))
 	if err != nil {
 		return err
 	}
@@ -107,21 +152,24 @@ func LDAPAddUserToGroup(username, groupname string) error {
 		return errors.New("Invalid Username supplied!")
 	}
 
-	mr := ldap.NewModifyRequest("cn=" + groupname + "," + configuration.LDAPBaseDN)
+	groupDN, err := LDAPGroupDN(ctx, groupname)
+	if err != nil {
+		return err
+	}
+	mr := ldap.NewModifyRequest(groupDN)
 	mr.Add("uniqueMember", []string{sr[0].DN})
-	err = l.Modify(mr)
-	l.Close()
-	return err
+	return l.Modify(mr)
 }
 
 // LDAPRemoveUserFromGroup removes user from group
-func LDAPRemoveUserFromGroup(username, groupname string) error {
-	conn, err := pLDAPConnectAdmin()
+func LDAPRemoveUserFromGroup(ctx context.Context, username, groupname string) error {
+	conn, err := pLDAPConnectAdmin(ctx)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 	// Validate User
-	sr, err := pLDAPSearch([]string{"dn"}, fmt.Sprintf(configuration.LDAPUserfilter, username))
+	sr, err := pLDAPSearch(ctx, []string{"dn"}, fmt.Sprintf(configuration().LDAPUserfilter, username))
 	if err != nil {
 		return err
 	}
@@ -130,22 +178,25 @@ func LDAPRemoveUserFromGroup(username, groupname string) error {
 		return errors.New("Invalid Username supplied!")
 	}
 	// Remove from group
-	mr := ldap.NewModifyRequest("cn=" + groupname + "," + configuration.LDAPBaseDN)
+	groupDN, err := LDAPGroupDN(ctx, groupname)
+	if err != nil {
+		return err
+	}
+	mr := ldap.NewModifyRequest(groupDN)
 	mr.Delete("uniqueMember", []string{sr[0].DN})
-	err = conn.Modify(mr)
-	return err
+	return conn.Modify(mr)
 }
 
 // LDAPChangeUserPassword changes password of user given username and new password
-func LDAPChangeUserPassword(username, password string) error {
-	l, err := pLDAPConnectAdmin()
+func LDAPChangeUserPassword(ctx context.Context, username, password string) error {
+	l, err := pLDAPConnectAdmin(ctx)
 	if err != nil {
 		return err
 	}
 	defer l.Close()
 
 	// Validate User
-	sr, err := pLDAPSearch([]string{"dn"}, fmt.Sprintf(configuration.LDAPUserfilter, username))
+	sr, err := pLDAPSearch(ctx, []string{"dn"}, fmt.Sprintf(configuration().LDAPUserfilter, username))
 	if err != nil {
 		return err
 	}
@@ -166,23 +217,23 @@ func LDAPChangeUserPassword(username, password string) error {
 }
 
 // LDAPAddGroup adds Group with given dn to LDAP
-func LDAPAddGroup(dn string) error {
-	l, err := pLDAPConnectAdmin()
+func LDAPAddGroup(ctx context.Context, dn string) error {
+	l, err := pLDAPConnectAdmin(ctx)
 	if err != nil {
 		return err
 	}
 
 	ar := ldap.NewAddRequest(dn)
 	ar.Attribute("objectclass", []string{"groupOfUniqueNames", "top"})
-	ar.Attribute("uniqueMember", []string{configuration.LDAPAdmin})
+	ar.Attribute("uniqueMember", []string{configuration().LDAPAdmin})
 	err = l.Add(ar)
 	l.Close()
 	return err
 }
 
 // LDAPDeleteDN removes given dn from LDAP
-func LDAPDeleteDN(dn string) error {
-	l, err := pLDAPConnectAdmin()
+func LDAPDeleteDN(ctx context.Context, dn string) error {
+	l, err := pLDAPConnectAdmin(ctx)
 	if err != nil {
 		return err
 	}
@@ -193,9 +244,95 @@ func LDAPDeleteDN(dn string) error {
 	return err
 }
 
+// LDAPDeleteUser deletes the user dn and removes it from all groups, see deleteEntryOperation
+func LDAPDeleteUser(ctx context.Context, dn string) ([]StepResult, error) {
+	op, err := deleteEntryOperation(ctx, "delete user", dn)
+	if err != nil {
+		return nil, err
+	}
+	return op.run()
+}
+
+// LDAPDeleteGroup deletes the group dn and removes it from other groups, see deleteEntryOperation
+func LDAPDeleteGroup(ctx context.Context, dn string) ([]StepResult, error) {
+	op, err := deleteEntryOperation(ctx, "delete group", dn)
+	if err != nil {
+		return nil, err
+	}
+	return op.run()
+}
+
+// deleteEntryOperation deletes dn after removing it from the members and owners of all groups, so no
+// dangling references remain when slapd runs without the refint overlay. If deleting fails, the references are restored
+func deleteEntryOperation(ctx context.Context, name, dn string) (*operation, error) {
+	snapshot, err := pLDAPReadEntry(ctx, dn)
+	if err != nil {
+		return nil, err
+	}
+	references, err := findDNReferences(ctx, dn)
+	if err != nil {
+		return nil, err
+	}
+	op := newOperation(name)
+	for _, ref := range references {
+		ref := ref
+		op.step("remove from "+ref.attribute+" of "+ref.group,
+			func() error { return removeDNReference(ctx, ref, dn) },
+			func() error { return replaceDNReference(ctx, ref, "", dn) })
+	}
+	var undo func() error
+	if snapshot != nil {
+		undo = func() error { return pLDAPAddEntry(ctx, snapshot) }
+	}
+	op.step(name+" "+dn, func() error { return LDAPDeleteDN(ctx, dn) }, undo)
+	return op, nil
+}
+
+// pLDAPReadEntry reads all user attributes of dn. Returns nil if dn does not exist
+func pLDAPReadEntry(ctx context.Context, dn string) (*ldap.Entry, error) {
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	sr, err := l.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"*"}, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, nil
+	} else if err != nil || len(sr.Entries) == 0 {
+		return nil, err
+	}
+	return sr.Entries[0], nil
+}
+
+// pLDAPAddEntry adds entry with all its attributes
+func pLDAPAddEntry(ctx context.Context, entry *ldap.Entry) error {
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	ar := ldap.NewAddRequest(entry.DN)
+	for _, attr := range entry.Attributes {
+		ar.Attribute(attr.Name, attr.Values)
+	}
+	return l.Add(ar)
+}
+
 // LDAPViewGroups gets dn of all groups from LDAP
-func LDAPViewGroups() (groups []string, err error) {
-	result, err := pLDAPSearch(
+func LDAPViewGroups(ctx context.Context) (groups []string, err error) {
+	if directory != nil {
+		cached, err := LDAPListGroups(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, group := range cached {
+			groups = append(groups, strings.Replace("{"+"\"name\": \""+group.DN+"\","+
+				"\"members\": \""+strings.Join(withoutPlaceholder(group.Members), ";")+"\"}", ","+configuration().LDAPBaseDN, "", -1))
+		}
+		return groups, nil
+	}
+	result, err := pLDAPSearch(ctx,
 		[]string{"cn", "uniqueMember"},
 		"(objectClass=groupOfUniqueNames)",
 	)
@@ -206,19 +343,34 @@ func LDAPViewGroups() (groups []string, err error) {
 	groups = make([]string, len(result))
 	for i := range result {
 		groups[i] = result[i].DN
-		memberList := strings.Join(result[i].GetAttributeValues("uniqueMember"), ";")
-		strings.Replace(memberList, ","+configuration.LDAPBaseDN, "", -1)
+		memberList := strings.Join(withoutPlaceholder(result[i].GetAttributeValues("uniqueMember")), ";")
+		strings.Replace(memberList, ","+configuration().LDAPBaseDN, "", -1)
 		groups[i] = "{" + "\"name\": \"" + result[i].DN + "\"," +
 			"\"members\": \"" + memberList + "\"}"
-		groups[i] = strings.Replace(groups[i], ","+configuration.LDAPBaseDN, "", -1)
+		groups[i] = strings.Replace(groups[i], ","+configuration().LDAPBaseDN, "", -1)
 	}
 
 	return groups, nil
 }
 
 // LDAPViewUsers gets dn of all users from LDAP
-func LDAPViewUsers() ([]string, error) {
-	result, err := pLDAPSearch(
+func LDAPViewUsers(ctx context.Context) ([]string, error) {
+	if directory != nil {
+		cached, err := LDAPListUsers(ctx)
+		if err != nil {
+			return nil, err
+		}
+		users := []string{}
+		for _, user := range cached {
+			if len(user.Groups) == 0 {
+				continue
+			}
+			users = append(users, strings.Replace("{"+"\"name\": \""+user.DN+"\","+
+				"\"groups\": \""+strings.Join(user.Groups, ";")+"\"}", ","+configuration().LDAPBaseDN, "", -1))
+		}
+		return users, nil
+	}
+	result, err := pLDAPSearch(ctx,
 		[]string{"cn", "memberOf"},
 		"(objectClass=organizationalPerson)",
 	)
@@ -241,30 +393,178 @@ func LDAPViewUsers() ([]string, error) {
 
 		users[i] = "{" + "\"name\": \"" + result[i].DN + "\"," +
 			"\"groups\": \"" + groupList + "\"}"
-		users[i] = strings.Replace(users[i], ","+configuration.LDAPBaseDN, "", -1)
+		users[i] = strings.Replace(users[i], ","+configuration().LDAPBaseDN, "", -1)
 	}
 
 	return users, nil
 }
 
+// LDAPListUsers gets all users from LDAP, or from the directory cache if enabled
+func LDAPListUsers(ctx context.Context) ([]UserEntry, error) {
+	if directory != nil {
+		users, _, err := directory.snapshot(ctx)
+		return users, err
+	}
+	return pLDAPListUsers(ctx, "(objectClass=organizationalPerson)")
+}
+
+// LDAPGetUser gets a single user from LDAP. Returns nil if the user does not exist
+func LDAPGetUser(ctx context.Context, username string) (*UserEntry, error) {
+	users, err := pLDAPListUsers(ctx, fmt.Sprintf(configuration().LDAPUserfilter, ldap.EscapeFilter(username)))
+	if err != nil || len(users) != 1 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+func pLDAPListUsers(ctx context.Context, filter string) ([]UserEntry, error) {
+	result, err := pLDAPSearch(ctx, []string{"cn", "displayName", "mail", "memberOf"}, filter)
+	if err != nil {
+		return nil, err
+	}
+	users := make([]UserEntry, len(result))
+	for i, entry := range result {
+		users[i] = UserEntry{
+			DN:          entry.DN,
+			Username:    entry.GetAttributeValue("cn"),
+			DisplayName: entry.GetAttributeValue("displayName"),
+			Mail:        entry.GetAttributeValue("mail"),
+			Groups:      entry.GetAttributeValues("memberOf"),
+		}
+	}
+	return users, nil
+}
+
+// LDAPListGroups gets all groups from LDAP, or from the directory cache if enabled
+func LDAPListGroups(ctx context.Context) ([]GroupEntry, error) {
+	if directory != nil {
+		_, groups, err := directory.snapshot(ctx)
+		return groups, err
+	}
+	return pLDAPListGroups(ctx, "(objectClass=groupOfUniqueNames)")
+}
+
+// LDAPGetGroup gets a single group from LDAP. Returns nil if the group does not exist
+func LDAPGetGroup(ctx context.Context, name string) (*GroupEntry, error) {
+	groups, err := pLDAPListGroups(ctx, fmt.Sprintf("(&(objectClass=groupOfUniqueNames)(cn=%s))", ldap.EscapeFilter(name)))
+	if err != nil || len(groups) != 1 {
+		return nil, err
+	}
+	return &groups[0], nil
+}
+
+// LDAPGroupDN returns the DN of group name, which need not be directly below LDAPBaseDN after a move
+func LDAPGroupDN(ctx context.Context, name string) (string, error) {
+	group, err := LDAPGetGroup(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if group == nil {
+		return "", ldap.NewError(ldap.LDAPResultNoSuchObject, fmt.Errorf("group %s does not exist", name))
+	}
+	return group.DN, nil
+}
+
+func pLDAPListGroups(ctx context.Context, filter string) ([]GroupEntry, error) {
+	result, err := pLDAPSearch(ctx, []string{"cn", "uniqueMember", "description", "owner", "mail", "businessCategory"}, filter)
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]GroupEntry, len(result))
+	for i, entry := range result {
+		groups[i] = GroupEntry{
+			DN:          entry.DN,
+			Name:        entry.GetAttributeValue("cn"),
+			Members:     entry.GetAttributeValues("uniqueMember"),
+			Description: entry.GetAttributeValue("description"),
+			Owners:      entry.GetAttributeValues("owner"),
+			Mail:        entry.GetAttributeValue("mail"),
+			Visibility:  groupVisibility(entry.GetAttributeValues("businessCategory")),
+		}
+	}
+	return groups, nil
+}
+
+// LDAPReplaceAttributes replaces the given attributes of dn. Empty values delete the attribute
+func LDAPReplaceAttributes(ctx context.Context, dn string, attributes map[string][]string) error {
+	if len(attributes) == 0 {
+		return nil
+	}
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	mr := ldap.NewModifyRequest(dn)
+	for name, values := range attributes {
+		mr.Replace(name, values)
+	}
+	return l.Modify(mr)
+}
+
+// rdnValue returns the value of the first RDN of dn, e.g. `bilbo` for `cn=bilbo,dc=example,dc=com`
+func rdnValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return dn
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+// ldapPageSize is the page size of the Simple Paged Results control (RFC 2696) used for all searches,
+// so that results are not truncated by the server's sizelimit
+const ldapPageSize = 500
+
 // pLDAPSearch searches LDAP for dn with given attributes matching given filter
-func pLDAPSearch(attributes []string, filter string) (result []*ldap.Entry, err error) {
-	l, err := pLDAPConnectAnon()
+func pLDAPSearch(ctx context.Context, attributes []string, filter string) (result []*ldap.Entry, err error) {
+	err = pLDAPSearchEach(ctx, attributes, filter, func(entry *ldap.Entry) error {
+		result = append(result, entry)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return result, nil
+}
+
+// pLDAPSearchEach searches LDAP page by page and calls fn for each entry as soon as its page arrives
+func pLDAPSearchEach(ctx context.Context, attributes []string, filter string, fn func(*ldap.Entry) error) error {
+	l, err := pLDAPConnectAnon(ctx)
+	if err != nil {
+		return err
+	}
 	defer l.Close()
-	// Search for the given username
+	return pLDAPSearchEachConn(l, attributes, filter, fn)
+}
+
+// pLDAPSearchEachConn is pLDAPSearchEach on an existing connection, e.g. one bound as admin
+func pLDAPSearchEachConn(l *ldapConn, attributes []string, filter string, fn func(*ldap.Entry) error) error {
+	paging := ldap.NewControlPaging(ldapPageSize)
 	searchRequest := ldap.NewSearchRequest(
-		configuration.LDAPBaseDN,
+		configuration().LDAPBaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
 		filter,
 		attributes,
-		nil,
+		[]ldap.Control{paging},
 	)
-	sr, err := l.Search(searchRequest)
-	if err != nil {
-		return nil, err
+	for {
+		sr, err := l.Search(searchRequest)
+		if err != nil {
+			return err
+		}
+		for _, entry := range sr.Entries {
+			if err = fn(entry); err != nil {
+				// abandon the paged search
+				paging.PagingSize = 0
+				l.Search(searchRequest)
+				return err
+			}
+		}
+		response, ok := ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+		if !ok || len(response.Cookie) == 0 {
+			return nil
+		}
+		paging.SetCookie(response.Cookie)
 	}
-	return sr.Entries, nil
 }
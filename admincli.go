@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// Admin commands for scripts and runbooks. They use the LDAP functions and checks of the v1 API,
+// bind as LDAPAdmin from the configuration, write to the audit log as cli:<user> and emit webhook events.
+
+// runSubcommand runs the subcommand args[0] of command
+func runSubcommand(command string, subcommands map[string]func(context.Context, []string) error, args []string) error {
+	names := make([]string, 0, len(subcommands))
+	for name := range subcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	usage := fmt.Errorf("usage: usermanager %s %s ...", command, strings.Join(names, "|"))
+	if len(args) == 0 {
+		return usage
+	}
+	run, ok := subcommands[args[0]]
+	if !ok {
+		return usage
+	}
+	readConfig()
+	setupCLIWebhooks()
+	return run(context.Background(), args[1:])
+}
+
+func cmdUser(args []string) error {
+	return runSubcommand("user", map[string]func(context.Context, []string) error{
+		"add":    cmdUserAdd,
+		"remove": cmdUserRemove,
+		"passwd": cmdUserPasswd,
+		"list":   cmdUserList,
+		"show":   cmdUserShow,
+	}, args)
+}
+
+func cmdGroup(args []string) error {
+	return runSubcommand("group", map[string]func(context.Context, []string) error{
+		"add":     cmdGroupAdd,
+		"remove":  cmdGroupRemove,
+		"members": cmdGroupMembers,
+	}, args)
+}
+
+func cmdMembership(args []string) error {
+	return runSubcommand("membership", map[string]func(context.Context, []string) error{
+		"add":    func(ctx context.Context, args []string) error { return cmdMembershipChange(ctx, args, true) },
+		"remove": func(ctx context.Context, args []string) error { return cmdMembershipChange(ctx, args, false) },
+	}, args)
+}
+
+// passwordFlags are the ways to set a password on the command line. Passwords are never taken
+// as arguments, which would show them in the process list and shell history
+type passwordFlags struct {
+	stdin    *bool
+	generate *bool
+}
+
+func addPasswordFlags(flags *flag.FlagSet) passwordFlags {
+	return passwordFlags{
+		stdin:    flags.Bool("password-stdin", false, "read the password from the first line of stdin"),
+		generate: flags.Bool("generate-password", false, "generate a password and print it"),
+	}
+}
+
+// password returns the cleartext password selected by the flags
+func (p passwordFlags) password() (string, error) {
+	switch {
+	case *p.stdin && *p.generate:
+		return "", errors.New("-password-stdin and -generate-password are exclusive")
+	case *p.generate:
+		password := generatePassword()
+		fmt.Println("password:", password)
+		return password, nil
+	case *p.stdin:
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("could not read password from stdin: " + err.Error())
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return "", errors.New("empty password")
+		}
+		return line, nil
+	}
+	return "", errors.New("set the password with -password-stdin or -generate-password")
+}
+
+// printJSON writes value as indented JSON to stdout
+func printJSON(value interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// userExists checks whether a user with the given name exists, as UsersAdd does
+func userExists(ctx context.Context, username string) (bool, error) {
+	existing, err := pLDAPSearch(ctx, []string{"dn"}, fmt.Sprintf("(&(objectClass=organizationalPerson)(cn=%s))", username))
+	return len(existing) != 0, err
+}
+
+func cmdUserAdd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user add", flag.ExitOnError)
+	name := flags.String("name", "", "display name (default: the username)")
+	mail := flags.String("mail", "", "mail address")
+	group := flags.String("group", "", "group to add the user to (required)")
+	passwordSource := addPasswordFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager user add -group GROUP [flags] USERNAME")
+	}
+	username := flags.Arg(0)
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("invalid username %q", username)
+	}
+	if *group == "" {
+		return errors.New("could not add user: -group is required")
+	}
+	existingGroup, err := LDAPGetGroup(ctx, *group)
+	if err != nil {
+		return err
+	}
+	if existingGroup == nil {
+		return fmt.Errorf("group %q does not exist", *group)
+	}
+	exists, err := userExists(ctx, username)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return errors.New("User with given Username already exists in LDAP")
+	}
+	password, err := passwordSource.password()
+	if err != nil {
+		return err
+	}
+
+	dn := "cn=" + username + "," + configuration().LDAPBaseDN
+	user := User{Username: username, Password: hashPassword(password), Fs: *group, Name: *name, Mail: *mail}
+	steps, err := addUserOperation(ctx, dn, user).run()
+	auditLog(cliActor(), "user.add", dn, err)
+	if err != nil {
+		return errors.New("Error adding user: " + err.Error() + "\n" + formatSteps(steps))
+	}
+	emitEvent(EventUserCreated, map[string]string{"username": user.Username, "groupname": user.Fs})
+	fmt.Println("created", dn)
+	return nil
+}
+
+func cmdUserRemove(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user remove", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager user remove USERNAME")
+	}
+	username := flags.Arg(0)
+	if isProtectedUser(username) {
+		return errors.New("Error deleting user: User is protected by divine spirits.")
+	}
+	user, err := LDAPGetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("Error deleting user: User does not exist.")
+	}
+
+	steps, err := LDAPDeleteUser(ctx, user.DN)
+	auditLog(cliActor(), "user.remove", user.DN, err)
+	if err != nil {
+		return errors.New("Error deleting user: " + err.Error() + "\n" + formatSteps(steps))
+	}
+	emitEvent(EventUserDeleted, map[string]string{"username": user.Username})
+	fmt.Println("deleted", user.DN)
+	return nil
+}
+
+func cmdUserPasswd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user passwd", flag.ExitOnError)
+	passwordSource := addPasswordFlags(flags)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager user passwd -password-stdin|-generate-password USERNAME")
+	}
+	username := flags.Arg(0)
+	if isProtectedUser(username) {
+		return errors.New("Error changing password: User is protected by divine spirits.")
+	}
+	user, err := LDAPGetUser(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return errors.New("User with given Username does not exist in LDAP")
+	}
+	password, err := passwordSource.password()
+	if err != nil {
+		return err
+	}
+
+	err = LDAPChangeUserPassword(ctx, username, hashPassword(password))
+	auditLog(cliActor(), "user.passwd", user.DN, err)
+	if err != nil {
+		return errors.New("Error changing password: " + err.Error())
+	}
+	emitEvent(EventUserPasswordChanged, map[string]string{"username": user.Username})
+	fmt.Println("changed password of", user.DN)
+	return nil
+}
+
+func cmdUserList(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user list", flag.ExitOnError)
+	query := flags.String("q", "", "only users whose name, display name or mail contains this")
+	group := flags.String("group", "", "only members of this group")
+	asJSON := flags.Bool("json", false, "print users as JSON")
+	flags.Parse(args)
+
+	users, err := listUsers(ctx, listQuery{Query: *query, Group: *group})
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool { return strings.ToLower(users[i].Username) < strings.ToLower(users[j].Username) })
+	if *asJSON {
+		if users == nil {
+			users = []UserEntry{}
+		}
+		return printJSON(users)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "USERNAME\tDISPLAY NAME\tMAIL\tGROUPS")
+	for _, user := range users {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", user.Username, user.DisplayName, user.Mail, strings.Join(dnNames(user.Groups), ","))
+	}
+	return tw.Flush()
+}
+
+func cmdUserShow(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("user show", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the user as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager user show [-json] USERNAME")
+	}
+	user, err := LDAPGetUser(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %q does not exist", flags.Arg(0))
+	}
+	if *asJSON {
+		return printJSON(user)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "dn\t%s\n", user.DN)
+	fmt.Fprintf(tw, "username\t%s\n", user.Username)
+	fmt.Fprintf(tw, "display name\t%s\n", user.DisplayName)
+	fmt.Fprintf(tw, "mail\t%s\n", user.Mail)
+	fmt.Fprintf(tw, "groups\t%s\n", strings.Join(dnNames(user.Groups), ","))
+	return tw.Flush()
+}
+
+func cmdGroupAdd(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("group add", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager group add GROUP")
+	}
+	name := flags.Arg(0)
+	if !usernamePattern.MatchString(name) {
+		return fmt.Errorf("invalid group name %q", name)
+	}
+	existing, err := pLDAPSearch(ctx, []string{"dn"}, fmt.Sprintf("(&(objectClass=groupOfUniqueNames)(cn=%s))", name))
+	if err != nil {
+		return err
+	}
+	if len(existing) != 0 {
+		return errors.New("Group with given name already exists in LDAP")
+	}
+
+	dn := "cn=" + name + "," + configuration().LDAPBaseDN
+	err = LDAPAddGroup(ctx, dn)
+	auditLog(cliActor(), "group.add", dn, err)
+	if err != nil {
+		return errors.New("Error adding Group: " + err.Error())
+	}
+	emitEvent(EventGroupCreated, map[string]string{"groupname": name})
+	fmt.Println("created", dn)
+	return nil
+}
+
+func cmdGroupRemove(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("group remove", flag.ExitOnError)
+	force := flags.Bool("force", false, "delete the group even if it has members")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager group remove [-force] GROUP")
+	}
+	name := flags.Arg(0)
+	if isProtectedGroup(name) {
+		return errors.New("Error deleting Group: admin group cannot be deleted")
+	}
+	group, err := LDAPGetGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("group %q does not exist", name)
+	}
+	if !*force && len(withoutPlaceholder(group.Members)) != 0 {
+		return errors.New("Error deleting Group: group has members, remove them first or use -force")
+	}
+
+	steps, err := LDAPDeleteGroup(ctx, group.DN)
+	auditLog(cliActor(), "group.remove", group.DN, err)
+	if err != nil {
+		return errors.New("Error deleting Group: " + err.Error() + "\n" + formatSteps(steps))
+	}
+	emitEvent(EventGroupDeleted, map[string]string{"groupname": group.Name})
+	fmt.Println("deleted", group.DN)
+	return nil
+}
+
+func cmdGroupMembers(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("group members", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the member DNs as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager group members [-json] GROUP")
+	}
+	group, err := LDAPGetGroup(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("group %q does not exist", flags.Arg(0))
+	}
+	members := withoutPlaceholder(group.Members)
+	if *asJSON {
+		return printJSON(members)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tDN")
+	for _, dn := range members {
+		fmt.Fprintf(tw, "%s\t%s\n", rdnValue(dn), dn)
+	}
+	return tw.Flush()
+}
+
+// cmdMembershipChange adds a user to a group or removes it
+func cmdMembershipChange(ctx context.Context, args []string, add bool) error {
+	command := "remove"
+	if add {
+		command = "add"
+	}
+	flags := flag.NewFlagSet("membership "+command, flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return errors.New("usage: usermanager membership " + command + " USERNAME GROUP")
+	}
+	username, name := flags.Arg(0), flags.Arg(1)
+	if isProtectedUser(username) {
+		return errors.New("Error changing membership: User is protected by divine spirits.")
+	}
+	group, err := LDAPGetGroup(ctx, name)
+	if err != nil {
+		return err
+	}
+	if group == nil {
+		return fmt.Errorf("group %q does not exist", name)
+	}
+
+	if add {
+		err = LDAPAddUserToGroup(ctx, username, name)
+	} else {
+		err = LDAPRemoveUserFromGroup(ctx, username, name)
+	}
+	auditLog(cliActor(), "membership."+command+"."+username, group.DN, err)
+	if err != nil {
+		return errors.New("Error changing membership: " + err.Error())
+	}
+	if add {
+		emitEvent(EventGroupMemberAdded, map[string]string{"username": username, "groupname": group.Name})
+		fmt.Println("added", username, "to", group.DN)
+	} else {
+		emitEvent(EventGroupMemberRemoved, map[string]string{"username": username, "groupname": group.Name})
+		fmt.Println("removed", username, "from", group.DN)
+	}
+	return nil
+}
+
+// dnNames returns the RDN values of dns, e.g. the group names of a user
+func dnNames(dns []string) []string {
+	names := make([]string, len(dns))
+	for i, dn := range dns {
+		names[i] = rdnValue(dn)
+	}
+	return names
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestAdminCLIArguments(t *testing.T) {
+	membershipAdd := func(ctx context.Context, args []string) error { return cmdMembershipChange(ctx, args, true) }
+	membershipRemove := func(ctx context.Context, args []string) error { return cmdMembershipChange(ctx, args, false) }
+	// every case is rejected before the LDAP server is contacted
+	tests := []struct {
+		name    string
+		command func(context.Context, []string) error
+		args    []string
+		want    string // part of the error
+	}{
+		{"user add without username", cmdUserAdd, []string{"-group", "hobbits"}, "usage: usermanager user add"},
+		{"user add with two usernames", cmdUserAdd, []string{"-group", "hobbits", "frodo", "sam"}, "usage: usermanager user add"},
+		{"user add invalid username", cmdUserAdd, []string{"-group", "hobbits", "frodo)(cn=*"}, "invalid username"},
+		{"user add leading dot", cmdUserAdd, []string{"-group", "hobbits", ".frodo"}, "invalid username"},
+		{"user add without group", cmdUserAdd, []string{"frodo"}, "-group is required"},
+		{"user remove without username", cmdUserRemove, nil, "usage: usermanager user remove"},
+		{"user remove protected", cmdUserRemove, []string{"admin"}, "protected"},
+		{"user passwd without username", cmdUserPasswd, []string{"-generate-password"}, "usage: usermanager user passwd"},
+		{"user passwd protected", cmdUserPasswd, []string{"-generate-password", "admin"}, "protected"},
+		{"user show without username", cmdUserShow, []string{"-json"}, "usage: usermanager user show"},
+		{"group add without name", cmdGroupAdd, nil, "usage: usermanager group add"},
+		{"group add invalid name", cmdGroupAdd, []string{"hob bits"}, "invalid group name"},
+		{"group remove without name", cmdGroupRemove, []string{"-force"}, "usage: usermanager group remove"},
+		{"group remove protected", cmdGroupRemove, []string{"-force", "admins"}, "cannot be deleted"},
+		{"group members with two groups", cmdGroupMembers, []string{"hobbits", "elves"}, "usage: usermanager group members"},
+		{"membership add without group", membershipAdd, []string{"frodo"}, "usage: usermanager membership add USERNAME GROUP"},
+		{"membership remove without group", membershipRemove, []string{"frodo"}, "usage: usermanager membership remove USERNAME GROUP"},
+		{"membership add protected", membershipAdd, []string{"admin", "hobbits"}, "protected"},
+	}
+	for _, test := range tests {
+		err := test.command(context.Background(), test.args)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestAdminCLISubcommand(t *testing.T) {
+	subcommands := map[string]func(context.Context, []string) error{"add": nil, "remove": nil}
+	for _, args := range [][]string{nil, {"rename"}, {"-json"}} {
+		err := runSubcommand("group", subcommands, args)
+		if err == nil || err.Error() != "usage: usermanager group add|remove ..." {
+			t.Errorf("%q: got error %v", args, err)
+		}
+	}
+}
+
+func TestPasswordFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string // error, empty for a generated password
+	}{
+		{nil, "set the password with -password-stdin or -generate-password"},
+		{[]string{"-password-stdin", "-generate-password"}, "-password-stdin and -generate-password are exclusive"},
+		{[]string{"-generate-password"}, ""},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("test", flag.ContinueOnError)
+		source := addPasswordFlags(flags)
+		if err := flags.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		password, err := source.password()
+		if test.want == "" && (err != nil || password == "") {
+			t.Errorf("%q: got password %q, error %v", test.args, password, err)
+		}
+		if test.want != "" && (err == nil || err.Error() != test.want) {
+			t.Errorf("%q: got error %v, want %q", test.args, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,828 @@
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/ldap.v2"
+)
+
+// Resource oriented v2 of the API. Unlike v1, parameters are taken from the URL,
+// bodies are JSON, and errors are JSON objects with a machine readable code.
+
+// Error codes returned by the v2 API
+const (
+	errCodeUnauthorized  = "unauthorized"
+	errCodeForbidden     = "forbidden"
+	errCodeInvalidBody   = "invalid_body"
+	errCodeInvalidValue  = "invalid_value"
+	errCodeProtected     = "protected"
+	errCodeUserNotFound  = "user_not_found"
+	errCodeGroupNotFound = "group_not_found"
+	errCodeNotMember     = "not_member"
+	errCodeUserExists    = "user_exists"
+	errCodeGroupExists   = "group_exists"
+	errCodeGroupCycle    = "group_cycle"
+	errCodeGroupNotEmpty = "group_not_empty"
+	errCodeLDAP          = "ldap_error"
+	errCodeInvalidConfig = "invalid_config"
+)
+
+// apiError is the body of every v2 error response
+type apiError struct {
+	Error struct {
+		Code      string       `json:"code"`
+		Message   string       `json:"message"`
+		Steps     []StepResult `json:"steps,omitempty"` // for failed multi-step operations
+		RequestID string       `json:"requestId,omitempty"`
+	} `json:"error"`
+}
+
+// apiUser is the v2 representation of a user
+type apiUser struct {
+	Username    string   `json:"username"`
+	DisplayName string   `json:"displayName"`
+	Mail        string   `json:"mail,omitempty"`
+	Groups      []string `json:"groups"`
+}
+
+// apiGroup is the v2 representation of a group. Members are users, Groups are nested groups
+type apiGroup struct {
+	Name        string   `json:"name"`
+	Members     []string `json:"members"`
+	Groups      []string `json:"groups"`
+	Description string   `json:"description"`
+	Owners      []string `json:"owners"` // user or group names
+	Mail        string   `json:"mail"`
+	Visibility  string   `json:"visibility"`
+}
+
+// apiGroupUpdate is the body of group metadata updates. Omitted fields stay unchanged
+type apiGroupUpdate struct {
+	Description *string   `json:"description"`
+	Owners      *[]string `json:"owners"`
+	Mail        *string   `json:"mail"`
+	Visibility  *string   `json:"visibility"`
+}
+
+// apiUserGroups lists the groups a user is a direct member of and all groups it is a member of through nesting
+type apiUserGroups struct {
+	Direct    []string `json:"direct"`
+	Effective []string `json:"effective"`
+}
+
+// apiUserUpdate is the body of user create and update requests. Password is expected to be hex-encoded sha512 hash.
+// For PATCH, omitted fields stay unchanged.
+type apiUserUpdate struct {
+	Username    *string `json:"username"`
+	Password    *string `json:"password"`
+	DisplayName *string `json:"displayName"`
+	Mail        *string `json:"mail"`
+	Group       *string `json:"group"` // initial group, only used on creation
+}
+
+func registerV2Routes(router instrumentedRouter) {
+	router.Handler("GET", "/api/v2/users", ValidateTokenMiddlewareV2(V2UsersList()))
+	router.Handler("POST", "/api/v2/users", ValidateTokenMiddlewareV2(V2UsersCreate()))
+	router.Handler("GET", "/api/v2/users/:name", ValidateTokenMiddlewareV2(V2UsersGet()))
+	router.Handler("PUT", "/api/v2/users/:name", ValidateTokenMiddlewareV2(V2UsersUpdate(false)))
+	router.Handler("PATCH", "/api/v2/users/:name", ValidateTokenMiddlewareV2(V2UsersUpdate(true)))
+	router.Handler("DELETE", "/api/v2/users/:name", ValidateTokenMiddlewareV2(V2UsersDelete()))
+	router.Handler("GET", "/api/v2/users/:name/groups", ValidateTokenMiddlewareV2(V2UserGroups()))
+	router.Handler("POST", "/api/v2/users/:name/rename", ValidateTokenMiddlewareV2(V2UsersRename()))
+
+	router.Handler("GET", "/api/v2/groups", ValidateTokenMiddlewareV2(V2GroupsList()))
+	router.Handler("POST", "/api/v2/groups", ValidateTokenMiddlewareV2(V2GroupsCreate()))
+	router.Handler("GET", "/api/v2/groups/:name", ValidateTokenMiddlewareV2(V2GroupsGet()))
+	router.Handler("PATCH", "/api/v2/groups/:name", ValidateTokenMiddlewareV2(V2GroupsUpdate()))
+	router.Handler("DELETE", "/api/v2/groups/:name", ValidateTokenMiddlewareV2(V2GroupsDelete()))
+	router.Handler("POST", "/api/v2/groups/:name/rename", ValidateTokenMiddlewareV2(V2GroupsRename()))
+	router.Handler("GET", "/api/v2/groups/:name/members", ValidateTokenMiddlewareV2(V2MembersList()))
+	router.Handler("PUT", "/api/v2/groups/:name/members/:user", ValidateTokenMiddlewareV2(V2MembersAdd()))
+	router.Handler("DELETE", "/api/v2/groups/:name/members/:user", ValidateTokenMiddlewareV2(V2MembersRemove()))
+	router.Handler("PUT", "/api/v2/groups/:name/groups/:group", ValidateTokenMiddlewareV2(V2SubgroupsAdd()))
+	router.Handler("DELETE", "/api/v2/groups/:name/groups/:group", ValidateTokenMiddlewareV2(V2SubgroupsRemove()))
+
+	router.Handler("GET", "/api/v2/doctor", ValidateTokenMiddlewareV2(V2Doctor(false)))
+	router.Handler("POST", "/api/v2/doctor/fix", ValidateTokenMiddlewareV2(V2Doctor(true)))
+
+	router.Handler("POST", "/api/v2/admin/reload", ValidateTokenMiddlewareV2(V2ReloadConfig()))
+	router.Handler("GET", "/api/v2/admin/lockouts", ValidateTokenMiddlewareV2(V2LockoutsList()))
+	router.Handler("DELETE", "/api/v2/admin/lockouts/:name", ValidateTokenMiddlewareV2(V2LockoutsClear()))
+
+	// membership requests, also available to user tokens
+	router.Handler("GET", "/api/v2/requests", ValidateTokenMiddlewareV2(V2AllRequests()))
+	router.Handler("GET", "/api/v2/me/groups", ValidateUserTokenMiddleware(V2MyGroups()))
+	router.Handler("GET", "/api/v2/me/requests", ValidateUserTokenMiddleware(V2MyRequests()))
+	router.Handler("POST", "/api/v2/groups/:name/requests", ValidateUserTokenMiddleware(V2RequestsCreate()))
+	router.Handler("GET", "/api/v2/groups/:name/requests", ValidateUserTokenMiddleware(V2RequestsList()))
+	router.Handler("POST", "/api/v2/groups/:name/requests/:id/approve", ValidateUserTokenMiddleware(V2RequestsDecide(true)))
+	router.Handler("POST", "/api/v2/groups/:name/requests/:id/reject", ValidateUserTokenMiddleware(V2RequestsDecide(false)))
+}
+
+// ValidateTokenMiddlewareV2 validates the request token, responding with a JSON error
+func ValidateTokenMiddlewareV2(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := parseToken(r)
+		if err != nil || !token.Valid {
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized access to this resource")
+			return
+		}
+		if tokenRole(token) != roleAdmin {
+			writeAPIError(w, http.StatusForbidden, errCodeForbidden, "Access to this resource requires an admin token")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// ValidateUserTokenMiddleware accepts admin and user tokens, for the self service endpoints
+func ValidateUserTokenMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := parseToken(r)
+		if err != nil || !token.Valid {
+			writeAPIError(w, http.StatusUnauthorized, errCodeUnauthorized, "Unauthorized access to this resource")
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// V2UsersList lists users. Supports the search and pagination parameters of listQuery
+func V2UsersList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseListQuery(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		users, total, next, err := LDAPSearchUsers(r.Context(), q)
+		if isListQueryError(err) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		} else if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		result := make([]apiUser, len(users))
+		for i := range users {
+			result[i] = toAPIUser(users[i])
+		}
+		writeJSON(w, http.StatusOK, listPage{Items: result, Total: total, NextCursor: next})
+	})
+}
+
+// V2UsersGet returns a single user
+func V2UsersGet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := v2FindUser(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIUser(*user))
+	})
+}
+
+// V2UsersCreate creates a user from the request body
+func V2UsersCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body apiUserUpdate
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		if body.Username == nil || *body.Username == "" {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "username is required")
+			return
+		}
+		v2CreateUser(r.Context(), w, *body.Username, body)
+	})
+}
+
+// V2UsersUpdate replaces (PUT) or partially updates (PATCH) a user. PUT creates the user if it does not exist
+func V2UsersUpdate(patch bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+		var body apiUserUpdate
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		if body.Username != nil && *body.Username != name {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "username cannot be changed")
+			return
+		}
+		if isProtectedUser(name) {
+			writeAPIError(w, http.StatusForbidden, errCodeProtected, "User is protected by divine spirits.")
+			return
+		}
+		if body.Password != nil && !validPasswordHash(*body.Password) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "password must be a hex-encoded sha512 hash")
+			return
+		}
+
+		user, err := LDAPGetUser(r.Context(), name)
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if user == nil {
+			if patch {
+				writeAPIError(w, http.StatusNotFound, errCodeUserNotFound, "User "+name+" does not exist")
+				return
+			}
+			v2CreateUser(r.Context(), w, name, body)
+			return
+		}
+
+		attributes := map[string][]string{}
+		if body.DisplayName != nil || !patch {
+			attributes["displayName"] = []string{name}
+			if body.DisplayName != nil && *body.DisplayName != "" {
+				attributes["displayName"] = []string{*body.DisplayName}
+			}
+		}
+		if body.Mail != nil || !patch {
+			attributes["mail"] = []string{}
+			if body.Mail != nil && *body.Mail != "" {
+				attributes["mail"] = []string{*body.Mail}
+			}
+		}
+		if err = LDAPReplaceAttributes(r.Context(), user.DN, attributes); err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if body.Password != nil {
+			if err = LDAPChangeUserPassword(r.Context(), name, *body.Password); err != nil {
+				writeLDAPError(w, err)
+				return
+			}
+			emitEvent(EventUserPasswordChanged, map[string]string{"username": name})
+		}
+
+		if user, err = LDAPGetUser(r.Context(), name); err != nil || user == nil {
+			writeLDAPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIUser(*user))
+	})
+}
+
+// V2UsersDelete deletes a user
+func V2UsersDelete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := v2FindUser(w, r)
+		if !ok {
+			return
+		}
+		if isProtectedUser(user.Username) {
+			writeAPIError(w, http.StatusForbidden, errCodeProtected, "User is protected by divine spirits.")
+			return
+		}
+		if steps, err := LDAPDeleteUser(r.Context(), user.DN); err != nil {
+			writeOperationError(w, err, steps)
+			return
+		}
+		emitEvent(EventUserDeleted, map[string]string{"username": user.Username})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// V2GroupsList lists groups. Supports the search and pagination parameters of listQuery
+func V2GroupsList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseListQuery(r)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		groups, total, next, err := LDAPSearchGroups(r.Context(), q)
+		if isListQueryError(err) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		} else if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		result := make([]apiGroup, len(groups))
+		for i := range groups {
+			result[i] = toAPIGroup(groups[i], graph)
+		}
+		writeJSON(w, http.StatusOK, listPage{Items: result, Total: total, NextCursor: next})
+	})
+}
+
+// V2GroupsGet returns a single group with its members
+func V2GroupsGet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindGroup(w, r)
+		if !ok {
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIGroup(*group, graph))
+	})
+}
+
+// V2GroupsCreate creates a group from the request body
+func V2GroupsCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body apiGroup
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		if body.Name == "" {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "name is required")
+			return
+		}
+		if !usernamePattern.MatchString(body.Name) {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, fmt.Sprintf("invalid group name %q", body.Name))
+			return
+		}
+		metadata, err := groupMetadataAttributes(r.Context(), apiGroupUpdate{
+			Description: &body.Description, Owners: &body.Owners, Mail: &body.Mail, Visibility: &body.Visibility,
+		})
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		// the group is removed again if its metadata cannot be set, so the client can retry
+		dn := "cn=" + body.Name + "," + configuration().LDAPBaseDN
+		op := newOperation("create group")
+		op.step("create group "+body.Name,
+			func() error { return LDAPAddGroup(r.Context(), dn) },
+			func() error { return LDAPDeleteDN(r.Context(), dn) })
+		op.step("set metadata of group "+body.Name,
+			func() error { return LDAPSetGroupMetadata(r.Context(), dn, metadata) }, nil)
+		if steps, err := op.run(); err != nil {
+			if steps[0].Status == stepFailed && ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists) {
+				writeAPIError(w, http.StatusConflict, errCodeGroupExists, "Group with given name already exists in LDAP")
+			} else {
+				writeOperationError(w, err, steps)
+			}
+			return
+		}
+		emitEvent(EventGroupCreated, map[string]string{"groupname": body.Name})
+
+		group, err := LDAPGetGroup(r.Context(), body.Name)
+		if err != nil || group == nil {
+			writeLDAPError(w, err)
+			return
+		}
+		w.Header().Set("Location", prefixed("/api/v2/groups/"+body.Name))
+		// a new group has no members besides the placeholder
+		writeJSON(w, http.StatusCreated, toAPIGroup(*group, nil))
+	})
+}
+
+// V2GroupsUpdate changes the metadata of a group
+func V2GroupsUpdate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindGroup(w, r)
+		if !ok {
+			return
+		}
+		var body apiGroupUpdate
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		metadata, err := groupMetadataAttributes(r.Context(), body)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		if err = LDAPSetGroupMetadata(r.Context(), group.DN, metadata); err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+
+		group, err = LDAPGetGroup(r.Context(), group.Name)
+		if err != nil || group == nil {
+			writeLDAPError(w, err)
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIGroup(*group, graph))
+	})
+}
+
+// groupMetadataAttributes converts the given fields of body to LDAP attributes. Empty values remove the attribute
+func groupMetadataAttributes(ctx context.Context, body apiGroupUpdate) (map[string][]string, error) {
+	attributes := map[string][]string{}
+	if body.Description != nil {
+		attributes["description"] = nonEmpty(*body.Description)
+	}
+	if body.Mail != nil {
+		attributes["mail"] = nonEmpty(*body.Mail)
+	}
+	if body.Owners != nil {
+		owners := []string{}
+		for _, name := range *body.Owners {
+			dn, err := resolveOwner(ctx, name)
+			if err != nil {
+				return nil, err
+			}
+			owners = append(owners, dn)
+		}
+		attributes["owner"] = owners
+	}
+	if body.Visibility != nil {
+		switch *body.Visibility {
+		case groupPrivate:
+			attributes["businessCategory"] = []string{groupPrivate}
+		case groupPublic, "":
+			attributes["businessCategory"] = []string{}
+		default:
+			return nil, errors.New("visibility must be public or private")
+		}
+	}
+	return attributes, nil
+}
+
+func nonEmpty(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return []string{value}
+}
+
+// V2GroupsDelete deletes a group. The admin group cannot be removed
+func V2GroupsDelete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindGroup(w, r)
+		if !ok {
+			return
+		}
+		if isProtectedGroup(group.Name) {
+			writeAPIError(w, http.StatusForbidden, errCodeProtected, "admin group cannot be deleted")
+			return
+		}
+		if r.URL.Query().Get("force") != "true" && len(withoutPlaceholder(group.Members)) != 0 {
+			writeAPIError(w, http.StatusConflict, errCodeGroupNotEmpty, "Group "+group.Name+" has members, remove them first or use ?force=true")
+			return
+		}
+		if steps, err := LDAPDeleteGroup(r.Context(), group.DN); err != nil {
+			writeOperationError(w, err, steps)
+			return
+		}
+		emitEvent(EventGroupDeleted, map[string]string{"groupname": group.Name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// V2MembersList lists the members of a group
+func V2MembersList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindGroup(w, r)
+		if !ok {
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, toAPIGroup(*group, graph).Members)
+	})
+}
+
+// V2MembersAdd adds a user to a group. Adding an existing member succeeds without changes
+func V2MembersAdd() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, user, ok := v2FindMembership(w, r)
+		if !ok {
+			return
+		}
+		if isMember(group, user.DN) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err := LDAPAddUserToGroup(r.Context(), user.Username, group.Name); err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		emitEvent(EventGroupMemberAdded, map[string]string{"username": user.Username, "groupname": group.Name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// V2MembersRemove removes a user from a group
+func V2MembersRemove() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, user, ok := v2FindMembership(w, r)
+		if !ok {
+			return
+		}
+		if !isMember(group, user.DN) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotMember, "User "+user.Username+" is not a member of "+group.Name)
+			return
+		}
+		if err := LDAPRemoveUserFromGroup(r.Context(), user.Username, group.Name); err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		emitEvent(EventGroupMemberRemoved, map[string]string{"username": user.Username, "groupname": group.Name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// V2SubgroupsAdd makes a group a member of another group. Cycles are rejected
+func V2SubgroupsAdd() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, child, ok := v2FindSubgroup(w, r)
+		if !ok {
+			return
+		}
+		if isMember(group, child.DN) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		err := LDAPAddGroupToGroup(r.Context(), child.Name, group.Name)
+		if err == errGroupCycle {
+			writeAPIError(w, http.StatusConflict, errCodeGroupCycle, "Group "+group.Name+" is a member of "+child.Name+", adding it would create a cycle")
+			return
+		} else if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		emitEvent(EventGroupMemberAdded, map[string]string{"subgroup": child.Name, "groupname": group.Name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// V2SubgroupsRemove removes a group from the members of another group
+func V2SubgroupsRemove() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, child, ok := v2FindSubgroup(w, r)
+		if !ok {
+			return
+		}
+		if !isMember(group, child.DN) {
+			writeAPIError(w, http.StatusNotFound, errCodeNotMember, "Group "+child.Name+" is not a member of "+group.Name)
+			return
+		}
+		if err := LDAPRemoveGroupFromGroup(r.Context(), child.Name, group.Name); err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		emitEvent(EventGroupMemberRemoved, map[string]string{"subgroup": child.Name, "groupname": group.Name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// V2UserGroups returns the direct and the effective groups of a user, resolving nested groups
+func V2UserGroups() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := v2FindUser(w, r)
+		if !ok {
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, apiUserGroups{
+			Direct:    toAPIUser(*user).Groups,
+			Effective: graph.effectiveGroups(user.DN),
+		})
+	})
+}
+
+// v2CreateUser creates the user name, which becomes the RDN and is checked like in imports and the CLI
+func v2CreateUser(ctx context.Context, w http.ResponseWriter, name string, body apiUserUpdate) {
+	if !usernamePattern.MatchString(name) {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, fmt.Sprintf("invalid username %q", name))
+		return
+	}
+	user := User{Username: name}
+	if body.Password != nil {
+		user.Password = *body.Password
+	}
+	if body.DisplayName != nil {
+		user.Name = *body.DisplayName
+	}
+	if body.Mail != nil {
+		user.Mail = *body.Mail
+	}
+	if body.Group != nil {
+		user.Fs = *body.Group
+	}
+	if !validPasswordHash(user.Password) {
+		writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, "password must be a hex-encoded sha512 hash")
+		return
+	}
+	if user.Fs != "" {
+		group, err := LDAPGetGroup(ctx, user.Fs)
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if group == nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeGroupNotFound, "Group "+user.Fs+" does not exist")
+			return
+		}
+	}
+
+	steps, err := addUserOperation(ctx, "cn="+user.Username+","+configuration().LDAPBaseDN, user).run()
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists) {
+		writeAPIError(w, http.StatusConflict, errCodeUserExists, "User with given Username already exists in LDAP")
+		return
+	} else if err != nil {
+		writeOperationError(w, err, steps)
+		return
+	}
+	emitEvent(EventUserCreated, map[string]string{"username": user.Username, "groupname": user.Fs})
+
+	created, err := LDAPGetUser(ctx, user.Username)
+	if err != nil || created == nil {
+		writeLDAPError(w, err)
+		return
+	}
+	w.Header().Set("Location", prefixed("/api/v2/users/"+user.Username))
+	writeJSON(w, http.StatusCreated, toAPIUser(*created))
+}
+
+func v2FindUser(w http.ResponseWriter, r *http.Request) (*UserEntry, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	user, err := LDAPGetUser(r.Context(), name)
+	if err != nil {
+		writeLDAPError(w, err)
+		return nil, false
+	}
+	if user == nil {
+		writeAPIError(w, http.StatusNotFound, errCodeUserNotFound, "User "+name+" does not exist")
+		return nil, false
+	}
+	return user, true
+}
+
+func v2FindGroup(w http.ResponseWriter, r *http.Request) (*GroupEntry, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	group, err := LDAPGetGroup(r.Context(), name)
+	if err != nil {
+		writeLDAPError(w, err)
+		return nil, false
+	}
+	if group == nil {
+		writeAPIError(w, http.StatusNotFound, errCodeGroupNotFound, "Group "+name+" does not exist")
+		return nil, false
+	}
+	return group, true
+}
+
+func v2FindMembership(w http.ResponseWriter, r *http.Request) (*GroupEntry, *UserEntry, bool) {
+	group, ok := v2FindGroup(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	name := httprouter.ParamsFromContext(r.Context()).ByName("user")
+	if isProtectedUser(name) {
+		writeAPIError(w, http.StatusForbidden, errCodeProtected, "User is protected by divine spirits.")
+		return nil, nil, false
+	}
+	user, err := LDAPGetUser(r.Context(), name)
+	if err != nil {
+		writeLDAPError(w, err)
+		return nil, nil, false
+	}
+	if user == nil {
+		writeAPIError(w, http.StatusNotFound, errCodeUserNotFound, "User "+name+" does not exist")
+		return nil, nil, false
+	}
+	return group, user, true
+}
+
+func v2FindSubgroup(w http.ResponseWriter, r *http.Request) (*GroupEntry, *GroupEntry, bool) {
+	group, ok := v2FindGroup(w, r)
+	if !ok {
+		return nil, nil, false
+	}
+	name := httprouter.ParamsFromContext(r.Context()).ByName("group")
+	child, err := LDAPGetGroup(r.Context(), name)
+	if err != nil {
+		writeLDAPError(w, err)
+		return nil, nil, false
+	}
+	if child == nil {
+		writeAPIError(w, http.StatusNotFound, errCodeGroupNotFound, "Group "+name+" does not exist")
+		return nil, nil, false
+	}
+	return group, child, true
+}
+
+// validPasswordHash checks that password is a hex-encoded sha512 hash, as sent by the frontend
+func validPasswordHash(password string) bool {
+	_, err := hex.DecodeString(password)
+	return err == nil && len(password) == sha512.Size*2
+}
+
+func isMember(group *GroupEntry, dn string) bool {
+	for _, member := range group.Members {
+		if member == dn {
+			return true
+		}
+	}
+	return false
+}
+
+func toAPIUser(user UserEntry) apiUser {
+	groups := make([]string, len(user.Groups))
+	for i, dn := range user.Groups {
+		groups[i] = rdnValue(dn)
+	}
+	return apiUser{Username: user.Username, DisplayName: user.DisplayName, Mail: user.Mail, Groups: groups}
+}
+
+func toAPIGroup(group GroupEntry, graph *groupGraph) apiGroup {
+	result := apiGroup{
+		Name:        group.Name,
+		Members:     []string{},
+		Groups:      []string{},
+		Description: group.Description,
+		Owners:      []string{},
+		Mail:        group.Mail,
+		Visibility:  group.Visibility,
+	}
+	for _, dn := range group.Owners {
+		result.Owners = append(result.Owners, rdnValue(dn))
+	}
+	users, groups := graph.splitMembers(group)
+	for _, dn := range users {
+		result.Members = append(result.Members, rdnValue(dn))
+	}
+	for _, dn := range groups {
+		result.Groups = append(result.Groups, rdnValue(dn))
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	var body apiError
+	body.Error.Code = code
+	body.Error.Message = message
+	body.Error.RequestID = w.Header().Get("X-Request-ID")
+	writeJSON(w, status, body)
+}
+
+// writeLDAPError maps LDAP result codes to HTTP status codes
+func writeLDAPError(w http.ResponseWriter, err error) {
+	writeOperationError(w, err, nil)
+}
+
+// writeOperationError is writeLDAPError for failed operations, listing which steps were applied and undone
+func writeOperationError(w http.ResponseWriter, err error, steps []StepResult) {
+	if err == nil {
+		writeAPIError(w, http.StatusInternalServerError, errCodeLDAP, "entry vanished while processing the request")
+		return
+	}
+	status := http.StatusInternalServerError
+	if e, ok := err.(*ldap.Error); ok {
+		switch e.ResultCode {
+		case ldap.LDAPResultNoSuchObject:
+			status = http.StatusNotFound
+		case ldap.LDAPResultEntryAlreadyExists, ldap.LDAPResultAttributeOrValueExists:
+			status = http.StatusConflict
+		case ldap.LDAPResultInsufficientAccessRights:
+			status = http.StatusForbidden
+		case ldap.LDAPResultInvalidDNSyntax, ldap.LDAPResultInvalidAttributeSyntax,
+			ldap.LDAPResultConstraintViolation, ldap.LDAPResultObjectClassViolation, ldap.LDAPResultNamingViolation:
+			status = http.StatusBadRequest
+		case ldap.LDAPResultBusy, ldap.LDAPResultUnavailable:
+			status = http.StatusServiceUnavailable
+		}
+	}
+	var body apiError
+	body.Error.Code = errCodeLDAP
+	body.Error.Message = err.Error()
+	body.Error.Steps = steps
+	body.Error.RequestID = w.Header().Get("X-Request-ID")
+	writeJSON(w, status, body)
+}
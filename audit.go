@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	auditMu     sync.Mutex
+	auditLogger *log.Logger
+)
+
+// auditLog records a change of the directory made by actor.
+// Entries go to AuditLogFile if configured, and to the server log otherwise.
+func auditLog(actor, action, dn string, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+	line := fmt.Sprintf("audit time=%s actor=%q action=%s dn=%q result=%q",
+		time.Now().UTC().Format(time.RFC3339), actor, action, dn, result)
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditLogger == nil {
+		auditLogger = log.New(os.Stderr, "", 0)
+		if configuration().AuditLogFile != "" {
+			file, err := os.OpenFile(configuration().AuditLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+			if err != nil {
+				logError("could not open audit log, logging to stderr", "error", err)
+			} else {
+				auditLogger = log.New(file, "", 0)
+			}
+		}
+	}
+	auditLogger.Println(line)
+}
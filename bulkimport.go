@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// Import result states
+const (
+	importCreated     = "created"
+	importWouldCreate = "would_create"
+	importConflict    = "conflict"
+	importInvalid     = "invalid"
+	importFailed      = "failed"
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// ImportRow is one user of a bulk import. Password is in cleartext
+type ImportRow struct {
+	Line     int      `json:"-"`
+	Username string   `json:"username"`
+	Name     string   `json:"name"`
+	Mail     string   `json:"mail"`
+	Groups   []string `json:"groups"`
+	Password string   `json:"password"`
+}
+
+// ImportResult reports the outcome of a single row
+type ImportResult struct {
+	Line     int          `json:"line"`
+	Username string       `json:"username"`
+	Status   string       `json:"status"`
+	Errors   []string     `json:"errors,omitempty"`
+	Password string       `json:"password,omitempty"` // generated initial password
+	Steps    []StepResult `json:"steps,omitempty"`    // applied and undone steps of failed rows
+}
+
+// ImportOptions control how a bulk import is applied
+type ImportOptions struct {
+	DryRun            bool
+	GeneratePasswords bool
+	Parallelism       int
+}
+
+// ImportReport is the result of a bulk import
+type ImportReport struct {
+	DryRun  bool           `json:"dryRun"`
+	Summary map[string]int `json:"summary"`
+	Results []ImportResult `json:"results"`
+}
+
+// parseImport reads rows from CSV (with header line) or JSON lines.
+// In CSV, multiple groups are separated by `;`
+func parseImport(r io.Reader, format string) ([]ImportRow, error) {
+	switch format {
+	case "csv":
+		return parseImportCSV(r)
+	case "jsonl", "json":
+		return parseImportJSONL(r)
+	}
+	return nil, fmt.Errorf("unknown import format %q", format)
+}
+
+func parseImportCSV(r io.Reader) ([]ImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read CSV header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["username"]; !ok {
+		return nil, errors.New("CSV header has no username column")
+	}
+
+	var rows []ImportRow
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		get := func(column string) string {
+			if i, ok := columns[column]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row := ImportRow{
+			Line:     line,
+			Username: get("username"),
+			Name:     get("name"),
+			Mail:     get("mail"),
+			Password: get("password"),
+		}
+		for _, group := range strings.Split(get("groups"), ";") {
+			if group = strings.TrimSpace(group); group != "" {
+				row.Groups = append(row.Groups, group)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseImportJSONL(r io.Reader) ([]ImportRow, error) {
+	var rows []ImportRow
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var row ImportRow
+		if err := json.Unmarshal([]byte(text), &row); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		row.Line = line
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// runImport validates all rows and, unless opts.DryRun is set, creates the valid ones
+// with at most opts.Parallelism concurrent LDAP operations
+func runImport(ctx context.Context, rows []ImportRow, opts ImportOptions) (ImportReport, error) {
+	users, err := LDAPListUsers(ctx)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	groups, err := LDAPListGroups(ctx)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	existingUsers := map[string]bool{}
+	for _, u := range users {
+		existingUsers[strings.ToLower(u.Username)] = true
+	}
+	// group names by their lower case form, as LDAP compares cn case-insensitively
+	existingGroups := map[string]string{}
+	for _, g := range groups {
+		existingGroups[strings.ToLower(g.Name)] = g.Name
+	}
+
+	results := make([]ImportResult, len(rows))
+	seen := map[string]int{}
+	for i := range rows {
+		results[i] = validateImportRow(&rows[i], opts, existingUsers, existingGroups, seen)
+	}
+
+	if !opts.DryRun {
+		parallelism := opts.Parallelism
+		if parallelism < 1 {
+			parallelism = 1
+		}
+		var wg sync.WaitGroup
+		sem := make(chan struct{}, parallelism)
+		for i := range rows {
+			if results[i].Status != importWouldCreate {
+				continue
+			}
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				applyImportRow(ctx, rows[i], &results[i])
+			}(i)
+		}
+		wg.Wait()
+	}
+
+	report := ImportReport{DryRun: opts.DryRun, Summary: map[string]int{"total": len(rows)}, Results: results}
+	for _, result := range results {
+		report.Summary[result.Status]++
+	}
+	return report, nil
+}
+
+// validateImportRow checks row against the existing users and groups and the rows seen before.
+// Group names are replaced by the names of the existing groups
+func validateImportRow(row *ImportRow, opts ImportOptions, existingUsers map[string]bool, existingGroups map[string]string, seen map[string]int) ImportResult {
+	result := ImportResult{Line: row.Line, Username: row.Username, Status: importWouldCreate}
+	invalid := func(format string, args ...interface{}) {
+		result.Status = importInvalid
+		result.Errors = append(result.Errors, fmt.Sprintf(format, args...))
+	}
+
+	if row.Username == "" {
+		invalid("no username supplied")
+	} else if !usernamePattern.MatchString(row.Username) {
+		invalid("invalid username %q", row.Username)
+	}
+	if row.Mail != "" && !strings.Contains(row.Mail, "@") {
+		invalid("invalid mail %q", row.Mail)
+	}
+	for i, group := range row.Groups {
+		if name, ok := existingGroups[strings.ToLower(group)]; ok {
+			row.Groups[i] = name
+		} else {
+			invalid("group %q does not exist", group)
+		}
+	}
+	if row.Password == "" {
+		if opts.GeneratePasswords {
+			if !opts.DryRun {
+				row.Password = generatePassword()
+				result.Password = row.Password
+			}
+		} else {
+			invalid("no password supplied")
+		}
+	}
+	if result.Status == importInvalid {
+		return result
+	}
+
+	key := strings.ToLower(row.Username)
+	if line, ok := seen[key]; ok {
+		result.Status = importConflict
+		result.Errors = append(result.Errors, fmt.Sprintf("duplicate of line %d", line))
+	} else if existingUsers[key] {
+		result.Status = importConflict
+		result.Errors = append(result.Errors, "User with given Username already exists in LDAP")
+	} else if group, ok := existingGroups[key]; ok {
+		// users and groups share the DN cn=<name>,LDAPBaseDN
+		result.Status = importConflict
+		result.Errors = append(result.Errors, fmt.Sprintf("Group %q with the same name already exists in LDAP", group))
+	}
+	seen[key] = row.Line
+	if result.Status == importConflict {
+		result.Password = ""
+	}
+	return result
+}
+
+func applyImportRow(ctx context.Context, row ImportRow, result *ImportResult) {
+	user := User{
+		Username: row.Username,
+		Password: hashPassword(row.Password),
+		Name:     row.Name,
+		Mail:     row.Mail,
+	}
+	var groups []string
+	if len(row.Groups) != 0 {
+		user.Fs, groups = row.Groups[0], row.Groups[1:]
+	}
+	// the user is created with all its groups or not at all
+	steps, err := addUserOperation(ctx, "cn="+user.Username+","+configuration().LDAPBaseDN, user, groups...).run()
+	if err != nil {
+		result.Status = importFailed
+		result.Errors = append(result.Errors, err.Error())
+		result.Steps = steps
+		return
+	}
+	result.Status = importCreated
+	emitEvent(EventUserCreated, map[string]string{"username": user.Username, "groupname": user.Fs})
+	for _, group := range groups {
+		emitEvent(EventGroupMemberAdded, map[string]string{"username": user.Username, "groupname": group})
+	}
+}
+
+// generatePassword returns a random initial password
+func generatePassword() string {
+	const alphabet = "abcdefghijkmnpqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	password := make([]byte, 14)
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			panic(err)
+		}
+		password[i] = alphabet[n.Int64()]
+	}
+	return string(password)
+}
+
+// UsersImport creates users from an uploaded CSV or JSON lines file.
+// The file is either the raw body or the `file` field of a multipart form.
+// Query parameters: format=csv|jsonl, dry_run=true, generate_passwords=true
+func UsersImport() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var body io.Reader = r.Body
+		contentType := r.Header.Get("Content-Type")
+		if strings.Contains(contentType, "multipart/form-data") {
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Error parsing Request Body: " + err.Error()))
+				return
+			}
+			defer file.Close()
+			body = file
+		}
+		format := query.Get("format")
+		if format == "" {
+			format = "csv"
+			if strings.Contains(contentType, "json") {
+				format = "jsonl"
+			}
+		}
+
+		rows, err := parseImport(body, format)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Error parsing Request Body: " + err.Error()))
+			return
+		}
+		report, err := runImport(r.Context(), rows, ImportOptions{
+			DryRun:            query.Get("dry_run") == "true",
+			GeneratePasswords: query.Get("generate_passwords") == "true",
+			Parallelism:       configuration().BulkImportParallelism,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error occurred: " + err.Error()))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func cmdImport(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only validate, do not create users")
+	generate := flags.Bool("generate-passwords", false, "generate passwords for rows without one")
+	format := flags.String("format", "", "csv or jsonl (default: guessed from file extension)")
+	parallel := flags.Int("parallel", 0, "number of concurrent LDAP operations (default: BulkImportParallelism)")
+	asJSON := flags.Bool("json", false, "print report as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager import [flags] FILE")
+	}
+
+	readConfig()
+	setupCLIWebhooks()
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if *format == "" {
+		*format = "csv"
+		if strings.HasSuffix(file.Name(), ".jsonl") || strings.HasSuffix(file.Name(), ".json") {
+			*format = "jsonl"
+		}
+	}
+	if *parallel == 0 {
+		*parallel = configuration().BulkImportParallelism
+	}
+
+	rows, err := parseImport(file, *format)
+	if err != nil {
+		return err
+	}
+	report, err := runImport(ctx, rows, ImportOptions{DryRun: *dryRun, GeneratePasswords: *generate, Parallelism: *parallel})
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		return json.NewEncoder(os.Stdout).Encode(report)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LINE\tUSERNAME\tSTATUS\tPASSWORD\tERRORS")
+	for _, result := range report.Results {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", result.Line, result.Username, result.Status, result.Password, strings.Join(result.Errors, "; "))
+	}
+	tw.Flush()
+	fmt.Printf("\n%d rows: %d created, %d would be created, %d conflicts, %d invalid, %d failed\n",
+		report.Summary["total"], report.Summary[importCreated], report.Summary[importWouldCreate],
+		report.Summary[importConflict], report.Summary[importInvalid], report.Summary[importFailed])
+	if report.Summary[importFailed] != 0 {
+		return errors.New("some rows failed")
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateImportRow(t *testing.T) {
+	existingUsers := map[string]bool{"frodo": true}
+	existingGroups := map[string]string{"hobbits": "Hobbits", "burglars": "burglars"}
+	tests := []struct {
+		name       string
+		row        ImportRow
+		opts       ImportOptions
+		wantStatus string
+		wantErrors []string
+		wantGroups []string
+	}{
+		{"valid", ImportRow{Line: 2, Username: "bilbo", Password: "x", Groups: []string{"Hobbits"}}, ImportOptions{},
+			importWouldCreate, nil, []string{"Hobbits"}},
+		{"group case", ImportRow{Line: 2, Username: "bilbo", Password: "x", Groups: []string{"HOBBITS", "Burglars"}}, ImportOptions{},
+			importWouldCreate, nil, []string{"Hobbits", "burglars"}},
+		{"missing group", ImportRow{Line: 2, Username: "bilbo", Password: "x", Groups: []string{"wizards"}}, ImportOptions{},
+			importInvalid, []string{`group "wizards" does not exist`}, nil},
+		{"invalid fields", ImportRow{Line: 2, Username: "-bilbo", Mail: "bilbo"}, ImportOptions{},
+			importInvalid, []string{`invalid username "-bilbo"`, `invalid mail "bilbo"`, "no password supplied"}, nil},
+		{"generated password", ImportRow{Line: 2, Username: "bilbo"}, ImportOptions{GeneratePasswords: true, DryRun: true},
+			importWouldCreate, nil, nil},
+		{"existing user", ImportRow{Line: 2, Username: "Frodo", Password: "x"}, ImportOptions{},
+			importConflict, []string{"User with given Username already exists in LDAP"}, nil},
+		{"existing group", ImportRow{Line: 2, Username: "hobbits", Password: "x"}, ImportOptions{},
+			importConflict, []string{`Group "Hobbits" with the same name already exists in LDAP`}, nil},
+	}
+	for _, test := range tests {
+		row := test.row
+		result := validateImportRow(&row, test.opts, existingUsers, existingGroups, map[string]int{})
+		if result.Status != test.wantStatus || strings.Join(result.Errors, "\n") != strings.Join(test.wantErrors, "\n") {
+			t.Errorf("%s: got %s %q, want %s %q", test.name, result.Status, result.Errors, test.wantStatus, test.wantErrors)
+		}
+		if test.wantGroups != nil && !reflect.DeepEqual(row.Groups, test.wantGroups) {
+			t.Errorf("%s: groups %q, want %q", test.name, row.Groups, test.wantGroups)
+		}
+	}
+}
+
+func TestValidateImportRowDuplicates(t *testing.T) {
+	seen := map[string]int{}
+	rows := []ImportRow{
+		{Line: 2, Username: "bilbo", Password: "x"},
+		{Line: 3, Username: "BILBO", Password: "x"},
+	}
+	want := []string{importWouldCreate, importConflict}
+	for i := range rows {
+		result := validateImportRow(&rows[i], ImportOptions{}, map[string]bool{}, map[string]string{}, seen)
+		if result.Status != want[i] {
+			t.Errorf("line %d: got %s %q, want %s", rows[i].Line, result.Status, result.Errors, want[i])
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// command is a subcommand of the usermanager binary. Without a subcommand the server is started.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"config":      {"config check  validate the configuration and print it with secrets masked", cmdConfig},
+	"doctor":      {"doctor [flags]  check the directory for inconsistencies and repair the safe ones", cmdDoctor},
+	"export":      {"export [flags]  dump users, groups and memberships as LDIF, CSV or JSON", cmdExport},
+	"group":       {"group add|remove|members [flags] GROUP  manage groups", cmdGroup},
+	"healthcheck": {"healthcheck [-ready]  probe the running server, exits with status 1 if it is not healthy", cmdHealthcheck},
+	"import":      {"import [flags] FILE  create users from a CSV or JSON lines file", cmdImport},
+	"keys":        {"keys init [flags]  generate the JWT signing key and optionally a TLS certificate", cmdKeys},
+	"ldif":        {"ldif [flags] FILE  apply an LDIF file with content or change records", cmdLDIF},
+	"membership":  {"membership add|remove USERNAME GROUP  add a user to a group or remove it", cmdMembership},
+	"reconcile":   {"reconcile [flags] FILE  bring groups and memberships to the state declared in a YAML file", cmdReconcile},
+	"user":        {"user add|remove|passwd|list|show [flags] [USERNAME]  manage users", cmdUser},
+}
+
+// parseGlobalFlags parses the flags given before the command, which apply to the server and all commands,
+// and returns the remaining arguments
+func parseGlobalFlags(args []string) []string {
+	flags := flag.NewFlagSet("usermanager", flag.ExitOnError)
+	flags.Usage = printUsage
+	flags.StringVar(&configFile, "config", configFile, "configuration file (JSON, YAML or TOML)")
+	flags.Parse(args)
+	flags.Visit(func(f *flag.Flag) {
+		configFileExplicit = f.Name == "config"
+	})
+	return flags.Args()
+}
+
+// runCommand executes the subcommand given in args and exits the process
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		if args[0] != "help" && args[0] != "-h" && args[0] != "--help" {
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		}
+		printUsage()
+		os.Exit(2)
+	}
+	err := cmd.run(args[1:])
+	if webhooks != nil {
+		// changes made before a failure are reported as well
+		webhooks.deliverAll()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func printUsage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(os.Stderr, "usage: usermanager [--config FILE] [command]")
+	fmt.Fprintln(os.Stderr, "\nwithout command, the server is started. commands:")
+	for _, name := range names {
+		fmt.Fprintln(os.Stderr, "  usermanager", commands[name].usage)
+	}
+}
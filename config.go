@@ -1,18 +1,124 @@
 package main
 
 import (
-	"crypto/rsa"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// configState holds the live configuration and JWT keys. Both are replaced as a whole on reload, so
+// callers reading several values at once should keep the returned pointer
+var configState struct {
+	config atomic.Value // *ServerConfig
+	keys   atomic.Value // *jwtKeys
+}
+
+// configuration returns the live configuration
+func configuration() *ServerConfig {
+	if conf, _ := configState.config.Load().(*ServerConfig); conf != nil {
+		return conf
+	}
+	return &ServerConfig{}
+}
 
-	"github.com/dgrijalva/jwt-go"
+func setConfiguration(conf ServerConfig) {
+	configState.config.Store(&conf)
+}
+
+// configFile is the configuration file, set with --config. Its format is chosen by the extension:
+// .yaml or .yml for YAML, .toml for TOML and JSON otherwise
+var (
+	configFile         = "config.conf"
+	configFileExplicit bool // set with --config, must exist
 )
 
-func readConfig(conf *ServerConfig) {
+// configEnv lists the environment variables overriding settings. Each can also be given as NAME_FILE,
+// the path of a file holding the value, e.g. a Docker secret
+var configEnv = []struct{ name, setting string }{
+	{"UM_SERVER_BIND_ADDR", "ServerBindAddr"},
+	{"UM_JWT_PUB", "JWTPublicRSAKey"},
+	{"UM_JWT_PRIV", "JWTPrivateRSAKey"},
+	{"UM_TLS_CERT", "SSLCertificate"},
+	{"UM_TLS_KEY", "SSLKeyFile"},
+	{"UM_LDAP_ADMIN", "LDAPAdmin"},
+	{"UM_LDAP_PASS", "LDAPPass"},
+	{"UM_LDAP_BASE_DN", "LDAPBaseDN"},
+	{"UM_LDAP_SERVER", "LDAPServer"},
+	{"UM_LDAP_PORT", "LDAPPort"},
+	{"UM_LDAP_ADMINFILTER", "LDAPAdminfilter"},
+	{"UM_LDAP_USERFILTER", "LDAPUserfilter"},
+	{"UM_AUDIT_LOG", "AuditLogFile"},
+	{"UM_REQUESTS_FILE", "MembershipRequestFile"},
+	{"UM_WEBHOOK_QUEUE", "WebhookQueueFile"},
+	{"UM_SHUTDOWN_TIMEOUT", "ShutdownTimeout"},
+	{"UM_LOG_FORMAT", "LogFormat"},
+	{"UM_LOG_LEVEL", "LogLevel"},
+	{"UM_METRICS_TOKEN", "MetricsToken"},
+	{"UM_CACHE_REFRESH", "DirectoryCacheRefresh"},
+	{"UM_CACHE_SYNC", "DirectoryCacheSync"},
+	{"UM_DEV_MODE", "DevMode"},
+	{"UM_TRUSTED_PROXIES", "TrustedProxies"},
+	{"UM_LOGIN_MAX_FAILURES", "LoginLockout.MaxFailures"},
+	{"UM_LOGIN_LOCKOUT", "LoginLockout.Duration"},
+	{"UM_LOGIN_MAX_LOCKOUT", "LoginLockout.MaxDuration"},
+	{"UM_LOGIN_LOCKOUT_KEY", "LoginLockout.Key"},
+	{"UM_PATH_PREFIX", "PathPrefix"},
+	{"UM_CORS_ORIGINS", "CORS.AllowedOrigins"},
+	{"UM_CORS_CREDENTIALS", "CORS.AllowCredentials"},
+}
+
+// configReport collects the problems found while reading the configuration
+type configReport struct {
+	errors   []string
+	warnings []string
+}
+
+func (r *configReport) errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *configReport) warnf(format string, args ...interface{}) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+// readConfig loads the configuration and exits if it is invalid
+func readConfig() {
+	conf, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	setConfiguration(conf)
+}
+
+// loadConfig reads and validates the configuration, logging warnings and returning all errors at once
+func loadConfig() (ServerConfig, error) {
+	conf, report := parseConfig()
+	for _, warning := range report.warnings {
+		log.Println("config:", warning)
+	}
+	if len(report.errors) != 0 {
+		return conf, errors.New("invalid config: " + strings.Join(report.errors, "; "))
+	}
+	return conf, nil
+}
+
+// parseConfig reads the defaults, the config file and the environment and validates the result.
+// A missing config file is only an error if it was given with --config
+func parseConfig() (ServerConfig, configReport) {
+	var report configReport
+	var config ServerConfig
+	conf := &config
+
 	// default values
 	conf.ServerBindAddr = ":8443"
 	conf.JWTPublicRSAKey = "./keys/jwt.pub"
@@ -20,117 +126,391 @@ func readConfig(conf *ServerConfig) {
 	conf.LDAPServer = "localhost"
 	conf.LDAPPort = "389"
 	conf.LDAPUserfilter = "(&(objectClass=organizationalPerson)(cn=%s))"
+	conf.WebhookQueueFile = "./webhooks.json"
+	conf.WebhookMaxAttempts = 8
+	conf.BulkImportParallelism = 4
+	conf.MembershipRequestFile = "./requests.json"
+	conf.DirectoryCacheRefresh = 300
+	conf.DirectoryCacheSync = true
+	conf.LogFormat = "logfmt"
+	conf.ShutdownTimeout = 30
+	conf.LogLevel = "info"
+	// one login attempt every 5 seconds per client and account
+	conf.RateLimits = []RateLimit{
+		{Route: "/api/login", Rate: 0.2, Burst: 1},
+		{Route: "/api/login/user", Rate: 0.2, Burst: 1},
+		{Route: "/api/login", Rate: 0.2, Burst: 1, Key: rateLimitByUsername},
+		{Route: "/api/login/user", Rate: 0.2, Burst: 1, Key: rateLimitByUsername},
+	}
+	conf.LoginLockout = LoginLockout{MaxFailures: 5, Duration: 60, MaxDuration: 3600, Key: lockoutByUsername}
+	conf.CORS = CORSConfig{
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-Request-ID"},
+		MaxAge:         600,
+	}
 
-	// load from json
-	if file, err := ioutil.ReadFile("config.conf"); err != nil {
-		log.Print(err)
-		log.Println("couldn't read config file, falling back to defaults + environment variables")
-	} else if err = json.Unmarshal(file, &conf); err != nil {
+	// load from the config file
+	if values, err := readConfigFile(configFile); os.IsNotExist(err) && !configFileExplicit {
 		log.Print(err)
 		log.Println("couldn't read config file, falling back to defaults + environment variables")
+	} else if err != nil {
+		report.errorf("%s: %v", configFile, err)
+	} else {
+		report.decode(reflect.ValueOf(conf).Elem(), values, "")
 	}
 
-	if os.Getenv("UM_SERVER_BIND_ADDR") != "" {
-		conf.ServerBindAddr = os.Getenv("UM_SERVER_BIND_ADDR")
+	settings := reflect.ValueOf(conf).Elem()
+	for _, env := range configEnv {
+		value, err := getenv(env.name)
+		if err != nil {
+			report.errorf("%s_FILE: %v", env.name, err)
+		} else if value != "" {
+			setting := settings
+			for _, name := range strings.Split(env.setting, ".") {
+				setting = setting.FieldByName(name)
+			}
+			report.decode(setting, value, env.name)
+		}
 	}
-	if os.Getenv("UM_JWT_PUB") != "" {
-		conf.JWTPublicRSAKey = os.Getenv("UM_JWT_PUB")
+
+	// validate required values are set
+	if conf.LDAPAdmin == "" {
+		report.errorf("missing required config LDAPAdmin")
 	}
-	if os.Getenv("UM_JWT_PRIV") != "" {
-		conf.JWTPrivateRSAKey = os.Getenv("UM_JWT_PRIV")
+	if conf.LDAPPass == "" {
+		report.errorf("missing required config LDAPPass")
 	}
-	if os.Getenv("UM_TLS_CERT") != "" {
-		conf.SSLCertificate = os.Getenv("UM_TLS_CERT")
+	if conf.LDAPBaseDN == "" {
+		report.errorf("missing required config LDAPBaseDN")
 	}
-	if os.Getenv("UM_TLS_KEY") != "" {
-		conf.SSLKeyFile = os.Getenv("UM_TLS_KEY")
+	if conf.LDAPAdminfilter == "" {
+		report.errorf("missing required config LDAPAdminfilter")
 	}
-	if os.Getenv("UM_LDAP_ADMIN") != "" {
-		conf.LDAPAdmin = os.Getenv("UM_LDAP_ADMIN")
+	// the values below have default values, but we check just in case
+	if conf.LDAPServer == "" {
+		report.errorf("missing required config LDAPServer")
 	}
-	if os.Getenv("UM_LDAP_PASS") != "" {
-		conf.LDAPPass = os.Getenv("UM_LDAP_PASS")
+	if conf.LDAPPort == "" {
+		report.errorf("missing required config LDAPPort")
 	}
-	if os.Getenv("UM_LDAP_BASE_DN") != "" {
-		conf.LDAPBaseDN = os.Getenv("UM_LDAP_BASE_DN")
+	if conf.LDAPUserfilter == "" {
+		report.errorf("missing required config LDAPUserfilter")
 	}
-	if os.Getenv("UM_LDAP_SERVER") != "" {
-		conf.LDAPServer = os.Getenv("UM_LDAP_SERVER")
+	hookIDs := map[string]int{}
+	for i, hook := range conf.Webhooks {
+		if hook.URL == "" {
+			report.errorf("invalid config Webhooks[%d]: missing url", i)
+		}
+		if hook.ID == "" {
+			conf.Webhooks[i].ID = hook.URL
+		}
+		if j, exists := hookIDs[conf.Webhooks[i].ID]; exists {
+			report.errorf("invalid config Webhooks[%d]: id %q is already used by Webhooks[%d], set a distinct id", i, conf.Webhooks[i].ID, j)
+		}
+		hookIDs[conf.Webhooks[i].ID] = i
 	}
-	if os.Getenv("UM_LDAP_PORT") != "" {
-		conf.LDAPPort = os.Getenv("UM_LDAP_PORT")
+	if len(conf.Webhooks) != 0 && conf.WebhookQueueFile == "" {
+		report.errorf("missing required config WebhookQueueFile")
 	}
-	if os.Getenv("UM_LDAP_ADMINFILTER") != "" {
-		conf.LDAPAdminfilter = os.Getenv("UM_LDAP_ADMINFILTER")
+	if conf.WebhookMaxAttempts < 1 {
+		conf.WebhookMaxAttempts = 1
 	}
-	if os.Getenv("UM_LDAP_USERFILTER") != "" {
-		conf.LDAPUserfilter = os.Getenv("UM_LDAP_USERFILTER")
+	if conf.LogFormat != "logfmt" && conf.LogFormat != "json" {
+		report.errorf("invalid config LogFormat: must be logfmt or json")
 	}
-
-	// validate required values are set
-	if conf.LDAPAdmin == "" {
-		log.Fatal("missing required config LDAPAdmin")
+	if _, ok := parseLogLevel(conf.LogLevel); !ok {
+		report.errorf("invalid config LogLevel: must be debug, info, warn or error")
 	}
-	if conf.LDAPPass == "" {
-		log.Fatal("missing required config LDAPPass")
+	if conf.ShutdownTimeout < 0 {
+		report.errorf("invalid config ShutdownTimeout: must not be negative")
 	}
-	if conf.LDAPBaseDN == "" {
-		log.Fatal("missing required config LDAPBaseDN")
+	if conf.DirectoryCacheRefresh < 0 {
+		report.errorf("invalid config DirectoryCacheRefresh: must not be negative")
 	}
-	if conf.LDAPAdminfilter == "" {
-		log.Fatal("missing required config LDAPAdminfilter")
+	for i := range conf.RateLimits {
+		limit := &conf.RateLimits[i]
+		if limit.Route == "" {
+			report.errorf("invalid config RateLimits[%d]: missing route", i)
+		}
+		if limit.Rate <= 0 {
+			report.errorf("invalid config RateLimits[%d]: rate must be positive", i)
+		}
+		if limit.Burst < 1 {
+			limit.Burst = 1
+		}
+		if limit.Key == "" {
+			limit.Key = rateLimitByIP
+		}
+		if limit.Key != rateLimitByIP && limit.Key != rateLimitByUsername {
+			report.errorf("invalid config RateLimits[%d]: key must be ip or username", i)
+		}
 	}
-	// the values below have default values, but we check just in case
-	if conf.LDAPServer == "" {
-		log.Fatal("missing required config LDAPServer")
+	if lockout := conf.LoginLockout; lockout.MaxFailures < 0 || lockout.Duration < 0 || lockout.MaxDuration < lockout.Duration {
+		report.errorf("invalid config LoginLockout: values must not be negative and maxDuration not less than duration")
+	} else if lockout.MaxFailures > 0 && lockout.Duration == 0 {
+		report.errorf("invalid config LoginLockout: duration must be positive")
 	}
-	if conf.LDAPPort == "" {
-		log.Fatal("missing required config LDAPPort")
+	if conf.LoginLockout.Key == "" {
+		conf.LoginLockout.Key = lockoutByUsername
 	}
-	if conf.LDAPUserfilter == "" {
-		log.Fatal("missing required config LDAPUserfilter")
+	if conf.LoginLockout.Key != lockoutByUsername && conf.LoginLockout.Key != lockoutByClient {
+		report.errorf("invalid config LoginLockout: key must be username or client")
+	}
+	for i, proxy := range conf.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			report.errorf("invalid config TrustedProxies[%d]: %q is not an address or CIDR", i, proxy)
+		}
+	}
+	if conf.PathPrefix = strings.TrimRight(conf.PathPrefix, "/"); conf.PathPrefix != "" {
+		if !strings.HasPrefix(conf.PathPrefix, "/") {
+			conf.PathPrefix = "/" + conf.PathPrefix
+		}
+		if strings.ContainsAny(conf.PathPrefix, "?#") {
+			report.errorf("invalid config PathPrefix: must be a path like /usermanager")
+		}
 	}
+	for i, origin := range conf.CORS.AllowedOrigins {
+		if !validOrigin(origin) {
+			report.errorf("invalid config CORS.allowedOrigins[%d]: %q is not * or an origin like https://example.com", i, origin)
+		} else if origin == "*" && conf.CORS.AllowCredentials {
+			report.errorf("invalid config CORS: allowCredentials needs explicit origins instead of *")
+		}
+	}
+	for i, method := range conf.CORS.AllowedMethods {
+		conf.CORS.AllowedMethods[i] = strings.ToUpper(method)
+	}
+	if conf.CORS.MaxAge < 0 {
+		report.errorf("invalid config CORS.maxAge: must not be negative")
+	}
+	return config, report
 }
 
-func readCert(path string) (result []byte) {
-	abspath, err := filepath.Abs(path)
+// readConfigFile parses the config file into a mapping
+func readConfigFile(path string) (map[string]interface{}, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	result, err = ioutil.ReadFile(abspath)
-	if err != nil {
-		log.Fatal(err)
+	defer file.Close()
+
+	var values interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(file)
+	case ".toml":
+		values, err = parseTOML(file)
+	default:
+		err = json.NewDecoder(file).Decode(&values)
+	}
+	if err != nil || values == nil {
+		return nil, err
 	}
-	return
+	mapping, ok := values.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("expected a mapping of settings")
+	}
+	return mapping, nil
 }
 
-// Code from http://www.giantflyingsaucer.com/blog/?p=5994
-func readJWTKeys(configuration ServerConfig) (verifyKey *rsa.PublicKey, signKey *rsa.PrivateKey) {
-	var err error
+// getenv returns the environment variable name, or the content of the file named by name_FILE
+func getenv(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	value, err := ioutil.ReadFile(path)
+	return strings.TrimRight(string(value), "\r\n"), err
+}
 
-	if configuration.JWTPrivateRSAKey == "" {
-		err = errors.New("missing config key JWTPrivateRSAKey")
-		log.Print(err)
+// settingName is the name of a field in config files: its json tag or its Go name
+func settingName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("json"), ",")[0]; tag != "" {
+		return tag
 	}
-	if configuration.JWTPublicRSAKey == "" {
-		err = errors.New("missing config key JWTPublicRSAkey")
-		log.Print(err)
+	return field.Name
+}
+
+// decode stores value, as read from a config file or the environment, in target. Scalars are converted
+// to the type of the setting, e.g. LDAPPort: 389 in YAML to a string. Keys are matched ignoring case,
+// like encoding/json does, but other spellings and unknown keys are reported as warnings
+func (r *configReport) decode(target reflect.Value, value interface{}, path string) {
+	switch target.Kind() {
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			target.SetString(v)
+		case int64, bool:
+			target.SetString(fmt.Sprint(v))
+		case float64:
+			target.SetString(strconv.FormatFloat(v, 'f', -1, 64))
+		case nil:
+			target.SetString("")
+		default:
+			r.errorf("%s: expected a string", path)
+		}
+	case reflect.Int:
+		switch v := value.(type) {
+		case int64:
+			target.SetInt(v)
+		case float64:
+			if v != float64(int64(v)) {
+				r.errorf("%s: expected a whole number", path)
+				return
+			}
+			target.SetInt(int64(v))
+		case string:
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				r.errorf("%s: expected a number, got %q", path, v)
+				return
+			}
+			target.SetInt(int64(n))
+		default:
+			r.errorf("%s: expected a number", path)
+		}
+	case reflect.Float64:
+		switch v := value.(type) {
+		case float64:
+			target.SetFloat(v)
+		case int64:
+			target.SetFloat(float64(v))
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				r.errorf("%s: expected a number, got %q", path, v)
+				return
+			}
+			target.SetFloat(f)
+		default:
+			r.errorf("%s: expected a number", path)
+		}
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			target.SetBool(v)
+		case string:
+			b, err := strconv.ParseBool(strings.TrimSpace(v))
+			if err != nil {
+				r.errorf("%s: expected true or false, got %q", path, v)
+				return
+			}
+			target.SetBool(b)
+		default:
+			r.errorf("%s: expected true or false", path)
+		}
+	case reflect.Slice:
+		items, ok := value.([]interface{})
+		if text, isString := value.(string); isString && target.Type().Elem().Kind() == reflect.String {
+			// comma separated, as given in the environment
+			items, ok = []interface{}{}, true
+			for _, item := range strings.Split(text, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+		}
+		if !ok && value != nil {
+			r.errorf("%s: expected a list", path)
+			return
+		}
+		slice := reflect.MakeSlice(target.Type(), len(items), len(items))
+		for i, item := range items {
+			r.decode(slice.Index(i), item, fmt.Sprintf("%s[%d]", path, i))
+		}
+		target.Set(slice)
+	case reflect.Struct:
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			r.errorf("%s: expected a mapping", path)
+			return
+		}
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		prefix := ""
+		if path != "" {
+			prefix = path + "."
+		}
+		for _, key := range keys {
+			field, found := reflect.StructField{}, false
+			for i := 0; i < target.NumField() && !found; i++ {
+				field = target.Type().Field(i)
+				found = strings.EqualFold(settingName(field), key)
+			}
+			if !found {
+				r.warnf("unknown key %s%s is ignored", prefix, key)
+				continue
+			}
+			if name := settingName(field); name != key {
+				r.warnf("key %s%s should be written %s", prefix, key, name)
+			}
+			r.decode(target.FieldByIndex(field.Index), values[key], prefix+settingName(field))
+		}
 	}
-	if err != nil {
-		log.Fatal("incorrect config file")
+}
+
+// secretSetting matches settings whose values are masked by config check
+var secretSetting = regexp.MustCompile(`(?i)pass|secret|token`)
+
+// maskSecrets replaces the values of secret settings in v, a struct or slice of structs
+func maskSecrets(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			maskSecrets(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if field.Kind() == reflect.String && field.String() != "" && secretSetting.MatchString(v.Type().Field(i).Name) {
+				field.SetString("********")
+			} else {
+				maskSecrets(field)
+			}
+		}
 	}
+}
 
-	signBytes := readCert(configuration.JWTPrivateRSAKey)
-	signKey, err = jwt.ParseRSAPrivateKeyFromPEM(signBytes)
-	if err != nil {
-		log.Fatal(err)
+// cmdConfig validates the configuration, printing all problems and the effective settings
+func cmdConfig(args []string) error {
+	if len(args) != 1 || args[0] != "check" {
+		return errors.New("usage: usermanager [--config FILE] config check")
+	}
+	conf, report := parseConfig()
+	// check that the files named by the settings can be used
+	if _, err := loadJWTKeys(conf); err != nil {
+		report.errorf("JWT keys: %v", err)
+	}
+	if tlsConfigured(conf) {
+		if _, err := loadCertificate(conf); err != nil {
+			report.errorf("%v", err)
+		}
 	}
 
-	verifyBytes := readCert(configuration.JWTPublicRSAKey)
-	verifyKey, err = jwt.ParseRSAPublicKeyFromPEM(verifyBytes)
-	if err != nil {
-		log.Fatal(err)
+	fmt.Println("config file:", configFile)
+	for _, problem := range report.errors {
+		fmt.Println("error:", problem)
+	}
+	for _, warning := range report.warnings {
+		fmt.Println("warning:", warning)
 	}
 
-	return
+	// the webhooks are shared with conf, copy them before masking
+	conf.Webhooks = append([]WebhookConfig(nil), conf.Webhooks...)
+	maskSecrets(reflect.ValueOf(&conf).Elem())
+	fmt.Println("\neffective configuration:")
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(conf)
+
+	if len(report.errors) != 0 {
+		return errors.New("invalid configuration")
+	}
+	return nil
 }
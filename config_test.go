@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type testSettings struct {
+	Name    string
+	Port    string
+	Count   int
+	Rate    float64
+	Enabled bool
+	Origins []string
+	Lockout struct {
+		MaxFailures int
+	}
+	Hooks []struct {
+		URL string `json:"url"`
+	}
+}
+
+func TestConfigDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    yamlMap
+		check    func(s testSettings) bool
+		warnings []string
+		errors   []string
+	}{
+		{"strings", yamlMap{"Name": "um", "Port": int64(389)},
+			func(s testSettings) bool { return s.Name == "um" && s.Port == "389" }, nil, nil},
+		{"numbers as strings", yamlMap{"Port": 636.0, "Name": true},
+			func(s testSettings) bool { return s.Port == "636" && s.Name == "true" }, nil, nil},
+		{"ints", yamlMap{"Count": " 12 "}, func(s testSettings) bool { return s.Count == 12 }, nil, nil},
+		{"whole floats as ints", yamlMap{"Count": 3.0}, func(s testSettings) bool { return s.Count == 3 }, nil, nil},
+		{"floats", yamlMap{"Rate": int64(2)}, func(s testSettings) bool { return s.Rate == 2 }, nil, nil},
+		{"floats from strings", yamlMap{"Rate": "0.5"}, func(s testSettings) bool { return s.Rate == 0.5 }, nil, nil},
+		{"bools from strings", yamlMap{"Enabled": "true"}, func(s testSettings) bool { return s.Enabled }, nil, nil},
+		{"lists", yamlMap{"Origins": yamlList{"https://a", "https://b"}},
+			func(s testSettings) bool { return reflect.DeepEqual(s.Origins, []string{"https://a", "https://b"}) }, nil, nil},
+		{"comma separated lists", yamlMap{"Origins": "https://a, https://b,"},
+			func(s testSettings) bool { return reflect.DeepEqual(s.Origins, []string{"https://a", "https://b"}) }, nil, nil},
+		{"nested", yamlMap{"Lockout": yamlMap{"MaxFailures": int64(5)}, "Hooks": yamlList{yamlMap{"url": "https://x"}}},
+			func(s testSettings) bool {
+				return s.Lockout.MaxFailures == 5 && len(s.Hooks) == 1 && s.Hooks[0].URL == "https://x"
+			}, nil, nil},
+		{"keys ignore case", yamlMap{"name": "um", "LOCKOUT": yamlMap{"maxfailures": int64(5)}},
+			func(s testSettings) bool { return s.Name == "um" && s.Lockout.MaxFailures == 5 },
+			[]string{"key LOCKOUT should be written Lockout", "key Lockout.maxfailures should be written MaxFailures", "key name should be written Name"}, nil},
+		{"json tags", yamlMap{"Hooks": yamlList{yamlMap{"URL": "https://x"}}},
+			func(s testSettings) bool { return s.Hooks[0].URL == "https://x" }, []string{"key Hooks[0].URL should be written url"}, nil},
+		{"unknown keys", yamlMap{"Nmae": "um", "Lockout": yamlMap{"Max": int64(1)}},
+			func(s testSettings) bool { return s.Name == "" },
+			[]string{"unknown key Lockout.Max is ignored", "unknown key Nmae is ignored"}, nil},
+		{"wrong types", yamlMap{"Name": yamlList{}, "Count": "many", "Rate": true, "Enabled": "yes", "Origins": int64(1), "Lockout": "x"},
+			func(s testSettings) bool { return true }, nil, []string{
+				`Count: expected a number, got "many"`, `Enabled: expected true or false, got "yes"`,
+				"Lockout: expected a mapping", "Name: expected a string", "Origins: expected a list", "Rate: expected a number"}},
+		{"fractions", yamlMap{"Count": 1.5}, func(s testSettings) bool { return true }, nil, []string{"Count: expected a whole number"}},
+		{"list items", yamlMap{"Hooks": yamlList{"https://x"}}, func(s testSettings) bool { return true }, nil,
+			[]string{"Hooks[0]: expected a mapping"}},
+	}
+	for _, test := range tests {
+		var settings testSettings
+		var report configReport
+		report.decode(reflect.ValueOf(&settings).Elem(), map[string]interface{}(test.value), "")
+		if !test.check(settings) {
+			t.Errorf("%s: decoded %+v", test.name, settings)
+		}
+		if strings.Join(report.warnings, "\n") != strings.Join(test.warnings, "\n") {
+			t.Errorf("%s: warnings %q, want %q", test.name, report.warnings, test.warnings)
+		}
+		if strings.Join(report.errors, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("%s: errors %q, want %q", test.name, report.errors, test.errors)
+		}
+	}
+}
+
+func TestGetenv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "getenv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	secretFile := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secretFile, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		env       map[string]string
+		want      string
+		wantError bool
+	}{
+		{"unset", nil, "", false},
+		{"value", map[string]string{"UM_TEST_SECRET": "value"}, "value", false},
+		{"file", map[string]string{"UM_TEST_SECRET_FILE": secretFile}, "s3cr3t", false},
+		{"value before file", map[string]string{"UM_TEST_SECRET": "value", "UM_TEST_SECRET_FILE": secretFile}, "value", false},
+		{"missing file", map[string]string{"UM_TEST_SECRET_FILE": filepath.Join(dir, "missing")}, "", true},
+	}
+	for _, test := range tests {
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+		got, err := getenv("UM_TEST_SECRET")
+		os.Unsetenv("UM_TEST_SECRET")
+		os.Unsetenv("UM_TEST_SECRET_FILE")
+		if (err != nil) != test.wantError || got != test.want {
+			t.Errorf("%s: got %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
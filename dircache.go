@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The directory cache keeps all users and groups in memory, so list endpoints and membership checks
+// do not search the whole subtree on every request. It is reloaded periodically, after every change
+// reported by content synchronization (RFC 4533) if the server supports it, and after our own writes.
+
+// directory is the cache used by the server, nil if caching is disabled (and in the CLI)
+var directory *directoryCache
+
+type directoryCache struct {
+	mu         sync.RWMutex
+	users      []UserEntry
+	groups     []GroupEntry
+	loaded     time.Time
+	valid      bool
+	generation uint64 // incremented by invalidate, loads started before are discarded
+
+	watching *wireConn // connection of the content synchronization search
+	stopped  bool
+
+	loading sync.Mutex    // only one load at a time
+	changed chan struct{} // wakes up run after invalidations
+	refresh time.Duration // reload interval
+}
+
+func newDirectoryCache(refresh time.Duration) *directoryCache {
+	return &directoryCache{refresh: refresh, changed: make(chan struct{}, 1)}
+}
+
+// run reloads the cache every refresh interval and shortly after invalidations
+func (c *directoryCache) run() {
+	if err := c.load(context.Background()); err != nil {
+		logWarn("directory cache: initial load failed", "error", err)
+	}
+	ticker := time.NewTicker(c.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.changed:
+			// collect the notifications of changes to several entries
+			time.Sleep(time.Second)
+		}
+		if err := c.load(context.Background()); err != nil {
+			logWarn("directory cache: reload failed", "error", err)
+		}
+	}
+}
+
+// watch invalidates the cache on every change reported by content synchronization. Without
+// server support, the cache falls back to the periodic reload
+func (c *directoryCache) watch() {
+	for {
+		conn, err := wireConnectAdmin(context.Background())
+		if err == nil {
+			c.mu.Lock()
+			c.watching = conn
+			stopped := c.stopped
+			c.mu.Unlock()
+			if stopped {
+				conn.Close()
+				return
+			}
+			err = conn.watchChanges("(|(objectClass=organizationalPerson)(objectClass=groupOfUniqueNames))", c.invalidate)
+			conn.Close()
+		}
+		c.mu.RLock()
+		stopped := c.stopped
+		c.mu.RUnlock()
+		if stopped {
+			return
+		}
+		if err == errSyncUnsupported {
+			logWarn("directory cache: content synchronization unavailable, reloading periodically", "error", err, "refresh", c.refresh.String())
+			return
+		}
+		logWarn("directory cache: content synchronization interrupted", "error", err)
+		// changes may have been missed while the search was not running
+		c.invalidate()
+		time.Sleep(30 * time.Second)
+	}
+}
+
+// stop ends content synchronization and closes its connection
+func (c *directoryCache) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	if c.watching != nil {
+		c.watching.Close()
+	}
+}
+
+// invalidate marks the cache as stale. The next read or the background loop reloads it
+func (c *directoryCache) invalidate() {
+	c.mu.Lock()
+	c.valid = false
+	c.generation++
+	c.mu.Unlock()
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// load reads all users and groups from LDAP
+func (c *directoryCache) load(ctx context.Context) error {
+	c.loading.Lock()
+	defer c.loading.Unlock()
+	c.mu.RLock()
+	generation := c.generation
+	c.mu.RUnlock()
+
+	users, err := pLDAPListUsers(ctx, "(objectClass=organizationalPerson)")
+	if err != nil {
+		return err
+	}
+	groups, err := pLDAPListGroups(ctx, "(objectClass=groupOfUniqueNames)")
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation == generation {
+		c.users, c.groups, c.loaded, c.valid = users, groups, time.Now(), true
+	}
+	return nil
+}
+
+// snapshot returns the cached users and groups, loading them first if the cache is stale.
+// The returned slices are copies, callers may reorder them
+func (c *directoryCache) snapshot(ctx context.Context) ([]UserEntry, []GroupEntry, error) {
+	for attempt := 0; ; attempt++ {
+		c.mu.RLock()
+		if c.valid {
+			users := append([]UserEntry(nil), c.users...)
+			groups := append([]GroupEntry(nil), c.groups...)
+			c.mu.RUnlock()
+			return users, groups, nil
+		}
+		c.mu.RUnlock()
+		if attempt == 2 {
+			// invalidated during every load, read directly
+			users, err := pLDAPListUsers(ctx, "(objectClass=organizationalPerson)")
+			if err != nil {
+				return nil, nil, err
+			}
+			groups, err := pLDAPListGroups(ctx, "(objectClass=groupOfUniqueNames)")
+			return users, groups, err
+		}
+		if err := c.load(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// InvalidateCacheMiddleware invalidates the directory cache after requests that may change the directory
+func InvalidateCacheMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+		if directory != nil && r.Method != "GET" && r.Method != "HEAD" && r.Method != "OPTIONS" {
+			directory.invalidate()
+		}
+	})
+}
+
+// invalidateDirectory marks the cache as stale after a write, so reads after it in the same request reload
+// and loads started before it are discarded
+func invalidateDirectory() {
+	if directory != nil {
+		directory.invalidate()
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// doctor scans LDAPBaseDN for inconsistencies and optionally repairs them. Only repairs that cannot
+// lose data are applied automatically, everything else is reported for an admin to decide.
+
+// doctor checks
+const (
+	checkMissingAttribute = "missing_attribute"
+	checkNoGroup          = "user_without_group"
+	checkNotListed        = "user_not_listed"
+	checkDanglingMember   = "dangling_member"
+	checkDanglingOwner    = "dangling_owner"
+	checkDuplicateCN      = "duplicate_cn"
+	checkPlaceholderOnly  = "placeholder_only"
+)
+
+// finding severities
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Finding is an inconsistency found by doctor
+type Finding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	DN       string `json:"dn"`
+	Message  string `json:"message"`
+	Fixable  bool   `json:"fixable"`
+	Fixed    bool   `json:"fixed"`
+	Error    string `json:"error,omitempty"`
+
+	fix func() error // nil if the finding cannot be repaired automatically
+}
+
+// doctorScan is a snapshot of the entries below LDAPBaseDN
+type doctorScan struct {
+	entries  []*ldap.Entry
+	existing map[string]bool // normalized DNs
+	users    []*ldap.Entry
+	groups   []*ldap.Entry
+}
+
+// attributes a user needs to be shown and edited correctly
+var requiredUserAttributes = []string{"cn", "sn", "displayName", "userPassword"}
+
+// runDoctor scans the directory and returns the findings of all checks
+func runDoctor(ctx context.Context) ([]Finding, error) {
+	scan, err := scanDirectory(ctx)
+	if err != nil {
+		return nil, err
+	}
+	findings := checkUserAttributes(ctx, scan)
+	findings = append(findings, checkUserGroups(scan)...)
+	dangling, err := checkDanglingReferences(ctx, scan)
+	if err != nil {
+		return nil, err
+	}
+	findings = append(findings, dangling...)
+	findings = append(findings, checkDuplicateNames(scan)...)
+	findings = append(findings, checkPlaceholderGroups(scan)...)
+	return findings, nil
+}
+
+// fixFindings applies the safe repairs and records their outcome in the findings
+func fixFindings(findings []Finding, actor string) {
+	for i := range findings {
+		if findings[i].fix == nil {
+			continue
+		}
+		err := findings[i].fix()
+		auditLog(actor, "doctor.fix."+findings[i].Check, findings[i].DN, err)
+		if err != nil {
+			findings[i].Error = err.Error()
+		} else {
+			findings[i].Fixed = true
+		}
+	}
+}
+
+func scanDirectory(ctx context.Context) (*doctorScan, error) {
+	// bound as admin, so userPassword is readable
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	scan := &doctorScan{existing: map[string]bool{normalizeDN(configuration().LDAPAdmin): true}}
+	attributes := []string{"objectClass", "cn", "sn", "displayName", "userPassword", "memberOf", "uniqueMember", "owner"}
+	err = pLDAPSearchEachConn(l, attributes, "(objectClass=*)", func(entry *ldap.Entry) error {
+		scan.entries = append(scan.entries, entry)
+		scan.existing[normalizeDN(entry.DN)] = true
+		if hasObjectClass(entry, "organizationalPerson") {
+			scan.users = append(scan.users, entry)
+		}
+		if hasObjectClass(entry, "groupOfUniqueNames") {
+			scan.groups = append(scan.groups, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scan, nil
+}
+
+func hasObjectClass(entry *ldap.Entry, class string) bool {
+	for _, value := range entry.GetAttributeValues("objectClass") {
+		if strings.EqualFold(value, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUserAttributes finds users without the attributes usermanager sets on creation. Missing sn and
+// displayName are repaired by copying the cn
+func checkUserAttributes(ctx context.Context, scan *doctorScan) []Finding {
+	var findings []Finding
+	for _, user := range scan.users {
+		cn := user.GetAttributeValue("cn")
+		for _, attribute := range requiredUserAttributes {
+			if len(user.GetAttributeValues(attribute)) != 0 {
+				continue
+			}
+			finding := Finding{
+				Check:    checkMissingAttribute,
+				Severity: severityError,
+				DN:       user.DN,
+				Message:  "user has no " + attribute,
+			}
+			if cn != "" && (attribute == "sn" || attribute == "displayName") {
+				dn, attributes := user.DN, map[string][]string{attribute: {cn}}
+				finding.Message += ", set to " + cn
+				finding.fix = func() error { return LDAPReplaceAttributes(ctx, dn, attributes) }
+			}
+			findings = append(findings, finding)
+		}
+	}
+	return findings
+}
+
+// checkUserGroups finds users that are in no group, and users the v1 user list skips because
+// they have no memberOf values, e.g. because the memberOf overlay was enabled after they joined
+func checkUserGroups(scan *doctorScan) []Finding {
+	members := map[string]bool{}
+	for _, group := range scan.groups {
+		for _, member := range group.GetAttributeValues("uniqueMember") {
+			members[normalizeDN(member)] = true
+		}
+	}
+	var findings []Finding
+	for _, user := range scan.users {
+		if !members[normalizeDN(user.DN)] {
+			findings = append(findings, Finding{
+				Check:    checkNoGroup,
+				Severity: severityWarning,
+				DN:       user.DN,
+				Message:  "user is not a member of any group",
+			})
+		} else if len(user.GetAttributeValues("memberOf")) == 0 {
+			findings = append(findings, Finding{
+				Check:    checkNotListed,
+				Severity: severityError,
+				DN:       user.DN,
+				Message:  "user is a group member but has no memberOf values and is skipped by /api/users/list, is the memberOf overlay enabled?",
+			})
+		}
+	}
+	return findings
+}
+
+// checkDanglingReferences finds uniqueMember and owner values that point to entries that do not exist.
+// Repairs remove the value
+func checkDanglingReferences(ctx context.Context, scan *doctorScan) ([]Finding, error) {
+	// references outside of the base DN are looked up one by one
+	exists := func(dn string) (bool, error) {
+		key := normalizeDN(dn)
+		if found, ok := scan.existing[key]; ok {
+			return found, nil
+		}
+		entry, err := pLDAPReadEntry(ctx, dn)
+		if err != nil {
+			return false, err
+		}
+		scan.existing[key] = entry != nil
+		return entry != nil, nil
+	}
+
+	var findings []Finding
+	for _, group := range scan.entries {
+		for _, attribute := range []string{"uniqueMember", "owner"} {
+			for _, value := range group.GetAttributeValues(attribute) {
+				found, err := exists(value)
+				if err != nil {
+					return nil, err
+				}
+				if found {
+					continue
+				}
+				check := checkDanglingMember
+				if attribute == "owner" {
+					check = checkDanglingOwner
+				}
+				ref, dn := dnReference{group.DN, attribute}, value
+				findings = append(findings, Finding{
+					Check:    check,
+					Severity: severityError,
+					DN:       group.DN,
+					Message:  attribute + " " + value + " does not exist",
+					fix:      func() error { return removeDNReference(ctx, ref, dn) },
+				})
+			}
+		}
+	}
+	return findings, nil
+}
+
+// checkDuplicateNames finds users and groups sharing a cn. Lookups by name do not find such entries
+func checkDuplicateNames(scan *doctorScan) []Finding {
+	byName := map[string][]string{}
+	for _, entry := range append(append([]*ldap.Entry{}, scan.users...), scan.groups...) {
+		name := strings.ToLower(entry.GetAttributeValue("cn"))
+		if name != "" {
+			byName[name] = append(byName[name], entry.DN)
+		}
+	}
+	var findings []Finding
+	for name, dns := range byName {
+		if len(dns) < 2 {
+			continue
+		}
+		sort.Strings(dns)
+		for _, dn := range dns {
+			findings = append(findings, Finding{
+				Check:    checkDuplicateCN,
+				Severity: severityError,
+				DN:       dn,
+				Message:  fmt.Sprintf("cn %s is used by %d entries: %s", name, len(dns), strings.Join(dns, "; ")),
+			})
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].DN < findings[j].DN })
+	return findings
+}
+
+// checkPlaceholderGroups finds groups whose only member is the LDAP admin placeholder
+func checkPlaceholderGroups(scan *doctorScan) []Finding {
+	var findings []Finding
+	for _, group := range scan.groups {
+		members := group.GetAttributeValues("uniqueMember")
+		if len(members) != 0 && len(withoutPlaceholder(members)) == 0 {
+			findings = append(findings, Finding{
+				Check:    checkPlaceholderOnly,
+				Severity: severityWarning,
+				DN:       group.DN,
+				Message:  "group has no members besides the placeholder " + configuration().LDAPAdmin,
+			})
+		}
+	}
+	return findings
+}
+
+// doctorResult is the response of the doctor endpoint
+type doctorResult struct {
+	Findings []Finding `json:"findings"`
+}
+
+// V2Doctor runs the doctor checks. With fix, the safe repairs are applied
+func V2Doctor(fix bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		findings, err := runDoctor(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		markFixable(findings)
+		if fix {
+			fixFindings(findings, requestActor(r))
+		}
+		if findings == nil {
+			findings = []Finding{}
+		}
+		writeJSON(w, http.StatusOK, doctorResult{findings})
+	})
+}
+
+func markFixable(findings []Finding) {
+	for i := range findings {
+		findings[i].Fixable = findings[i].fix != nil
+	}
+}
+
+func cmdDoctor(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "apply the safe repairs")
+	asJSON := flags.Bool("json", false, "print findings as JSON")
+	flags.Parse(args)
+	readConfig()
+
+	findings, err := runDoctor(ctx)
+	if err != nil {
+		return err
+	}
+	markFixable(findings)
+	if *fix {
+		fixFindings(findings, cliActor())
+	}
+
+	if *asJSON {
+		if findings == nil {
+			findings = []Finding{}
+		}
+		json.NewEncoder(os.Stdout).Encode(doctorResult{findings})
+	} else {
+		fixable := 0
+		for _, finding := range findings {
+			line := finding.Severity + "  " + finding.Check + "  " + finding.DN + "  " + finding.Message
+			if finding.Fixed {
+				line += "  (fixed)"
+			} else if finding.Error != "" {
+				line += "  (fix failed: " + finding.Error + ")"
+			} else if finding.Fixable {
+				fixable++
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("\n%d findings\n", len(findings))
+		if fixable != 0 {
+			fmt.Printf("run with -fix to repair %d of them\n", fixable)
+		}
+	}
+	for _, finding := range findings {
+		if finding.Severity == severityError && !finding.Fixed {
+			return errors.New("directory has unresolved errors")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// default columns of CSV exports
+var exportCSVAttributes = []string{"dn", "cn", "displayName", "mail", "memberOf", "uniqueMember"}
+
+// ExportOptions select what is exported and how
+type ExportOptions struct {
+	Format           string   // ldif, csv or json
+	Type             string   // users, groups or all
+	Attributes       []string // CSV columns
+	IncludePasswords bool     // include userPassword hashes
+}
+
+// exportWriter writes entries in one of the export formats
+type exportWriter interface {
+	begin() error
+	entry(e *ldap.Entry) error
+	end() error
+}
+
+// exportDirectory streams all users and/or groups under LDAPBaseDN to w
+func exportDirectory(ctx context.Context, w io.Writer, opts ExportOptions) error {
+	var filter string
+	switch opts.Type {
+	case "users":
+		filter = "(objectClass=organizationalPerson)"
+	case "groups":
+		filter = "(objectClass=groupOfUniqueNames)"
+	case "all", "":
+		filter = "(|(objectClass=organizationalPerson)(objectClass=groupOfUniqueNames))"
+	default:
+		return fmt.Errorf("unknown export type %q", opts.Type)
+	}
+
+	buffered := bufio.NewWriter(w)
+	var out exportWriter
+	switch opts.Format {
+	case "ldif", "":
+		out = &ldifExporter{w: buffered}
+	case "csv":
+		attributes := opts.Attributes
+		if len(attributes) == 0 {
+			attributes = exportCSVAttributes
+		}
+		out = &csvExporter{w: csv.NewWriter(buffered), attributes: attributes}
+	case "json":
+		out = &jsonExporter{w: buffered}
+	default:
+		return fmt.Errorf("unknown export format %q", opts.Format)
+	}
+
+	// password hashes are only readable when bound as admin
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	if err = out.begin(); err != nil {
+		return err
+	}
+	err = pLDAPSearchEachConn(l, []string{"*", "memberOf"}, filter, func(e *ldap.Entry) error {
+		if !opts.IncludePasswords {
+			e = withoutAttribute(e, "userPassword")
+		}
+		if err := out.entry(e); err != nil {
+			return err
+		}
+		// hand entries to the client as soon as they arrive
+		return buffered.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if err = out.end(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
+
+func withoutAttribute(e *ldap.Entry, name string) *ldap.Entry {
+	filtered := &ldap.Entry{DN: e.DN}
+	for _, attr := range e.Attributes {
+		if !strings.EqualFold(attr.Name, name) {
+			filtered.Attributes = append(filtered.Attributes, attr)
+		}
+	}
+	return filtered
+}
+
+// ldifExporter writes LDIF content records (RFC 2849)
+type ldifExporter struct {
+	w *bufio.Writer
+}
+
+func (x *ldifExporter) begin() error {
+	_, err := x.w.WriteString("version: 1\n")
+	return err
+}
+
+func (x *ldifExporter) entry(e *ldap.Entry) error {
+	x.w.WriteString("\n")
+	writeLDIFLine(x.w, "dn", []byte(e.DN))
+	for _, attr := range e.Attributes {
+		for _, value := range attr.ByteValues {
+			writeLDIFLine(x.w, attr.Name, value)
+		}
+	}
+	return nil
+}
+
+func (x *ldifExporter) end() error { return nil }
+
+// writeLDIFLine writes `name: value`, base64 encoding values that are not SAFE-STRINGs
+// and folding lines longer than 76 characters
+func writeLDIFLine(w *bufio.Writer, name string, value []byte) {
+	line := name + ": " + string(value)
+	if !ldifSafeString(value) {
+		line = name + ":: " + base64.StdEncoding.EncodeToString(value)
+	}
+	// continuation lines start with a space, so they carry one character less
+	width := 76
+	for len(line) > width {
+		w.WriteString(line[:width] + "\n ")
+		line = line[width:]
+		width = 75
+	}
+	w.WriteString(line + "\n")
+}
+
+func ldifSafeString(value []byte) bool {
+	if len(value) == 0 {
+		return true
+	}
+	if value[0] == ' ' || value[0] == ':' || value[0] == '<' || value[len(value)-1] == ' ' {
+		return false
+	}
+	for _, c := range value {
+		if c == 0 || c == '\n' || c == '\r' || c > 127 {
+			return false
+		}
+	}
+	return true
+}
+
+// csvExporter writes one row per entry with the configured attributes as columns.
+// Multiple values are separated by `;`
+type csvExporter struct {
+	w          *csv.Writer
+	attributes []string
+}
+
+func (x *csvExporter) begin() error {
+	return x.w.Write(x.attributes)
+}
+
+func (x *csvExporter) entry(e *ldap.Entry) error {
+	record := make([]string, len(x.attributes))
+	for i, name := range x.attributes {
+		if strings.EqualFold(name, "dn") {
+			record[i] = e.DN
+			continue
+		}
+		for _, attr := range e.Attributes {
+			if strings.EqualFold(attr.Name, name) {
+				record[i] = strings.Join(attr.Values, ";")
+			}
+		}
+	}
+	if err := x.w.Write(record); err != nil {
+		return err
+	}
+	x.w.Flush()
+	return x.w.Error()
+}
+
+func (x *csvExporter) end() error {
+	x.w.Flush()
+	return x.w.Error()
+}
+
+// jsonExporter writes a JSON array of {"dn", "attributes"} objects
+type jsonExporter struct {
+	w     *bufio.Writer
+	count int
+}
+
+func (x *jsonExporter) begin() error {
+	_, err := x.w.WriteString("[")
+	return err
+}
+
+func (x *jsonExporter) entry(e *ldap.Entry) error {
+	attributes := map[string][]string{}
+	for _, attr := range e.Attributes {
+		attributes[attr.Name] = attr.Values
+	}
+	data, err := json.Marshal(map[string]interface{}{"dn": e.DN, "attributes": attributes})
+	if err != nil {
+		return err
+	}
+	if x.count > 0 {
+		x.w.WriteString(",")
+	}
+	x.count++
+	x.w.WriteString("\n")
+	_, err = x.w.Write(data)
+	return err
+}
+
+func (x *jsonExporter) end() error {
+	_, err := x.w.WriteString("\n]\n")
+	return err
+}
+
+// Export streams the directory. Query parameters: format=ldif|csv|json, type=users|groups|all,
+// attributes=cn,mail,... (CSV columns) and include_passwords=true
+func Export() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		opts := ExportOptions{
+			Format:           query.Get("format"),
+			Type:             query.Get("type"),
+			IncludePasswords: query.Get("include_passwords") == "true",
+		}
+		if opts.Format == "" {
+			opts.Format = "ldif"
+		}
+		if attributes := query.Get("attributes"); attributes != "" {
+			opts.Attributes = strings.Split(attributes, ",")
+		}
+
+		contentTypes := map[string]string{"ldif": "text/x-ldif", "csv": "text/csv", "json": "application/json"}
+		contentType, ok := contentTypes[opts.Format]
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Error: unknown export format " + opts.Format))
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", "attachment; filename=\"usermanager-export."+opts.Format+"\"")
+
+		cw := &countingWriter{w: w}
+		if err := exportDirectory(r.Context(), cw, opts); err != nil {
+			if cw.n != 0 {
+				// the export is already streamed, a truncated body is all we can do
+				logError("export aborted", "error", err, "request_id", requestID(r.Context()))
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Del("Content-Disposition")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error occurred: " + err.Error()))
+		}
+	})
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
+
+func cmdExport(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	format := flags.String("format", "ldif", "ldif, csv or json")
+	typ := flags.String("type", "all", "users, groups or all")
+	attributes := flags.String("attributes", strings.Join(exportCSVAttributes, ","), "comma separated CSV columns")
+	passwords := flags.Bool("include-passwords", false, "include password hashes")
+	output := flags.String("o", "", "output file (default: stdout)")
+	flags.Parse(args)
+	if flags.NArg() != 0 {
+		return errors.New("usage: usermanager export [flags]")
+	}
+
+	readConfig()
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return exportDirectory(ctx, w, ExportOptions{
+		Format:           *format,
+		Type:             *typ,
+		Attributes:       strings.Split(*attributes, ","),
+		IncludePasswords: *passwords,
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteLDIFLine(t *testing.T) {
+	tests := []struct {
+		name, attr string
+		value      []byte
+		encoded    bool
+	}{
+		{"short", "cn", []byte("bilbo"), false},
+		{"exactly one line", "description", []byte(strings.Repeat("x", 76-len("description: "))), false},
+		{"one more", "description", []byte(strings.Repeat("x", 77-len("description: "))), false},
+		{"several lines", "description", []byte(strings.Repeat("abcdefghij", 30)), false},
+		{"base64", "description", []byte(strings.Repeat("Beutlin ä ", 20)), true},
+		{"leading space", "sn", []byte(" Baggins"), true},
+		{"empty", "mail", []byte{}, false},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		writeLDIFLine(w, test.attr, test.value)
+		w.Flush()
+
+		lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		for i, line := range lines {
+			if len(line) > 76 {
+				t.Errorf("%s: line %d has %d characters", test.name, i+1, len(line))
+			}
+			if i > 0 && !strings.HasPrefix(line, " ") {
+				t.Errorf("%s: continuation line %d does not start with a space", test.name, i+1)
+			}
+		}
+
+		records, err := parseLDIF(strings.NewReader("dn: cn=x\n" + buf.String()))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		attributes := records[0].Attributes
+		if len(attributes) != 1 || attributes[0].Name != test.attr || attributes[0].Values[0] != string(test.value) {
+			t.Errorf("%s: read back %+v", test.name, attributes)
+		}
+		if encoded := strings.HasPrefix(buf.String(), test.attr+":: "); encoded != test.encoded {
+			t.Errorf("%s: base64 = %v, want %v", test.name, encoded, test.encoded)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Group metadata is stored in attributes of groupOfUniqueNames: description, owner and
+// businessCategory (`private` hides the group from users that are not members or owners).
+// mail is not part of groupOfUniqueNames, groups with mail get the extensibleObject class.
+
+// group visibilities
+const (
+	groupPublic  = "public"
+	groupPrivate = "private"
+)
+
+// groupVisibility derives the visibility of a group from its businessCategory values
+func groupVisibility(categories []string) string {
+	for _, category := range categories {
+		if strings.EqualFold(category, groupPrivate) {
+			return groupPrivate
+		}
+	}
+	return groupPublic
+}
+
+// withoutPlaceholder removes the LDAP admin, which is added to every new group because
+// groupOfUniqueNames requires a member, from a list of member DNs
+func withoutPlaceholder(members []string) []string {
+	result := make([]string, 0, len(members))
+	for _, dn := range members {
+		if normalizeDN(dn) != normalizeDN(configuration().LDAPAdmin) {
+			result = append(result, dn)
+		}
+	}
+	return result
+}
+
+// resolveOwner returns the DN of the user or group with the given name
+func resolveOwner(ctx context.Context, name string) (string, error) {
+	user, err := LDAPGetUser(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if user != nil {
+		return user.DN, nil
+	}
+	group, err := LDAPGetGroup(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if group != nil {
+		return group.DN, nil
+	}
+	return "", errors.New("owner " + name + " is neither a user nor a group")
+}
+
+// LDAPSetGroupMetadata replaces the given metadata attributes of the group dn
+func LDAPSetGroupMetadata(ctx context.Context, dn string, attributes map[string][]string) error {
+	if len(attributes["mail"]) != 0 {
+		l, err := pLDAPConnectAdmin(ctx)
+		if err != nil {
+			return err
+		}
+		mr := ldap.NewModifyRequest(dn)
+		mr.Add("objectClass", []string{"extensibleObject"})
+		err = l.Modify(mr)
+		l.Close()
+		if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) {
+			return err
+		}
+	}
+	return LDAPReplaceAttributes(ctx, dn, attributes)
+}
+
+// isGroupOwner reports whether dn owns group, directly or as member of an owning group
+func isGroupOwner(graph *groupGraph, group *GroupEntry, dn string) bool {
+	for _, owner := range group.Owners {
+		if normalizeDN(owner) == normalizeDN(dn) || graph.contains(owner, dn) {
+			return true
+		}
+	}
+	return false
+}
+
+// isGroupVisible reports whether the user dn may see group: public groups are visible to everyone,
+// private groups only to their members and owners
+func isGroupVisible(graph *groupGraph, group *GroupEntry, dn string) bool {
+	return group.Visibility != groupPrivate || graph.contains(group.DN, dn) || isGroupOwner(graph, group, dn)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Liveness and readiness probes for Docker, systemd and load balancers. /healthz only reports that the
+// process serves requests, /readyz checks the dependencies the API needs.
+
+const (
+	readinessTimeout      = 3 * time.Second  // per LDAP request of the readiness check
+	readinessCheckTimeout = 10 * time.Second // for the whole readiness check
+	readinessCacheTTL     = 5 * time.Second  // probes within this time get the previous report
+)
+
+// check states
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+)
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// ReadinessReport is the response of /readyz
+type ReadinessReport struct {
+	Status  string                 `json:"status"`
+	Checked time.Time              `json:"checked"`
+	Checks  map[string]CheckResult `json:"checks"`
+}
+
+var readiness struct {
+	mu     sync.Mutex
+	report *ReadinessReport
+}
+
+// runCheck runs check and measures its latency
+func runCheck(check func() error) CheckResult {
+	start := time.Now()
+	err := check()
+	result := CheckResult{Status: checkOK, LatencyMS: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status, result.Error = checkFail, err.Error()
+	}
+	return result
+}
+
+// checkReadiness binds to LDAP as admin, reads LDAPBaseDN and checks that the JWT keys are loaded
+func checkReadiness(ctx context.Context) *ReadinessReport {
+	report := &ReadinessReport{Status: checkOK, Checked: time.Now().UTC(), Checks: map[string]CheckResult{}}
+
+	var l *ldapConn
+	report.Checks["ldap_bind"] = runCheck(func() error {
+		var err error
+		if l, err = dialLDAPTimeout(ctx, readinessTimeout); err != nil {
+			return err
+		}
+		return l.Bind(configuration().LDAPAdmin, configuration().LDAPPass)
+	})
+	if l != nil {
+		defer l.Close()
+	}
+	if report.Checks["ldap_bind"].Status == checkOK {
+		report.Checks["ldap_base"] = runCheck(func() error {
+			_, err := l.Search(ldap.NewSearchRequest(configuration().LDAPBaseDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+				0, int(readinessTimeout.Seconds()), false, "(objectClass=*)", []string{"1.1"}, nil))
+			return err
+		})
+	} else {
+		report.Checks["ldap_base"] = CheckResult{Status: checkFail, Error: "skipped, bind failed"}
+	}
+	report.Checks["jwt_keys"] = runCheck(func() error {
+		if currentJWTKeys() == nil {
+			return errors.New("JWT keys are not loaded")
+		}
+		return nil
+	})
+
+	for _, result := range report.Checks {
+		if result.Status != checkOK {
+			report.Status = checkFail
+		}
+	}
+	return report
+}
+
+// cachedReadiness returns the last report if it is recent, so that frequent probes do not load slapd.
+// Concurrent probes wait for a single check. The report is shared, so the check does not use the
+// context of the probe that triggered it, which a disconnecting client would cancel for everyone
+func cachedReadiness(ctx context.Context) *ReadinessReport {
+	readiness.mu.Lock()
+	defer readiness.mu.Unlock()
+	if readiness.report == nil || time.Since(readiness.report.Checked) > readinessCacheTTL {
+		checkCtx, cancel := context.WithTimeout(withRequestID(context.Background(), requestID(ctx)), readinessCheckTimeout)
+		readiness.report = checkReadiness(checkCtx)
+		cancel()
+	}
+	return readiness.report
+}
+
+// Healthz reports that the server is alive
+func Healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": checkOK})
+	})
+}
+
+// Readyz reports whether the server can handle API requests, with 503 if a check fails
+func Readyz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			w.Header().Set("Cache-Control", "no-store")
+			writeJSON(w, http.StatusServiceUnavailable, ReadinessReport{Status: checkFail, Checked: time.Now().UTC(),
+				Checks: map[string]CheckResult{"shutdown": {Status: checkFail, Error: "shutting down"}}})
+			return
+		}
+		report := cachedReadiness(r.Context())
+		status := http.StatusOK
+		if report.Status != checkOK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		writeJSON(w, status, report)
+	})
+}
+
+// cmdHealthcheck probes the running server, for container images without curl
+func cmdHealthcheck(args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	ready := flags.Bool("ready", false, "check /readyz instead of /healthz")
+	flags.Parse(args)
+	readConfig()
+
+	host, port, err := net.SplitHostPort(configuration().ServerBindAddr)
+	if err != nil {
+		return err
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "localhost"
+	}
+	scheme := "http"
+	if tlsConfigured(*configuration()) {
+		scheme = "https"
+	}
+	path := "/healthz"
+	if *ready {
+		path = "/readyz"
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		// the certificate is issued for the public name, not for localhost
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	response, err := client.Get(scheme + "://" + net.JoinHostPort(host, port) + prefixed(path))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	var report ReadinessReport
+	json.NewDecoder(response.Body).Decode(&report)
+	for name, result := range report.Checks {
+		fmt.Printf("%s: %s %.1fms %s\n", name, result.Status, result.LatencyMS, result.Error)
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", path, response.Status)
+	}
+	return nil
+}
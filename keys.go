@@ -0,0 +1,419 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// JWTs are signed with RSA (RS256), ECDSA (ES256, ES384 or ES512 by curve) or Ed25519 (EdDSA) keys,
+// chosen by the type of the configured key. Tokens signed with another algorithm are rejected.
+
+// jwtKeys are the keys signing and verifying tokens
+type jwtKeys struct {
+	verify    crypto.PublicKey
+	sign      crypto.Signer
+	method    jwt.SigningMethod
+	ephemeral bool // generated in dev mode, not read from files
+}
+
+// currentJWTKeys returns the keys in use, nil before they are loaded
+func currentJWTKeys() *jwtKeys {
+	keys, _ := configState.keys.Load().(*jwtKeys)
+	return keys
+}
+
+// equal reports whether k and other hold the same key pair
+func (k *jwtKeys) equal(other *jwtKeys) bool {
+	if k == nil || other == nil {
+		return k == other
+	}
+	public, ok := k.verify.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && public.Equal(other.verify)
+}
+
+// readJWTKeys loads the JWT keys of the configuration and exits if they cannot be read
+func readJWTKeys() {
+	keys, err := loadJWTKeys(*configuration())
+	if err != nil {
+		log.Fatal(err)
+	}
+	configState.keys.Store(keys)
+}
+
+// loadJWTKeys reads the keys configured in conf. In dev mode, missing keys are generated
+func loadJWTKeys(conf ServerConfig) (*jwtKeys, error) {
+	if conf.JWTPrivateRSAKey == "" {
+		return nil, errors.New("missing config key JWTPrivateRSAKey")
+	}
+	if conf.JWTPublicRSAKey == "" {
+		return nil, errors.New("missing config key JWTPublicRSAkey")
+	}
+
+	signBytes, err := ioutil.ReadFile(conf.JWTPrivateRSAKey)
+	if os.IsNotExist(err) && conf.DevMode {
+		return ephemeralJWTKeys()
+	}
+	if err != nil {
+		return nil, err
+	}
+	signKey, err := parsePrivateKeyPEM(signBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", conf.JWTPrivateRSAKey, err)
+	}
+
+	verifyBytes, err := ioutil.ReadFile(conf.JWTPublicRSAKey)
+	if err != nil {
+		return nil, err
+	}
+	verifyKey, err := parsePublicKeyPEM(verifyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", conf.JWTPublicRSAKey, err)
+	}
+
+	keys := &jwtKeys{verify: verifyKey, sign: signKey}
+	if !keys.equal(&jwtKeys{verify: signKey.Public()}) {
+		return nil, fmt.Errorf("%s is not the public key of %s", conf.JWTPublicRSAKey, conf.JWTPrivateRSAKey)
+	}
+	if keys.method, err = jwtSigningMethod(signKey); err != nil {
+		return nil, fmt.Errorf("%s: %v", conf.JWTPrivateRSAKey, err)
+	}
+	return keys, nil
+}
+
+// ephemeralJWTKeys generates keys that are lost on restart, so every restart invalidates all tokens
+func ephemeralJWTKeys() (*jwtKeys, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	logWarn("dev mode: JWT keys not found, signing tokens with an ephemeral key")
+	return &jwtKeys{verify: key.Public(), sign: key, method: signingMethodEdDSA, ephemeral: true}, nil
+}
+
+// jwtSigningMethod returns the JWT algorithm for key
+func jwtSigningMethod(key crypto.Signer) (jwt.SigningMethod, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, nil
+	case *ecdsa.PrivateKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return jwt.SigningMethodES256, nil
+		case elliptic.P384():
+			return jwt.SigningMethodES384, nil
+		case elliptic.P521():
+			return jwt.SigningMethodES512, nil
+		}
+		return nil, errors.New("unsupported ECDSA curve " + key.Curve.Params().Name)
+	case ed25519.PrivateKey:
+		return signingMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// parsePrivateKeyPEM parses a PKCS #8, PKCS #1 (RSA) or SEC 1 (EC) private key
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q, expected a private key", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return signer, nil
+}
+
+// parsePublicKeyPEM parses a PKIX or PKCS #1 (RSA) public key
+func parsePublicKeyPEM(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unexpected PEM block %q, expected a public key", block.Type)
+}
+
+// signingMethodEdDSA signs tokens with Ed25519 keys (RFC 8037), which jwt-go does not implement
+var signingMethodEdDSA = &edDSASigningMethod{}
+
+type edDSASigningMethod struct{}
+
+func init() {
+	jwt.RegisterSigningMethod(signingMethodEdDSA.Alg(), func() jwt.SigningMethod { return signingMethodEdDSA })
+}
+
+func (*edDSASigningMethod) Alg() string { return "EdDSA" }
+
+func (*edDSASigningMethod) Sign(signingString string, key interface{}) (string, error) {
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	return jwt.EncodeSegment(ed25519.Sign(privateKey, []byte(signingString))), nil
+}
+
+func (*edDSASigningMethod) Verify(signingString, signature string, key interface{}) error {
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return jwt.ErrInvalidKeyType
+	}
+	sig, err := jwt.DecodeSegment(signature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, []byte(signingString), sig) {
+		return jwt.ErrSignatureInvalid
+	}
+	return nil
+}
+
+// generateKey creates a private key of the given type: rsa (with bits), ecdsa (P-256) or ed25519
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ed25519":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unknown key type %q, expected rsa, ecdsa or ed25519", keyType)
+}
+
+// certificateTemplate returns a certificate for hosts, which may be DNS names or IP addresses.
+// Without hosts, the certificate is a CA
+func certificateTemplate(hosts []string, validity time.Duration) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"usermanager"}, CommonName: "usermanager local CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(validity),
+		BasicConstraintsValid: true,
+	}
+	if len(hosts) == 0 {
+		template.IsCA = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		return template, nil
+	}
+	template.Subject.CommonName = hosts[0]
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	return template, nil
+}
+
+// ephemeralCertificate returns a self-signed certificate for localhost that is lost on restart
+func ephemeralCertificate() (*tls.Certificate, error) {
+	key, err := generateKey("ecdsa", 0)
+	if err != nil {
+		return nil, err
+	}
+	template, err := certificateTemplate(defaultCertificateHosts(), 24*time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	logWarn("dev mode: TLS certificate not found, serving an ephemeral self-signed certificate")
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// defaultCertificateHosts are the names of the local machine
+func defaultCertificateHosts() []string {
+	hosts := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return append(hosts, "127.0.0.1", "::1")
+}
+
+// writePEM writes a PEM block to path, refusing to replace existing files unless force is set
+func writePEM(path, blockType string, der []byte, mode os.FileMode, force bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, mode)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s exists, use -force to replace it", path)
+	}
+	if err != nil {
+		return err
+	}
+	// the mode of OpenFile only applies to new files
+	if err = file.Chmod(mode); err == nil {
+		err = pem.Encode(file, &pem.Block{Type: blockType, Bytes: der})
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		fmt.Printf("wrote %s (%o)\n", path, mode)
+	}
+	return err
+}
+
+// writeKeyPair writes key as PKCS #8 to keyPath and its public key as PKIX to pubPath, if set
+func writeKeyPair(key crypto.Signer, keyPath, pubPath string, force bool) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err = writePEM(keyPath, "PRIVATE KEY", der, 0600, force); err != nil {
+		return err
+	}
+	if pubPath == "" {
+		return nil
+	}
+	if der, err = x509.MarshalPKIXPublicKey(key.Public()); err != nil {
+		return err
+	}
+	return writePEM(pubPath, "PUBLIC KEY", der, 0644, force)
+}
+
+func cmdKeys(args []string) error {
+	if len(args) == 0 || args[0] != "init" {
+		return errors.New("usage: usermanager keys init [flags]")
+	}
+	// keys are created before the configuration is complete, only the paths are used
+	conf, _ := parseConfig()
+
+	flags := flag.NewFlagSet("keys init", flag.ExitOnError)
+	keyType := flags.String("type", "rsa", "JWT key type: rsa, ecdsa or ed25519")
+	bits := flags.Int("bits", 4096, "size of RSA keys")
+	withTLS := flags.Bool("tls", false, "also create a TLS certificate")
+	hosts := flags.String("hosts", strings.Join(defaultCertificateHosts(), ","), "comma separated DNS names and IP addresses of the TLS certificate")
+	withCA := flags.Bool("ca", false, "sign the TLS certificate with a new local CA instead of self-signing it")
+	days := flags.Int("days", 365, "validity of the TLS certificate in days")
+	force := flags.Bool("force", false, "replace existing files")
+	flags.Parse(args[1:])
+	if flags.NArg() != 0 {
+		return errors.New("usage: usermanager keys init [flags]")
+	}
+
+	key, err := generateKey(*keyType, *bits)
+	if err != nil {
+		return err
+	}
+	if err = writeKeyPair(key, conf.JWTPrivateRSAKey, conf.JWTPublicRSAKey, *force); err != nil {
+		return err
+	}
+	method, _ := jwtSigningMethod(key)
+	fmt.Println("tokens are signed with", method.Alg())
+	if !*withTLS {
+		return nil
+	}
+
+	certPath, keyPath := conf.SSLCertificate, conf.SSLKeyFile
+	if certPath == "" || keyPath == "" {
+		dir := filepath.Dir(conf.JWTPrivateRSAKey)
+		certPath, keyPath = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+		fmt.Printf("set SSLCertificate=%s and SSLKeyFile=%s to serve TLS\n", certPath, keyPath)
+	}
+	var names []string
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("-hosts must name at least one host")
+	}
+	validity := time.Duration(*days) * 24 * time.Hour
+
+	tlsKey, err := generateKey("ecdsa", 0)
+	if err != nil {
+		return err
+	}
+	template, err := certificateTemplate(names, validity)
+	if err != nil {
+		return err
+	}
+	parent, parentKey := template, tlsKey
+	if *withCA {
+		if parentKey, err = generateKey("ecdsa", 0); err != nil {
+			return err
+		}
+		if parent, err = certificateTemplate(nil, validity); err != nil {
+			return err
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, parent, parent, parentKey.Public(), parentKey)
+		if err != nil {
+			return err
+		}
+		caPath := filepath.Join(filepath.Dir(certPath), "ca.crt")
+		if err = writeKeyPair(parentKey, filepath.Join(filepath.Dir(keyPath), "ca.key"), "", *force); err != nil {
+			return err
+		}
+		if err = writePEM(caPath, "CERTIFICATE", caDER, 0644, *force); err != nil {
+			return err
+		}
+		fmt.Printf("add %s to the trust store of clients\n", caPath)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, tlsKey.Public(), parentKey)
+	if err != nil {
+		return err
+	}
+	if err = writeKeyPair(tlsKey, keyPath, "", *force); err != nil {
+		return err
+	}
+	return writePEM(certPath, "CERTIFICATE", der, 0644, *force)
+}
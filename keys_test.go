@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func TestParseKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encode := func(blockType string, der []byte, err error) []byte {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	}
+	pkcs8 := func(key crypto.Signer) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		return encode("PRIVATE KEY", der, err)
+	}
+	pkix := func(key crypto.Signer) []byte {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		return encode("PUBLIC KEY", der, err)
+	}
+	sec1 := func(key *ecdsa.PrivateKey) []byte {
+		der, err := x509.MarshalECPrivateKey(key)
+		return encode("EC PRIVATE KEY", der, err)
+	}
+
+	tests := []struct {
+		name    string
+		private []byte
+		public  []byte
+		key     crypto.Signer
+		method  jwt.SigningMethod
+	}{
+		{"RSA PKCS #1", encode("RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey), nil),
+			encode("RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey), nil), rsaKey, jwt.SigningMethodRS256},
+		{"RSA PKCS #8", pkcs8(rsaKey), pkix(rsaKey), rsaKey, jwt.SigningMethodRS256},
+		{"ECDSA SEC 1", sec1(p256Key), pkix(p256Key), p256Key, jwt.SigningMethodES256},
+		{"ECDSA PKCS #8", pkcs8(p384Key), pkix(p384Key), p384Key, jwt.SigningMethodES384},
+		{"Ed25519 PKCS #8", pkcs8(edKey), pkix(edKey), edKey, signingMethodEdDSA},
+	}
+	for _, test := range tests {
+		private, err := parsePrivateKeyPEM(test.private)
+		if err != nil {
+			t.Errorf("%s: private key: %v", test.name, err)
+			continue
+		}
+		public, err := parsePublicKeyPEM(test.public)
+		if err != nil {
+			t.Errorf("%s: public key: %v", test.name, err)
+			continue
+		}
+		keys := &jwtKeys{verify: public, sign: private}
+		if !keys.equal(&jwtKeys{verify: test.key.Public()}) || !keys.equal(&jwtKeys{verify: private.Public()}) {
+			t.Errorf("%s: parsed keys do not match", test.name)
+		}
+		if keys.method, err = jwtSigningMethod(private); err != nil || keys.method != test.method {
+			t.Errorf("%s: signing method %v, %v", test.name, keys.method, err)
+			continue
+		}
+		token, err := jwt.New(keys.method).SignedString(private)
+		if err != nil {
+			t.Errorf("%s: signing: %v", test.name, err)
+			continue
+		}
+		if _, err = jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return public, nil }); err != nil {
+			t.Errorf("%s: verifying: %v", test.name, err)
+		}
+	}
+}
+
+func TestParseKeyPEMErrors(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec1, _ := x509.MarshalECPrivateKey(key)
+	pkix, _ := x509.MarshalPKIXPublicKey(key.Public())
+	parsePrivate := func(data []byte) (interface{}, error) { return parsePrivateKeyPEM(data) }
+	parsePublic := func(data []byte) (interface{}, error) { return parsePublicKeyPEM(data) }
+	block := func(blockType string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	}
+	tests := []struct {
+		name   string
+		data   []byte
+		parse  func([]byte) (interface{}, error)
+		errMsg string // empty if any error will do
+	}{
+		{"private: no PEM", []byte("not a key"), parsePrivate, "no PEM data found"},
+		{"private: public key", block("PUBLIC KEY", pkix), parsePrivate, `unexpected PEM block "PUBLIC KEY", expected a private key`},
+		{"private: wrong encoding", block("RSA PRIVATE KEY", sec1), parsePrivate, ""},
+		{"private: corrupt", block("PRIVATE KEY", []byte{1, 2, 3}), parsePrivate, ""},
+		{"public: no PEM", nil, parsePublic, "no PEM data found"},
+		{"public: private key", block("EC PRIVATE KEY", sec1), parsePublic, `unexpected PEM block "EC PRIVATE KEY", expected a public key`},
+		{"public: certificate", block("CERTIFICATE", pkix), parsePublic, `unexpected PEM block "CERTIFICATE", expected a public key`},
+		{"public: wrong encoding", block("RSA PUBLIC KEY", pkix), parsePublic, ""},
+	}
+	for _, test := range tests {
+		_, err := test.parse(test.data)
+		if err == nil || (test.errMsg != "" && err.Error() != test.errMsg) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.errMsg)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"gopkg.in/ldap.v2"
+)
+
+// ldapConn is an LDAP connection that records metrics for every operation. Operations that are
+// not wrapped here are passed to ldap.Conn unmeasured. Operations are logged with the request ID of ctx
+type ldapConn struct {
+	*ldap.Conn
+	ctx    context.Context
+	closed bool
+}
+
+// dialLDAP opens a measured connection to the configured LDAP server
+func dialLDAP(ctx context.Context) (*ldapConn, error) {
+	return dialLDAPTimeout(ctx, 0)
+}
+
+// dialLDAPTimeout is dialLDAP with a timeout for connecting and for every request. Without
+// timeout, connecting times out after ldap.DefaultTimeout and requests never time out
+func dialLDAPTimeout(ctx context.Context, timeout time.Duration) (*ldapConn, error) {
+	dialTimeout := timeout
+	if dialTimeout == 0 {
+		dialTimeout = ldap.DefaultTimeout
+	}
+	var conn net.Conn
+	err := observeLDAP(ctx, "connect", configuration().LDAPServer, func() (err error) {
+		conn, err = net.DialTimeout("tcp", configuration().LDAPServer+":"+configuration().LDAPPort, dialTimeout)
+		return err
+	})
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	ldapConnections.inc()
+	openLDAPConnections.add(1)
+	l := ldap.NewConn(conn, false)
+	l.SetTimeout(timeout)
+	l.Start()
+	return &ldapConn{Conn: l, ctx: ctx}, nil
+}
+
+// observeLDAP runs the LDAP operation op on target (usually a DN) and records its latency and outcome.
+// Failures are logged as warnings, all operations at debug level, with the request ID of ctx
+func observeLDAP(ctx context.Context, operation, target string, op func() error) error {
+	start := time.Now()
+	err := op()
+	duration := time.Since(start)
+	ldapDuration.observe(duration, operation)
+	ldapOperations.inc(operation)
+	fields := []interface{}{"request_id", requestID(ctx), "operation", operation, "target", target,
+		"duration_ms", float64(duration.Microseconds()) / 1000}
+	if err != nil {
+		ldapErrors.inc(operation)
+		logWarn("ldap operation failed", append(fields, "error", err)...)
+	} else {
+		logDebug("ldap operation", fields...)
+	}
+	return err
+}
+
+// Close closes the connection
+func (l *ldapConn) Close() {
+	if !l.closed {
+		l.closed = true
+		openLDAPConnections.add(-1)
+	}
+	l.Conn.Close()
+}
+
+// Bind authenticates as username
+func (l *ldapConn) Bind(username, password string) error {
+	return observeLDAP(l.ctx, "bind", username, func() error { return l.Conn.Bind(username, password) })
+}
+
+// Search performs a search request
+func (l *ldapConn) Search(request *ldap.SearchRequest) (result *ldap.SearchResult, err error) {
+	err = observeLDAP(l.ctx, "search", request.BaseDN+" "+request.Filter, func() error {
+		result, err = l.Conn.Search(request)
+		return err
+	})
+	return result, err
+}
+
+// Add performs an add request
+func (l *ldapConn) Add(request *ldap.AddRequest) error {
+	return written(observeLDAP(l.ctx, "add", request.DN, func() error { return l.Conn.Add(request) }))
+}
+
+// Modify performs a modify request
+func (l *ldapConn) Modify(request *ldap.ModifyRequest) error {
+	return written(observeLDAP(l.ctx, "modify", request.DN, func() error { return l.Conn.Modify(request) }))
+}
+
+// Del performs a delete request
+func (l *ldapConn) Del(request *ldap.DelRequest) error {
+	return written(observeLDAP(l.ctx, "delete", request.DN, func() error { return l.Conn.Del(request) }))
+}
+
+// written invalidates the directory cache if the write that returned err succeeded. All writes go
+// through ldapConn or wireConn, reads on admin connections keep the cache
+func written(err error) error {
+	if err == nil {
+		invalidateDirectory()
+	}
+	return err
+}
+
+// PasswordModify performs a password modify extended operation
+func (l *ldapConn) PasswordModify(request *ldap.PasswordModifyRequest) (result *ldap.PasswordModifyResult, err error) {
+	err = observeLDAP(l.ctx, "password_modify", request.UserIdentity, func() error {
+		result, err = l.Conn.PasswordModify(request)
+		return err
+	})
+	return result, err
+}
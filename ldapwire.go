@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+// Minimal LDAP client on top of the BER encoding used by ldap.v2, for operations
+// that the vendored ldap.v2 does not implement.
+
+const (
+	applicationIntermediateResponse = 25 // not defined by ldap.v2
+
+	controlTypeSyncRequest    = "1.3.6.1.4.1.4203.1.9.1.1" // RFC 4533
+	syncModeRefreshAndPersist = 3
+)
+
+// wireConn is a synchronous LDAP connection: every request waits for its single response
+type wireConn struct {
+	conn      net.Conn
+	ctx       context.Context
+	messageID int64
+}
+
+// wireDial connects to the configured LDAP server. Operations are logged with the request ID of ctx
+func wireDial(ctx context.Context) (*wireConn, error) {
+	var conn net.Conn
+	err := observeLDAP(ctx, "connect", configuration().LDAPServer, func() (err error) {
+		conn, err = net.DialTimeout("tcp", configuration().LDAPServer+":"+configuration().LDAPPort, 10*time.Second)
+		return err
+	})
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	ldapConnections.inc()
+	openLDAPConnections.add(1)
+	return &wireConn{conn: conn, ctx: ctx}, nil
+}
+
+// wireConnectAdmin connects to LDAP and binds with editing permissions
+func wireConnectAdmin(ctx context.Context) (*wireConn, error) {
+	c, err := wireDial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.bind(configuration().LDAPAdmin, configuration().LDAPPass); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the connection
+func (c *wireConn) Close() {
+	if c.conn.Close() == nil {
+		openLDAPConnections.add(-1)
+	}
+}
+
+func (c *wireConn) bind(dn, password string) error {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationBindRequest, nil, "Bind Request")
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 3, "Version"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "User Name"))
+	request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, password, "Password"))
+	return observeLDAP(c.ctx, "bind", dn, func() error {
+		_, err := c.request(request, ldap.ApplicationBindResponse)
+		return err
+	})
+}
+
+// request sends an LDAP operation and returns the response operation, or an *ldap.Error if its result is not success
+func (c *wireConn) request(op *ber.Packet, responseTag ber.Tag) (*ber.Packet, error) {
+	c.messageID++
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.messageID, "MessageID"))
+	packet.AppendChild(op)
+
+	c.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write(packet.Bytes()); err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	response, err := c.readResponse()
+	if err != nil {
+		return nil, err
+	}
+	if response.Children[1].Tag != responseTag {
+		return nil, ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("unexpected response"))
+	}
+	return response.Children[1], wireResult(response.Children[1])
+}
+
+// readResponse reads the next message, which must answer the last request sent
+func (c *wireConn) readResponse() (*ber.Packet, error) {
+	response, err := ber.ReadPacket(c.conn)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+	if len(response.Children) < 2 {
+		return nil, ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("unexpected response"))
+	}
+	if id, _ := response.Children[0].Value.(int64); id != c.messageID {
+		return nil, ldap.NewError(ldap.ErrorUnexpectedResponse, fmt.Errorf("response to message %d, expected %d", id, c.messageID))
+	}
+	return response, nil
+}
+
+// wireResult extracts the LDAPResult of a response operation
+func wireResult(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("invalid result"))
+	}
+	code, ok := op.Children[0].Value.(int64)
+	if !ok {
+		return ldap.NewError(ldap.ErrorUnexpectedResponse, errors.New("invalid result code"))
+	}
+	if code == ldap.LDAPResultSuccess {
+		return nil
+	}
+	message, _ := op.Children[2].Value.(string)
+	return ldap.NewError(uint8(code), errors.New(message))
+}
+
+// modifyDN renames dn to newRDN, optionally moving it below newSuperior (RFC 4511, section 4.9)
+func (c *wireConn) modifyDN(dn, newRDN string, deleteOldRDN bool, newSuperior string) error {
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationModifyDNRequest, nil, "Modify DN Request")
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "Entry"))
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, newRDN, "New RDN"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, deleteOldRDN, "Delete Old RDN"))
+	if newSuperior != "" {
+		request.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimitive, 0, newSuperior, "New Superior"))
+	}
+	return written(observeLDAP(c.ctx, "modify_dn", dn, func() error {
+		_, err := c.request(request, ldap.ApplicationModifyDNResponse)
+		return err
+	}))
+}
+
+// LDAPModifyDN renames and/or moves dn. An empty newSuperior keeps the entry at its position in the tree
+func LDAPModifyDN(ctx context.Context, dn, newRDN string, deleteOldRDN bool, newSuperior string) error {
+	c, err := wireConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.modifyDN(dn, newRDN, deleteOldRDN, newSuperior)
+}
+
+// errSyncUnsupported is returned by watchChanges if the server rejects the content synchronization control
+var errSyncUnsupported = errors.New("server does not support content synchronization (RFC 4533), is the syncprov overlay loaded?")
+
+// watchChanges runs a refreshAndPersist content synchronization search (RFC 4533) for filter below
+// LDAPBaseDN and calls changed for every entry that is added, modified or deleted after the initial
+// refresh. It only returns when the search ends, e.g. because the connection was closed
+func (c *wireConn) watchChanges(filter string, changed func()) error {
+	compiled, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return err
+	}
+	request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchRequest, nil, "Search Request")
+	request.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, configuration().LDAPBaseDN, "Base DN"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.ScopeWholeSubtree, "Scope"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.NeverDerefAliases, "Deref Aliases"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Size Limit"))
+	request.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, 0, "Time Limit"))
+	request.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, false, "Types Only"))
+	request.AppendChild(compiled)
+	attributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	// no attributes, entries are only used as change notifications
+	attributes.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "1.1", "Attribute"))
+	request.AppendChild(attributes)
+
+	control := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Control")
+	control.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, controlTypeSyncRequest, "Control Type (Sync Request)"))
+	control.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "Criticality"))
+	value := ber.Encode(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, nil, "Control Value (Sync Request)")
+	syncRequest := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Sync Request Value")
+	syncRequest.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, syncModeRefreshAndPersist, "Mode"))
+	value.AppendChild(syncRequest)
+	control.AppendChild(value)
+	controls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+	controls.AppendChild(control)
+
+	c.messageID++
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, c.messageID, "MessageID"))
+	packet.AppendChild(request)
+	packet.AppendChild(controls)
+	if _, err := c.conn.Write(packet.Bytes()); err != nil {
+		return ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	// the refresh phase sends all entries and ends with a Sync Info intermediate response,
+	// entries after that are changes
+	persisting := false
+	for {
+		response, err := c.readResponse()
+		if err != nil {
+			return err
+		}
+		switch response.Children[1].Tag {
+		case ldap.ApplicationSearchResultEntry:
+			if persisting {
+				changed()
+			}
+		case applicationIntermediateResponse:
+			persisting = true
+		case ldap.ApplicationSearchResultDone:
+			err := wireResult(response.Children[1])
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultUnavailableCriticalExtension) || ldap.IsErrorWithCode(err, ldap.LDAPResultProtocolError) {
+				return errSyncUnsupported
+			}
+			if err == nil {
+				err = ldap.NewError(ldap.ErrorNetwork, errors.New("content synchronization search ended"))
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"gopkg.in/asn1-ber.v1"
+	"gopkg.in/ldap.v2"
+)
+
+func TestWireRequestMessageID(t *testing.T) {
+	tests := []struct {
+		name      string
+		messageID int64
+		tag       ber.Tag
+		wantError bool
+	}{
+		{"matching", 1, ldap.ApplicationModifyDNResponse, false},
+		{"other message", 7, ldap.ApplicationModifyDNResponse, true},
+		{"unsolicited notification", 0, ldap.ApplicationExtendedResponse, true},
+		{"other operation", 1, ldap.ApplicationModifyResponse, true},
+	}
+	for _, test := range tests {
+		test := test
+		client, server := net.Pipe()
+		go func() {
+			if _, err := ber.ReadPacket(server); err != nil {
+				return
+			}
+			result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, test.tag, nil, "Response")
+			result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, ldap.LDAPResultSuccess, "Result Code"))
+			result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+			result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+			packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, test.messageID, "MessageID"))
+			packet.AppendChild(result)
+			server.Write(packet.Bytes())
+		}()
+
+		c := &wireConn{conn: client, ctx: context.Background()}
+		request := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationModifyDNRequest, nil, "Modify DN Request")
+		_, err := c.request(request, ldap.ApplicationModifyDNResponse)
+		if (err != nil) != test.wantError {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantError)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ldifRecord is a content or change record of an LDIF file (RFC 2849)
+type ldifRecord struct {
+	Line         int
+	DN           string
+	ChangeType   string          // add, delete, modify or modrdn. Content records are treated as add
+	Attributes   []ldifAttribute // add
+	Mods         []ldifMod       // modify
+	NewRDN       string          // modrdn
+	DeleteOldRDN bool            // modrdn
+	NewSuperior  string          // modrdn, optional
+}
+
+// ldifAttribute is an attribute with its values
+type ldifAttribute struct {
+	Name   string
+	Values []string
+}
+
+// ldifMod is a single modification of a modify record
+type ldifMod struct {
+	Op string // add, delete or replace
+	ldifAttribute
+}
+
+// ldifLine is an unfolded line and the line number it starts at
+type ldifLine struct {
+	number int
+	text   string
+}
+
+// parseLDIF parses content and change records.
+// Values given as URL (`attr:< file:///...`) and controls are not supported.
+func parseLDIF(r io.Reader) ([]ldifRecord, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var records []ldifRecord
+	var block []ldifLine
+	flush := func() error {
+		if len(block) == 0 {
+			return nil
+		}
+		if len(records) == 0 && strings.HasPrefix(block[0].text, "version:") {
+			block = block[1:]
+			if len(block) == 0 {
+				return nil
+			}
+		}
+		record, err := parseLDIFRecord(block)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+		block = nil
+		return nil
+	}
+
+	inComment := false
+	for number := 1; scanner.Scan(); number++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case text == "":
+			inComment = false
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case text[0] == ' ':
+			// continuation of the previous line
+			if inComment {
+				continue
+			}
+			if len(block) == 0 {
+				return nil, fmt.Errorf("line %d: continuation without preceding line", number)
+			}
+			block[len(block)-1].text += text[1:]
+		case text[0] == '#':
+			inComment = true
+		default:
+			inComment = false
+			block = append(block, ldifLine{number, text})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func parseLDIFRecord(lines []ldifLine) (ldifRecord, error) {
+	fail := func(line ldifLine, format string, args ...interface{}) (ldifRecord, error) {
+		return ldifRecord{}, fmt.Errorf("line %d: %s", line.number, fmt.Sprintf(format, args...))
+	}
+
+	name, dn, err := parseLDIFLine(lines[0])
+	if err != nil {
+		return ldifRecord{}, err
+	}
+	if !strings.EqualFold(name, "dn") {
+		return fail(lines[0], "record must start with dn")
+	}
+	record := ldifRecord{Line: lines[0].number, DN: dn, ChangeType: "add"}
+	lines = lines[1:]
+
+	if len(lines) != 0 {
+		name, value, err := parseLDIFLine(lines[0])
+		if err != nil {
+			return ldifRecord{}, err
+		}
+		if strings.EqualFold(name, "control") {
+			return fail(lines[0], "controls are not supported")
+		}
+		if strings.EqualFold(name, "changetype") {
+			record.ChangeType = strings.ToLower(value)
+			lines = lines[1:]
+		}
+	}
+
+	switch record.ChangeType {
+	case "add":
+		for _, line := range lines {
+			name, value, err := parseLDIFLine(line)
+			if err != nil {
+				return ldifRecord{}, err
+			}
+			record.Attributes = appendLDIFValue(record.Attributes, name, value)
+		}
+		if len(record.Attributes) == 0 {
+			return fail(firstLine(lines, record.Line), "add record without attributes")
+		}
+
+	case "delete":
+		if len(lines) != 0 {
+			return fail(lines[0], "unexpected content in delete record")
+		}
+
+	case "modrdn", "moddn":
+		record.ChangeType = "modrdn"
+		for _, line := range lines {
+			name, value, err := parseLDIFLine(line)
+			if err != nil {
+				return ldifRecord{}, err
+			}
+			switch strings.ToLower(name) {
+			case "newrdn":
+				record.NewRDN = value
+			case "deleteoldrdn":
+				if value != "0" && value != "1" {
+					return fail(line, "deleteoldrdn must be 0 or 1")
+				}
+				record.DeleteOldRDN = value == "1"
+			case "newsuperior":
+				record.NewSuperior = value
+			default:
+				return fail(line, "unexpected %s in modrdn record", name)
+			}
+		}
+		if record.NewRDN == "" {
+			return fail(firstLine(lines, record.Line), "modrdn record without newrdn")
+		}
+
+	case "modify":
+		var mod *ldifMod
+		for _, line := range lines {
+			if line.text == "-" {
+				if mod == nil {
+					return fail(line, "unexpected -")
+				}
+				record.Mods = append(record.Mods, *mod)
+				mod = nil
+				continue
+			}
+			name, value, err := parseLDIFLine(line)
+			if err != nil {
+				return ldifRecord{}, err
+			}
+			if mod == nil {
+				op := strings.ToLower(name)
+				if op != "add" && op != "delete" && op != "replace" {
+					return fail(line, "expected add, delete or replace, got %s", name)
+				}
+				mod = &ldifMod{Op: op, ldifAttribute: ldifAttribute{Name: value}}
+				continue
+			}
+			if !strings.EqualFold(name, mod.Name) {
+				return fail(line, "attribute %s does not match %s: %s", name, mod.Op, mod.Name)
+			}
+			mod.Values = append(mod.Values, value)
+		}
+		if mod != nil {
+			// the trailing `-` is optional for the last modification
+			record.Mods = append(record.Mods, *mod)
+		}
+
+	default:
+		return fail(firstLine(lines, record.Line), "unknown changetype %q", record.ChangeType)
+	}
+	return record, nil
+}
+
+func firstLine(lines []ldifLine, fallback int) ldifLine {
+	if len(lines) != 0 {
+		return lines[0]
+	}
+	return ldifLine{number: fallback}
+}
+
+// parseLDIFLine splits `name: value` or `name:: base64` into name and decoded value
+func parseLDIFLine(line ldifLine) (string, string, error) {
+	i := strings.Index(line.text, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("line %d: expected attribute: value", line.number)
+	}
+	name, value := line.text[:i], line.text[i+1:]
+	switch {
+	case strings.HasPrefix(value, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("line %d: invalid base64 value: %v", line.number, err)
+		}
+		return name, string(decoded), nil
+	case strings.HasPrefix(value, "<"):
+		return "", "", fmt.Errorf("line %d: URL values are not supported", line.number)
+	}
+	return name, strings.TrimLeft(value, " "), nil
+}
+
+func appendLDIFValue(attributes []ldifAttribute, name, value string) []ldifAttribute {
+	for i := range attributes {
+		if strings.EqualFold(attributes[i].Name, name) {
+			attributes[i].Values = append(attributes[i].Values, value)
+			return attributes
+		}
+	}
+	return append(attributes, ldifAttribute{Name: name, Values: []string{value}})
+}
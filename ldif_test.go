@@ -0,0 +1,119 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLDIF(t *testing.T) {
+	tests := []struct {
+		name string
+		ldif string
+		want []ldifRecord
+	}{
+		{"content record", `
+dn: cn=bilbo,dc=example,dc=com
+objectClass: inetOrgPerson
+objectClass: organizationalPerson
+cn: bilbo
+`, []ldifRecord{{Line: 2, DN: "cn=bilbo,dc=example,dc=com", ChangeType: "add", Attributes: []ldifAttribute{
+			{"objectClass", []string{"inetOrgPerson", "organizationalPerson"}},
+			{"cn", []string{"bilbo"}},
+		}}}},
+		{"version, comments and several records", `version: 1
+# the hobbits
+dn: cn=bilbo,dc=example,dc=com
+cn: bilbo
+
+# a folded
+ comment
+dn: cn=frodo,dc=example,dc=com
+cn: frodo
+`, []ldifRecord{
+			{Line: 3, DN: "cn=bilbo,dc=example,dc=com", ChangeType: "add", Attributes: []ldifAttribute{{"cn", []string{"bilbo"}}}},
+			{Line: 8, DN: "cn=frodo,dc=example,dc=com", ChangeType: "add", Attributes: []ldifAttribute{{"cn", []string{"frodo"}}}},
+		}},
+		{"folding, base64 and CRLF", "dn: cn=bilbo,dc=exa\r\n mple,dc=com\r\ndescription:: QmV1dGxpbiDDpA==\r\ncn:bilbo\r\n",
+			[]ldifRecord{{Line: 1, DN: "cn=bilbo,dc=example,dc=com", ChangeType: "add", Attributes: []ldifAttribute{
+				{"description", []string{"Beutlin ä"}},
+				{"cn", []string{"bilbo"}},
+			}}}},
+		{"attribute names ignore case", `
+dn: cn=hobbits,dc=example,dc=com
+changetype: add
+uniqueMember: cn=bilbo,dc=example,dc=com
+UNIQUEMEMBER: cn=frodo,dc=example,dc=com
+`, []ldifRecord{{Line: 2, DN: "cn=hobbits,dc=example,dc=com", ChangeType: "add", Attributes: []ldifAttribute{
+			{"uniqueMember", []string{"cn=bilbo,dc=example,dc=com", "cn=frodo,dc=example,dc=com"}},
+		}}}},
+		{"delete", `
+dn: cn=bilbo,dc=example,dc=com
+changetype: delete
+`, []ldifRecord{{Line: 2, DN: "cn=bilbo,dc=example,dc=com", ChangeType: "delete"}}},
+		{"modify", `
+dn: cn=hobbits,dc=example,dc=com
+changetype: Modify
+add: uniqueMember
+uniqueMember: cn=sam,dc=example,dc=com
+-
+delete: description
+-
+replace: mail
+mail: hobbits@example.com
+mail: shire@example.com
+`, []ldifRecord{{Line: 2, DN: "cn=hobbits,dc=example,dc=com", ChangeType: "modify", Mods: []ldifMod{
+			{"add", ldifAttribute{"uniqueMember", []string{"cn=sam,dc=example,dc=com"}}},
+			{"delete", ldifAttribute{"description", nil}},
+			{"replace", ldifAttribute{"mail", []string{"hobbits@example.com", "shire@example.com"}}},
+		}}}},
+		{"modrdn", `
+dn: cn=bilbo,dc=example,dc=com
+changetype: moddn
+newrdn: cn=bilbo-baggins
+deleteoldrdn: 1
+newsuperior: ou=alumni,dc=example,dc=com
+`, []ldifRecord{{Line: 2, DN: "cn=bilbo,dc=example,dc=com", ChangeType: "modrdn", NewRDN: "cn=bilbo-baggins",
+			DeleteOldRDN: true, NewSuperior: "ou=alumni,dc=example,dc=com"}}},
+		{"empty", "\n# nothing\n\n", nil},
+	}
+	for _, test := range tests {
+		records, err := parseLDIF(strings.NewReader(test.ldif))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(records, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, records, test.want)
+		}
+	}
+}
+
+func TestParseLDIFErrors(t *testing.T) {
+	tests := []struct {
+		ldif, err string
+	}{
+		{" continued\n", "line 1: continuation without preceding line"},
+		{"cn: bilbo\n", "line 1: record must start with dn"},
+		{"dn: cn=bilbo\n", "line 1: add record without attributes"},
+		{"dn: cn=bilbo\ncn\n", "line 2: expected attribute: value"},
+		{"dn: cn=bilbo\ncn:: !!!\n", "line 2: invalid base64 value"},
+		{"dn: cn=bilbo\njpegPhoto:< file:///tmp/x.jpg\n", "line 2: URL values are not supported"},
+		{"dn: cn=bilbo\ncontrol: 1.2.3\n", "line 2: controls are not supported"},
+		{"dn: cn=bilbo\nchangetype: rename\n", "line 1: unknown changetype"},
+		{"dn: cn=bilbo\nchangetype: delete\ncn: bilbo\n", "line 3: unexpected content in delete record"},
+		{"dn: cn=bilbo\nchangetype: modrdn\ndeleteoldrdn: 1\n", "line 3: modrdn record without newrdn"},
+		{"dn: cn=bilbo\nchangetype: modrdn\nnewrdn: cn=x\ndeleteoldrdn: yes\n", "line 4: deleteoldrdn must be 0 or 1"},
+		{"dn: cn=bilbo\nchangetype: modrdn\nnewrdn: cn=x\ncn: x\n", "line 4: unexpected cn in modrdn record"},
+		{"dn: cn=bilbo\nchangetype: modify\n-\n", "line 3: unexpected -"},
+		{"dn: cn=bilbo\nchangetype: modify\nmail: x\n", "line 3: expected add, delete or replace"},
+		{"dn: cn=bilbo\nchangetype: modify\nadd: mail\ncn: x\n", "line 4: attribute cn does not match add: mail"},
+		{"dn: cn=a\ncn: a\n\n\ndn: cn=b\n", "line 5: add record without attributes"},
+	}
+	for _, test := range tests {
+		_, err := parseLDIF(strings.NewReader(test.ldif))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %s", test.ldif, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/user"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Change states of an LDIF report
+const (
+	ldifPlanned        = "planned"
+	ldifInvalid        = "invalid"
+	ldifApplied        = "applied"
+	ldifFailed         = "failed"
+	ldifSkipped        = "skipped"
+	ldifRolledBack     = "rolled_back"
+	ldifRollbackFailed = "rollback_failed"
+)
+
+// LDIFChange reports the planned diff and outcome of one LDIF record
+type LDIFChange struct {
+	Line       int      `json:"line"`
+	DN         string   `json:"dn"`
+	ChangeType string   `json:"changetype"`
+	Diff       []string `json:"diff"`
+	Status     string   `json:"status"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// LDIFReport is the result of applying an LDIF file
+type LDIFReport struct {
+	DryRun     bool         `json:"dryRun"`
+	Changes    []LDIFChange `json:"changes"`
+	RolledBack bool         `json:"rolledBack"`
+	Error      string       `json:"error,omitempty"`
+}
+
+// ldifEntry is the state of an entry, attributes keyed by lowercase name
+type ldifEntry map[string]ldifAttribute
+
+// ldifStep applies a record and knows how to undo it
+type ldifStep struct {
+	diff []string
+	do   func() error
+	undo func() error
+}
+
+// ldifSimulation tracks the expected state of all entries touched by an LDIF file,
+// so that every record is validated and diffed against the result of the records before it
+type ldifSimulation struct {
+	conn    *ldapConn
+	entries map[string]ldifEntry // by normalized DN, nil if the entry does not exist
+}
+
+// applyLDIF validates all records and applies them in order, unless dryRun is set.
+// Nothing is applied if any record is invalid. If a record fails, all records
+// applied before it are undone in reverse order.
+func applyLDIF(ctx context.Context, records []ldifRecord, dryRun bool, actor string) (LDIFReport, error) {
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return LDIFReport{}, err
+	}
+	defer l.Close()
+
+	sim := &ldifSimulation{conn: l, entries: map[string]ldifEntry{}}
+	report := LDIFReport{DryRun: dryRun}
+	steps := make([]ldifStep, len(records))
+	valid := true
+	for i, record := range records {
+		change := LDIFChange{Line: record.Line, DN: record.DN, ChangeType: record.ChangeType, Status: ldifPlanned}
+		step, err := sim.plan(record)
+		if _, ok := err.(*ldap.Error); ok {
+			return LDIFReport{}, err
+		} else if err != nil {
+			change.Status = ldifInvalid
+			change.Error = err.Error()
+			valid = false
+		}
+		change.Diff = step.diff
+		steps[i] = step
+		report.Changes = append(report.Changes, change)
+	}
+	if !valid {
+		report.Error = "validation failed, nothing was applied"
+		return report, nil
+	}
+	if dryRun {
+		return report, nil
+	}
+
+	for i := range steps {
+		err := steps[i].do()
+		auditLog(actor, "ldif."+records[i].ChangeType, records[i].DN, err)
+		if err == nil {
+			report.Changes[i].Status = ldifApplied
+			continue
+		}
+
+		report.Changes[i].Status = ldifFailed
+		report.Changes[i].Error = err.Error()
+		report.Error = fmt.Sprintf("line %d: %v", records[i].Line, err)
+		for j := i + 1; j < len(steps); j++ {
+			report.Changes[j].Status = ldifSkipped
+		}
+		for j := i - 1; j >= 0; j-- {
+			err := steps[j].undo()
+			auditLog(actor, "ldif.rollback."+records[j].ChangeType, records[j].DN, err)
+			if err != nil {
+				report.Changes[j].Status = ldifRollbackFailed
+				report.Changes[j].Error = err.Error()
+			} else {
+				report.Changes[j].Status = ldifRolledBack
+			}
+		}
+		report.RolledBack = true
+		break
+	}
+	return report, nil
+}
+
+// plan validates record against the simulated state, computes its diff, and updates the state
+func (sim *ldifSimulation) plan(record ldifRecord) (ldifStep, error) {
+	if err := validateLDIFDN(record.DN); err != nil {
+		return ldifStep{}, err
+	}
+	before, err := sim.get(record.DN)
+	if err != nil {
+		return ldifStep{}, err
+	}
+	l := sim.conn
+
+	switch record.ChangeType {
+	case "add":
+		if before != nil {
+			return ldifStep{}, errors.New("entry already exists")
+		}
+		after := ldifEntry{}
+		for _, attr := range record.Attributes {
+			after[strings.ToLower(attr.Name)] = attr
+		}
+		if err := validateLDIFEntry(record.DN, after); err != nil {
+			return ldifStep{}, err
+		}
+		sim.set(record.DN, after)
+		return ldifStep{
+			diff: ldifDiff(nil, after),
+			do:   func() error { return l.Add(ldifAddRequest(record.DN, after)) },
+			undo: func() error { return l.Del(ldap.NewDelRequest(record.DN, nil)) },
+		}, nil
+
+	case "delete":
+		if before == nil {
+			return ldifStep{}, errors.New("entry does not exist")
+		}
+		if err := checkLDIFProtected(record.DN); err != nil {
+			return ldifStep{}, err
+		}
+		sim.set(record.DN, nil)
+		return ldifStep{
+			diff: ldifDiff(before, nil),
+			do:   func() error { return l.Del(ldap.NewDelRequest(record.DN, nil)) },
+			undo: func() error { return l.Add(ldifAddRequest(record.DN, before)) },
+		}, nil
+
+	case "modify":
+		if before == nil {
+			return ldifStep{}, errors.New("entry does not exist")
+		}
+		if err := checkLDIFProtected(record.DN); err != nil && !isGroupEntry(before) {
+			return ldifStep{}, err
+		}
+		after := before.copy()
+		mr := ldap.NewModifyRequest(record.DN)
+		undo := ldap.NewModifyRequest(record.DN)
+		touched := map[string]bool{}
+		for _, mod := range record.Mods {
+			key := strings.ToLower(mod.Name)
+			if err := after.apply(mod); err != nil {
+				return ldifStep{}, err
+			}
+			switch mod.Op {
+			case "add":
+				mr.Add(mod.Name, mod.Values)
+			case "delete":
+				mr.Delete(mod.Name, mod.Values)
+			case "replace":
+				mr.Replace(mod.Name, mod.Values)
+			}
+			if !touched[key] {
+				touched[key] = true
+				undo.Replace(mod.Name, before[key].Values)
+			}
+		}
+		if err := checkLDIFMembers(before, after); err != nil {
+			return ldifStep{}, err
+		}
+		if err := validateLDIFEntry(record.DN, after); err != nil {
+			return ldifStep{}, err
+		}
+		sim.set(record.DN, after)
+		return ldifStep{
+			diff: ldifDiff(before, after),
+			do:   func() error { return l.Modify(mr) },
+			undo: func() error { return l.Modify(undo) },
+		}, nil
+
+	case "modrdn":
+		if before == nil {
+			return ldifStep{}, errors.New("entry does not exist")
+		}
+		if err := checkLDIFProtected(record.DN); err != nil {
+			return ldifStep{}, err
+		}
+		oldRDN, parent := splitDN(record.DN)
+		newParent := parent
+		if record.NewSuperior != "" {
+			newParent = record.NewSuperior
+		}
+		newDN := record.NewRDN + "," + newParent
+		if err := validateLDIFDN(newDN); err != nil {
+			return ldifStep{}, err
+		}
+		existing, err := sim.get(newDN)
+		if err != nil {
+			return ldifStep{}, err
+		}
+		if existing != nil {
+			return ldifStep{}, fmt.Errorf("entry %s already exists", newDN)
+		}
+
+		after := before.copy()
+		oldAttr, oldValue := splitRDN(oldRDN)
+		newAttr, newValue := splitRDN(record.NewRDN)
+		if record.DeleteOldRDN {
+			after.apply(ldifMod{Op: "delete", ldifAttribute: ldifAttribute{Name: oldAttr, Values: []string{oldValue}}})
+		}
+		if !after.has(newAttr, newValue) {
+			after.apply(ldifMod{Op: "add", ldifAttribute: ldifAttribute{Name: newAttr, Values: []string{newValue}}})
+		}
+		sim.set(record.DN, nil)
+		sim.set(newDN, after)
+
+		undoSuperior := ""
+		if record.NewSuperior != "" {
+			undoSuperior = parent
+		}
+		return ldifStep{
+			diff: append([]string{"dn: " + record.DN + " -> " + newDN}, ldifDiff(before, after)...),
+			do: func() error {
+				return LDAPModifyDN(sim.conn.ctx, record.DN, record.NewRDN, record.DeleteOldRDN, record.NewSuperior)
+			},
+			undo: func() error { return LDAPModifyDN(sim.conn.ctx, newDN, oldRDN, true, undoSuperior) },
+		}, nil
+	}
+	return ldifStep{}, fmt.Errorf("unknown changetype %q", record.ChangeType)
+}
+
+// get returns the simulated state of dn, reading it from LDAP on first access
+func (sim *ldifSimulation) get(dn string) (ldifEntry, error) {
+	key := normalizeDN(dn)
+	if entry, ok := sim.entries[key]; ok {
+		return entry, nil
+	}
+	sr, err := sim.conn.Search(ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)", []string{"*"}, nil,
+	))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		sim.entries[key] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(sr.Entries) != 1 {
+		sim.entries[key] = nil
+		return nil, nil
+	}
+	entry := ldifEntry{}
+	for _, attr := range sr.Entries[0].Attributes {
+		entry[strings.ToLower(attr.Name)] = ldifAttribute{Name: attr.Name, Values: attr.Values}
+	}
+	sim.entries[key] = entry
+	return entry, nil
+}
+
+func (sim *ldifSimulation) set(dn string, entry ldifEntry) {
+	sim.entries[normalizeDN(dn)] = entry
+}
+
+func (e ldifEntry) copy() ldifEntry {
+	c := ldifEntry{}
+	for key, attr := range e {
+		c[key] = ldifAttribute{Name: attr.Name, Values: append([]string{}, attr.Values...)}
+	}
+	return c
+}
+
+func (e ldifEntry) has(name, value string) bool {
+	for _, v := range e[strings.ToLower(name)].Values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply applies a modification like the server would, failing in the same cases
+func (e ldifEntry) apply(mod ldifMod) error {
+	key := strings.ToLower(mod.Name)
+	attr, exists := e[key]
+	if !exists {
+		attr = ldifAttribute{Name: mod.Name}
+	}
+	switch mod.Op {
+	case "add":
+		for _, v := range mod.Values {
+			if e.has(mod.Name, v) {
+				return fmt.Errorf("%s already has value %s", mod.Name, v)
+			}
+			attr.Values = append(attr.Values, v)
+		}
+	case "delete":
+		if !exists {
+			return fmt.Errorf("no such attribute %s", mod.Name)
+		}
+		if len(mod.Values) == 0 {
+			attr.Values = nil
+		}
+		for _, v := range mod.Values {
+			if !e.has(mod.Name, v) {
+				return fmt.Errorf("%s has no value %s", mod.Name, v)
+			}
+			kept := []string{}
+			for _, existing := range attr.Values {
+				if !strings.EqualFold(existing, v) {
+					kept = append(kept, existing)
+				}
+			}
+			attr.Values = kept
+		}
+	case "replace":
+		attr.Values = append([]string{}, mod.Values...)
+	}
+	if len(attr.Values) == 0 {
+		delete(e, key)
+	} else {
+		e[key] = attr
+	}
+	return nil
+}
+
+// ldifDiff describes the changes from before to after. Password values are masked
+func ldifDiff(before, after ldifEntry) []string {
+	var diff []string
+	mask := func(key, value string) string {
+		if key == "userpassword" {
+			return "***"
+		}
+		return value
+	}
+	for key, attr := range before {
+		for _, v := range attr.Values {
+			if !after.has(key, v) {
+				diff = append(diff, "- "+attr.Name+": "+mask(key, v))
+			}
+		}
+	}
+	for key, attr := range after {
+		for _, v := range attr.Values {
+			if !before.has(key, v) {
+				diff = append(diff, "+ "+attr.Name+": "+mask(key, v))
+			}
+		}
+	}
+	return diff
+}
+
+func ldifAddRequest(dn string, entry ldifEntry) *ldap.AddRequest {
+	ar := ldap.NewAddRequest(dn)
+	for _, attr := range entry {
+		ar.Attribute(attr.Name, attr.Values)
+	}
+	return ar
+}
+
+// validateLDIFDN checks that dn is below LDAPBaseDN
+func validateLDIFDN(dn string) error {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return fmt.Errorf("invalid dn: %v", err)
+	}
+	base, err := ldap.ParseDN(configuration().LDAPBaseDN)
+	if err != nil {
+		return err
+	}
+	if !base.AncestorOf(parsed) {
+		return fmt.Errorf("%s is not below %s", dn, configuration().LDAPBaseDN)
+	}
+	return nil
+}
+
+// validateLDIFEntry applies the same rules to entries as the API does
+func validateLDIFEntry(dn string, entry ldifEntry) error {
+	if len(entry["objectclass"].Values) == 0 {
+		return errors.New("entry has no objectClass")
+	}
+	if entry.has("objectClass", "organizationalPerson") {
+		names := entry["cn"].Values
+		if len(names) == 0 {
+			return errors.New("user entry has no cn")
+		}
+		if !usernamePattern.MatchString(names[0]) {
+			return fmt.Errorf("invalid username %q", names[0])
+		}
+	}
+	for _, password := range entry["userpassword"].Values {
+		if !strings.HasPrefix(password, "{") {
+			return errors.New("userPassword must be hashed, e.g. {SHA512}...")
+		}
+	}
+	return nil
+}
+
+// checkLDIFProtected refuses changes to the LDAP admin and to protected users and groups
+func checkLDIFProtected(dn string) error {
+	if normalizeDN(dn) == normalizeDN(configuration().LDAPAdmin) {
+		return errors.New("the LDAP admin entry is protected")
+	}
+	name := rdnValue(dn)
+	if isProtectedUser(name) || isProtectedGroup(name) {
+		return fmt.Errorf("%s is protected by divine spirits", name)
+	}
+	return nil
+}
+
+// checkLDIFMembers refuses to remove protected users from groups
+func checkLDIFMembers(before, after ldifEntry) error {
+	for _, member := range before["uniquemember"].Values {
+		if isProtectedUser(rdnValue(member)) && !after.has("uniqueMember", member) {
+			return fmt.Errorf("%s cannot be removed from groups", rdnValue(member))
+		}
+	}
+	return nil
+}
+
+func isGroupEntry(entry ldifEntry) bool {
+	return entry.has("objectClass", "groupOfUniqueNames")
+}
+
+// normalizeDN lowercases dn and removes spaces after separators, for comparisons
+func normalizeDN(dn string) string {
+	return strings.ToLower(strings.Replace(dn, ", ", ",", -1))
+}
+
+// splitDN splits dn into its first RDN and the DN of its parent
+func splitDN(dn string) (rdn, parent string) {
+	for i := 0; i < len(dn); i++ {
+		switch dn[i] {
+		case '\\':
+			i++
+		case ',':
+			return dn[:i], strings.TrimLeft(dn[i+1:], " ")
+		}
+	}
+	return dn, ""
+}
+
+// splitRDN splits `cn=bilbo` into attribute and value
+func splitRDN(rdn string) (attr, value string) {
+	if i := strings.Index(rdn, "="); i >= 0 {
+		return rdn[:i], rdn[i+1:]
+	}
+	return rdn, ""
+}
+
+// LDIFApply applies the LDIF file in the request body. With ?dry_run=true, only the planned diff is returned
+func LDIFApply() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		records, err := parseLDIF(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Error parsing Request Body: " + err.Error()))
+			return
+		}
+		report, err := applyLDIF(r.Context(), records, r.URL.Query().Get("dry_run") == "true", requestActor(r))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error occurred: " + err.Error()))
+			return
+		}
+		status := http.StatusOK
+		if report.RolledBack {
+			status = http.StatusInternalServerError
+		} else if report.Error != "" {
+			status = http.StatusUnprocessableEntity
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+func cmdLDIF(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("ldif", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only print the planned changes")
+	asJSON := flags.Bool("json", false, "print report as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager ldif [flags] FILE")
+	}
+
+	readConfig()
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := parseLDIF(file)
+	if err != nil {
+		return err
+	}
+	report, err := applyLDIF(ctx, records, *dryRun, cliActor())
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else {
+		for _, change := range report.Changes {
+			fmt.Printf("%s %s (line %d): %s", change.ChangeType, change.DN, change.Line, change.Status)
+			if change.Error != "" {
+				fmt.Printf(": %s", change.Error)
+			}
+			fmt.Println()
+			for _, line := range change.Diff {
+				fmt.Println("   ", line)
+			}
+		}
+	}
+	if report.Error != "" {
+		return errors.New(report.Error)
+	}
+	return nil
+}
+
+// cliActor names the user running a CLI command, for audit logging
+func cliActor() string {
+	if u, err := user.Current(); err == nil {
+		return "cli:" + u.Username
+	}
+	return "cli"
+}
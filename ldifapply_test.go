@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testLDIFEntry builds an entry from `name: value` lines
+func testLDIFEntry(lines ...string) ldifEntry {
+	var attributes []ldifAttribute
+	for _, line := range lines {
+		parts := strings.SplitN(line, ": ", 2)
+		attributes = appendLDIFValue(attributes, parts[0], parts[1])
+	}
+	entry := ldifEntry{}
+	for _, attr := range attributes {
+		entry[strings.ToLower(attr.Name)] = attr
+	}
+	return entry
+}
+
+func TestValidateLDIFEntry(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry ldifEntry
+		err   string
+	}{
+		{"user", testLDIFEntry("objectClass: inetOrgPerson", "objectClass: organizationalPerson", "cn: bilbo.baggins",
+			"userPassword: {SHA512}abc"), ""},
+		{"group", testLDIFEntry("objectClass: groupOfUniqueNames", "cn: hobbits and friends"), ""},
+		{"no objectClass", testLDIFEntry("cn: bilbo"), "entry has no objectClass"},
+		{"user without cn", testLDIFEntry("objectClass: organizationalPerson", "sn: Baggins"), "user entry has no cn"},
+		{"invalid username", testLDIFEntry("objectClass: OrganizationalPerson", "cn: bilbo baggins"), `invalid username "bilbo baggins"`},
+		{"username starting with a dot", testLDIFEntry("objectClass: organizationalPerson", "cn: .bilbo"), `invalid username ".bilbo"`},
+		{"cleartext password", testLDIFEntry("objectClass: organizationalPerson", "cn: bilbo", "userPassword: secret"),
+			"userPassword must be hashed"},
+	}
+	for _, test := range tests {
+		err := validateLDIFEntry("cn=x,dc=example,dc=com", test.entry)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestValidateLDIFEntryAfterModify(t *testing.T) {
+	tests := []struct {
+		name string
+		mod  ldifMod
+		err  string
+	}{
+		{"delete cn", ldifMod{"delete", ldifAttribute{"cn", nil}}, "user entry has no cn"},
+		{"delete the only cn value", ldifMod{"delete", ldifAttribute{"CN", []string{"bilbo"}}}, "user entry has no cn"},
+		{"replace cn", ldifMod{"replace", ldifAttribute{"cn", []string{"frodo"}}}, ""},
+		{"replace cn with an invalid name", ldifMod{"replace", ldifAttribute{"cn", []string{"frodo/"}}}, "invalid username"},
+	}
+	for _, test := range tests {
+		entry := testLDIFEntry("objectClass: organizationalPerson", "cn: bilbo")
+		if err := entry.apply(test.mod); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		err := validateLDIFEntry("cn=bilbo,dc=example,dc=com", entry)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err != "" && (err == nil || !strings.HasPrefix(err.Error(), test.err)):
+			t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+		}
+	}
+}
+
+func TestLDIFEntryApply(t *testing.T) {
+	tests := []struct {
+		name string
+		mod  ldifMod
+		want []string // mail values afterwards
+		err  string
+	}{
+		{"add", ldifMod{"add", ldifAttribute{"mail", []string{"c@example.com"}}}, []string{"a@example.com", "b@example.com", "c@example.com"}, ""},
+		{"add existing", ldifMod{"add", ldifAttribute{"mail", []string{"A@example.com"}}}, nil, "mail already has value"},
+		{"delete value", ldifMod{"delete", ldifAttribute{"Mail", []string{"a@example.com"}}}, []string{"b@example.com"}, ""},
+		{"delete missing value", ldifMod{"delete", ldifAttribute{"mail", []string{"x@example.com"}}}, nil, "mail has no value"},
+		{"delete attribute", ldifMod{"delete", ldifAttribute{"mail", nil}}, nil, ""},
+		{"delete missing attribute", ldifMod{"delete", ldifAttribute{"description", nil}}, []string{"a@example.com", "b@example.com"}, "no such attribute"},
+		{"replace", ldifMod{"replace", ldifAttribute{"mail", []string{"x@example.com"}}}, []string{"x@example.com"}, ""},
+		{"replace with nothing", ldifMod{"replace", ldifAttribute{"mail", nil}}, nil, ""},
+	}
+	for _, test := range tests {
+		entry := testLDIFEntry("cn: bilbo", "mail: a@example.com", "mail: b@example.com")
+		err := entry.apply(test.mod)
+		if test.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+				t.Errorf("%s: got error %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := entry["mail"].Values; strings.Join(got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("%s: mail is %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+const (
+	listDefaultLimit = 100
+	listMaxLimit     = 1000
+)
+
+// listQuery holds the search, sort and pagination parameters of a list request
+type listQuery struct {
+	Query  string // ?q=, substring of name, display name or mail
+	Group  string // ?group=, only members of this group
+	Sort   string // ?sort=, attribute to sort by, prefixed with `-` for descending order
+	Limit  int    // ?limit=, page size
+	Cursor string // ?cursor=, opaque position returned as nextCursor by the previous page
+}
+
+// listPage is a single page of a list response
+type listPage struct {
+	Items      interface{} `json:"items"`
+	Total      int         `json:"total"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// listCursor marks the last item of a page by its sort key and name
+type listCursor struct {
+	Key  string `json:"k"`
+	Name string `json:"n"`
+}
+
+var (
+	userSortKeys = map[string]func(UserEntry) string{
+		"name":        func(u UserEntry) string { return strings.ToLower(u.Username) },
+		"displayName": func(u UserEntry) string { return strings.ToLower(u.DisplayName) },
+		"mail":        func(u UserEntry) string { return strings.ToLower(u.Mail) },
+	}
+	groupSortKeys = map[string]func(GroupEntry) string{
+		"name":    func(g GroupEntry) string { return strings.ToLower(g.Name) },
+		"members": func(g GroupEntry) string { return fmt.Sprintf("%08d", len(g.Members)) },
+	}
+)
+
+// listQueryError is an invalid list parameter, a client error unlike the LDAP errors of a search
+type listQueryError struct {
+	message string
+}
+
+func (e *listQueryError) Error() string { return e.message }
+
+func listQueryErrorf(format string, args ...interface{}) error {
+	return &listQueryError{fmt.Sprintf(format, args...)}
+}
+
+// isListQueryError reports whether err is caused by the list parameters
+func isListQueryError(err error) bool {
+	var queryErr *listQueryError
+	return errors.As(err, &queryErr)
+}
+
+// hasListParams checks whether any of the list parameters is set
+func hasListParams(r *http.Request) bool {
+	query := r.URL.Query()
+	for _, p := range []string{"q", "group", "sort", "limit", "cursor"} {
+		if query.Get(p) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func parseListQuery(r *http.Request) (listQuery, error) {
+	query := r.URL.Query()
+	q := listQuery{
+		Query:  query.Get("q"),
+		Group:  query.Get("group"),
+		Sort:   query.Get("sort"),
+		Limit:  listDefaultLimit,
+		Cursor: query.Get("cursor"),
+	}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(limit); err != nil || q.Limit < 1 {
+			return q, listQueryErrorf("limit must be a positive number")
+		}
+		if q.Limit > listMaxLimit {
+			q.Limit = listMaxLimit
+		}
+	}
+	if q.Sort == "" {
+		q.Sort = "name"
+	}
+	return q, nil
+}
+
+// LDAPSearchUsers searches users matching q.Query and q.Group, sorted and paginated according to q
+func LDAPSearchUsers(ctx context.Context, q listQuery) ([]UserEntry, int, string, error) {
+	key, ok := userSortKeys[strings.TrimPrefix(q.Sort, "-")]
+	if !ok {
+		return nil, 0, "", listQueryErrorf("cannot sort users by %q", q.Sort)
+	}
+
+	users, err := listUsers(ctx, q)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	keys := make([]listCursor, len(users))
+	for i := range users {
+		keys[i] = listCursor{key(users[i]), users[i].Username}
+	}
+	sort.Sort(listSorter{keys: keys, swap: func(i, j int) { users[i], users[j] = users[j], users[i] }, desc: strings.HasPrefix(q.Sort, "-")})
+	from, to, next, err := listPageBounds(keys, q)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return users[from:to], len(users), next, nil
+}
+
+// LDAPSearchGroups searches groups whose name contains q.Query, sorted and paginated according to q
+func LDAPSearchGroups(ctx context.Context, q listQuery) ([]GroupEntry, int, string, error) {
+	key, ok := groupSortKeys[strings.TrimPrefix(q.Sort, "-")]
+	if !ok {
+		return nil, 0, "", listQueryErrorf("cannot sort groups by %q", q.Sort)
+	}
+
+	if q.Group != "" {
+		return nil, 0, "", listQueryErrorf("groups cannot be filtered by group")
+	}
+	groups, err := listGroups(ctx, q)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	keys := make([]listCursor, len(groups))
+	for i := range groups {
+		keys[i] = listCursor{key(groups[i]), groups[i].Name}
+	}
+	sort.Sort(listSorter{keys: keys, swap: func(i, j int) { groups[i], groups[j] = groups[j], groups[i] }, desc: strings.HasPrefix(q.Sort, "-")})
+	from, to, next, err := listPageBounds(keys, q)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	return groups[from:to], len(groups), next, nil
+}
+
+// listUsers returns the users matching q.Query and q.Group, filtering the directory cache if enabled
+func listUsers(ctx context.Context, q listQuery) ([]UserEntry, error) {
+	groupDN := ""
+	if q.Group != "" {
+		graph, err := loadGroupGraph(ctx)
+		if err != nil {
+			return nil, err
+		}
+		group := graph.group(q.Group)
+		if group == nil {
+			return nil, nil
+		}
+		groupDN = group.DN
+	}
+
+	if directory == nil {
+		filter := "(objectClass=organizationalPerson)"
+		if q.Query != "" {
+			escaped := ldap.EscapeFilter(q.Query)
+			filter += fmt.Sprintf("(|(cn=*%s*)(displayName=*%s*)(mail=*%s*))", escaped, escaped, escaped)
+		}
+		if q.Group != "" {
+			filter += fmt.Sprintf("(memberOf=%s)", ldap.EscapeFilter(groupDN))
+		}
+		return pLDAPListUsers(ctx, "(&"+filter+")")
+	}
+
+	all, err := LDAPListUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	group := normalizeDN(groupDN)
+	users := all[:0]
+	for _, user := range all {
+		if q.Query != "" && !containsFold(user.Username, q.Query) && !containsFold(user.DisplayName, q.Query) && !containsFold(user.Mail, q.Query) {
+			continue
+		}
+		if q.Group != "" && !containsDN(user.Groups, group) {
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// listGroups returns the groups whose name contains q.Query, filtering the directory cache if enabled
+func listGroups(ctx context.Context, q listQuery) ([]GroupEntry, error) {
+	if directory == nil {
+		filter := "(objectClass=groupOfUniqueNames)"
+		if q.Query != "" {
+			filter += fmt.Sprintf("(cn=*%s*)", ldap.EscapeFilter(q.Query))
+		}
+		return pLDAPListGroups(ctx, "(&"+filter+")")
+	}
+
+	all, err := LDAPListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	groups := all[:0]
+	for _, group := range all {
+		if q.Query == "" || containsFold(group.Name, q.Query) {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// containsFold reports whether substr is in s, ignoring case like LDAP substring filters on cn, displayName and mail
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// containsDN reports whether the normalized dn is in dns
+func containsDN(dns []string, dn string) bool {
+	for _, value := range dns {
+		if normalizeDN(value) == dn {
+			return true
+		}
+	}
+	return false
+}
+
+// listSorter sorts items by their keys, ties are broken by name
+type listSorter struct {
+	keys []listCursor
+	swap func(i, j int)
+	desc bool
+}
+
+func (s listSorter) Len() int { return len(s.keys) }
+
+func (s listSorter) Less(i, j int) bool { return listLess(s.keys[i], s.keys[j], s.desc) }
+
+func (s listSorter) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.swap(i, j)
+}
+
+func listLess(a, b listCursor, desc bool) bool {
+	if desc {
+		a, b = b, a
+	}
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	return a.Name < b.Name
+}
+
+// listPageBounds returns the range of sorted keys on the page selected by q, and the cursor of the next page.
+// The cursor stores the position by value, so pages stay consistent when entries are added or removed in between.
+func listPageBounds(keys []listCursor, q listQuery) (from, to int, next string, err error) {
+	if q.Cursor != "" {
+		var cursor listCursor
+		data, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+		if err != nil || json.Unmarshal(data, &cursor) != nil {
+			return 0, 0, "", listQueryErrorf("invalid cursor")
+		}
+		desc := strings.HasPrefix(q.Sort, "-")
+		from = sort.Search(len(keys), func(i int) bool { return listLess(cursor, keys[i], desc) })
+	}
+	to = from + q.Limit
+	if to >= len(keys) {
+		return from, len(keys), "", nil
+	}
+	data, _ := json.Marshal(keys[to-1])
+	return from, to, base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// writeListHeaders exposes total count and next cursor of a page to v1 clients, which expect a bare array as body
+func writeListHeaders(w http.ResponseWriter, total int, next string) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+}
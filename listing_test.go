@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestListSorter(t *testing.T) {
+	tests := []struct {
+		desc bool
+		want []string
+	}{
+		{false, []string{"a", "c", "b", "d"}},
+		{true, []string{"d", "b", "c", "a"}},
+	}
+	for _, test := range tests {
+		keys := []listCursor{{"2", "b"}, {"1", "c"}, {"3", "d"}, {"1", "a"}}
+		names := []string{"b", "c", "d", "a"}
+		sort.Sort(listSorter{keys: keys, swap: func(i, j int) { names[i], names[j] = names[j], names[i] }, desc: test.desc})
+		if !reflect.DeepEqual(names, test.want) {
+			t.Errorf("desc=%v: items sorted as %v, want %v", test.desc, names, test.want)
+		}
+		for i := range keys {
+			if keys[i].Name != names[i] {
+				t.Errorf("desc=%v: keys and items out of step at %d", test.desc, i)
+			}
+		}
+	}
+}
+
+// listPages collects the names of all pages of keys, following the cursors
+func listPages(t *testing.T, keys []listCursor, q listQuery) [][]string {
+	t.Helper()
+	var pages [][]string
+	for i := 0; i < len(keys)+1; i++ {
+		from, to, next, err := listPageBounds(keys, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page []string
+		for _, key := range keys[from:to] {
+			page = append(page, key.Name)
+		}
+		pages = append(pages, page)
+		if next == "" {
+			return pages
+		}
+		q.Cursor = next
+	}
+	t.Fatal("cursors do not end")
+	return nil
+}
+
+func TestListPageBounds(t *testing.T) {
+	keys := []listCursor{{"a", "a"}, {"b", "b"}, {"b", "c"}, {"d", "d"}, {"e", "e"}}
+	tests := []struct {
+		name  string
+		keys  []listCursor
+		query listQuery
+		want  [][]string
+	}{
+		{"single page", keys, listQuery{Limit: 10, Sort: "name"}, [][]string{{"a", "b", "c", "d", "e"}}},
+		{"exact pages", keys[:4], listQuery{Limit: 2, Sort: "name"}, [][]string{{"a", "b"}, {"c", "d"}}},
+		{"last page shorter", keys, listQuery{Limit: 2, Sort: "name"}, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{"empty", nil, listQuery{Limit: 2, Sort: "name"}, [][]string{nil}},
+		{"descending", []listCursor{{"e", "e"}, {"d", "d"}, {"b", "c"}, {"b", "b"}, {"a", "a"}},
+			listQuery{Limit: 2, Sort: "-name"}, [][]string{{"e", "d"}, {"c", "b"}, {"a"}}},
+	}
+	for _, test := range tests {
+		if got := listPages(t, test.keys, test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: pages %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestListCursorSurvivesChanges(t *testing.T) {
+	keys := []listCursor{{"a", "a"}, {"b", "b"}, {"c", "c"}, {"d", "d"}}
+	_, _, next, err := listPageBounds(keys, listQuery{Limit: 2, Sort: "name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b, the last item of the first page, is deleted and an item before it is added
+	changed := []listCursor{{"0", "0"}, {"a", "a"}, {"c", "c"}, {"d", "d"}}
+	from, to, _, err := listPageBounds(changed, listQuery{Limit: 2, Sort: "name", Cursor: next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := changed[from:to]; !reflect.DeepEqual(got, []listCursor{{"c", "c"}, {"d", "d"}}) {
+		t.Errorf("second page %v, want c and d", got)
+	}
+}
+
+func TestListInvalidCursor(t *testing.T) {
+	keys := []listCursor{{"a", "a"}}
+	for _, cursor := range []string{"not base64!", base64.RawURLEncoding.EncodeToString([]byte("not json"))} {
+		_, _, _, err := listPageBounds(keys, listQuery{Limit: 1, Cursor: cursor})
+		if !isListQueryError(err) {
+			t.Errorf("cursor %q: got %v, want a list query error", cursor, err)
+		}
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		url     string
+		want    listQuery
+		invalid bool
+	}{
+		{"/api/v2/users", listQuery{Sort: "name", Limit: listDefaultLimit}, false},
+		{"/api/v2/users?q=bil&group=hobbits&sort=-mail&limit=5&cursor=x",
+			listQuery{Query: "bil", Group: "hobbits", Sort: "-mail", Limit: 5, Cursor: "x"}, false},
+		{"/api/v2/users?limit=5000", listQuery{Sort: "name", Limit: listMaxLimit}, false},
+		{"/api/v2/users?limit=0", listQuery{}, true},
+		{"/api/v2/users?limit=ten", listQuery{}, true},
+	}
+	for _, test := range tests {
+		q, err := parseListQuery(httptest.NewRequest("GET", test.url, nil))
+		if test.invalid {
+			if !isListQueryError(err) {
+				t.Errorf("%s: got %v, want a list query error", test.url, err)
+			}
+			continue
+		}
+		if err != nil || q != test.want {
+			t.Errorf("%s: got %+v, %v, want %+v", test.url, q, err, test.want)
+		}
+	}
+}
+
+func TestIsListQueryError(t *testing.T) {
+	if isListQueryError(errors.New("connection reset")) || isListQueryError(nil) {
+		t.Error("other errors are not list query errors")
+	}
+	if !isListQueryError(listQueryErrorf("cannot sort users by %q", "x")) {
+		t.Error("listQueryErrorf is a list query error")
+	}
+}
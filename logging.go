@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Structured, levelled logging as logfmt or JSON lines. Messages of the standard log package,
+// used throughout the server, are logged at info level.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{levelDebug: "debug", levelInfo: "info", levelWarn: "warn", levelError: "error"}
+
+// parseLogLevel returns the level with the given name
+func parseLogLevel(name string) (logLevel, bool) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, true
+		}
+	}
+	return levelInfo, false
+}
+
+// structuredLogger writes log events with a level, a message and key value fields
+type structuredLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	level  logLevel
+	format string // logfmt or json
+}
+
+var logger = &structuredLogger{out: os.Stderr, level: levelInfo, format: "logfmt"}
+
+// setupLogging configures the logger from the configuration and routes the standard log package through it
+func setupLogging(conf ServerConfig) {
+	logger.mu.Lock()
+	logger.level, _ = parseLogLevel(conf.LogLevel)
+	logger.format = conf.LogFormat
+	logger.mu.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdlogWriter{})
+}
+
+// sensitiveKey matches field names whose values must never be logged. Only whole words of
+// the name are matched, so e.g. "key" of a rate limit or "passed" stay readable
+var sensitiveKey = regexp.MustCompile(`(?i)^([a-z0-9]+[_.-])*(pass|passwd|password|secret|token|authorization|cookie|(api|private|secret|signing)[_-]?key)$`)
+
+// redacted is logged instead of sensitive values
+const redacted = "[REDACTED]"
+
+// logEvent logs msg at level with fields given as alternating keys and values
+func logEvent(level logLevel, msg string, fields ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	if level < logger.level {
+		return
+	}
+	keys := []string{"time", "level", "msg"}
+	values := map[string]interface{}{
+		"time":  time.Now().UTC().Format(time.RFC3339Nano),
+		"level": levelNames[level],
+		"msg":   msg,
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		value := fields[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		if sensitiveKey.MatchString(key) {
+			value = redacted
+		}
+		if _, exists := values[key]; !exists {
+			keys = append(keys, key)
+		}
+		values[key] = value
+	}
+
+	var line []byte
+	if logger.format == "json" {
+		line, _ = json.Marshal(values)
+	} else {
+		var b bytes.Buffer
+		for i, key := range keys {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(key + "=" + logfmtValue(values[key]))
+		}
+		line = b.Bytes()
+	}
+	logger.out.Write(append(line, '\n'))
+}
+
+func logDebug(msg string, fields ...interface{}) { logEvent(levelDebug, msg, fields...) }
+func logInfo(msg string, fields ...interface{})  { logEvent(levelInfo, msg, fields...) }
+func logWarn(msg string, fields ...interface{})  { logEvent(levelWarn, msg, fields...) }
+func logError(msg string, fields ...interface{}) { logEvent(levelError, msg, fields...) }
+
+// logfmtValue quotes values containing spaces, quotes or equal signs
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \"=\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// stdlogWriter turns lines of the standard log package into info events
+type stdlogWriter struct{}
+
+func (stdlogWriter) Write(p []byte) (int, error) {
+	logInfo(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// Request IDs are taken from X-Request-ID or generated, returned in the X-Request-ID response header,
+// in v2 error bodies and logged with every LDAP operation of the request. The ID travels in the request
+// context, which handlers pass on to the LDAP helpers.
+
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// withRequestID returns a copy of ctx carrying the request ID id
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request ID carried by ctx, or ""
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// accessRecorder records status, size and, for server errors, the start of the body of a response
+type accessRecorder struct {
+	statusRecorder
+	bytes int
+	body  []byte
+}
+
+func (r *accessRecorder) Write(p []byte) (int, error) {
+	if r.status >= 500 && len(r.body) < 512 {
+		r.body = append(r.body, p...)
+	}
+	n, err := r.ResponseWriter.Write(p)
+	r.bytes += n
+	return n, err
+}
+
+// RequestLogMiddleware assigns request IDs and writes an access log line for every request.
+// Server errors are logged with the error message of the response
+func RequestLogMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = randomID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(withRequestID(r.Context(), id))
+
+		start := time.Now()
+		recorder := &accessRecorder{statusRecorder: statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		handler.ServeHTTP(recorder, r)
+
+		fields := []interface{}{
+			"request_id", id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"remote", r.RemoteAddr,
+			"client", clientIP(r),
+		}
+		if r.Header.Get("Authorization") != "" {
+			fields = append(fields, "actor", requestActor(r))
+		}
+		if recorder.status >= 500 {
+			logError("request failed", append(fields, "error", strings.TrimSpace(string(recorder.body)))...)
+		} else {
+			logInfo("request", fields...)
+		}
+	})
+}
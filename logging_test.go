@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestObserveLDAPRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	out, level, format := logger.out, logger.level, logger.format
+	logger.out, logger.level, logger.format = &buf, levelDebug, "logfmt"
+	defer func() { logger.out, logger.level, logger.format = out, level, format }()
+
+	ctx := withRequestID(context.Background(), "req-42")
+	done := make(chan struct{})
+	// work started by a request in another goroutine, like bulk import workers
+	go func() {
+		defer close(done)
+		observeLDAP(ctx, "search", "dc=example,dc=com", func() error { return nil })
+	}()
+	<-done
+	observeLDAP(context.Background(), "bind", "cn=admin", func() error { return nil })
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d log lines, want 2: %q", len(lines), buf.String())
+	}
+	if !strings.Contains(lines[0], "request_id=req-42") {
+		t.Errorf("log line without request ID: %s", lines[0])
+	}
+	if !strings.Contains(lines[1], `request_id=""`) {
+		t.Errorf("log line outside a request: %s", lines[1])
+	}
+}
+
+func TestSensitiveKey(t *testing.T) {
+	tests := []struct {
+		key       string
+		sensitive bool
+	}{
+		{"password", true},
+		{"Password", true},
+		{"new_password", true},
+		{"pass", true},
+		{"client_secret", true},
+		{"token", true},
+		{"refresh-token", true},
+		{"Authorization", true},
+		{"Set-Cookie", true},
+		{"api_key", true},
+		{"private_key", true},
+		{"key", false},
+		{"keys", false},
+		{"passed", false},
+		{"tokens_issued", false},
+		{"monkey", false},
+		{"username", false},
+		{"route", false},
+	}
+	for _, test := range tests {
+		if got := sensitiveKey.MatchString(test.key); got != test.sensitive {
+			t.Errorf("%s: sensitive %v, want %v", test.key, got, test.sensitive)
+		}
+	}
+}
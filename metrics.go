@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Metrics in the Prometheus text exposition format, served on /metrics. Counters and histograms
+// are kept in memory and reset on restart, which Prometheus handles.
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	httpRequests = newCounterVec("usermanager_http_requests_total",
+		"HTTP requests by method, route and status code.", "method", "route", "code")
+	httpDuration = newHistogramVec("usermanager_http_request_duration_seconds",
+		"HTTP request latency by method and route.", "method", "route")
+	logins = newCounterVec("usermanager_logins_total",
+		"Login attempts by token role and result.", "role", "result")
+	rateLimited = newCounterVec("usermanager_ratelimit_rejections_total",
+		"Requests rejected by the rate limiter, by route.", "route")
+	ldapOperations = newCounterVec("usermanager_ldap_operations_total",
+		"LDAP operations by type.", "operation")
+	ldapErrors = newCounterVec("usermanager_ldap_operation_errors_total",
+		"Failed LDAP operations by type.", "operation")
+	ldapDuration = newHistogramVec("usermanager_ldap_operation_duration_seconds",
+		"LDAP operation latency by type.", "operation")
+	ldapConnections = newCounterVec("usermanager_ldap_connections_total",
+		"LDAP connections opened.")
+	ldapConnectionsOpen = newGaugeFunc("usermanager_ldap_connections_open",
+		"LDAP connections currently open.", func() (float64, error) { return float64(openLDAPConnections.get()), nil })
+	directoryUsers = newGaugeFunc("usermanager_users",
+		"Users in LDAPBaseDN.", func() (float64, error) {
+			users, err := LDAPListUsers(context.Background())
+			return float64(len(users)), err
+		})
+	directoryGroups = newGaugeFunc("usermanager_groups",
+		"Groups in LDAPBaseDN.", func() (float64, error) {
+			groups, err := LDAPListGroups(context.Background())
+			return float64(len(groups)), err
+		})
+)
+
+// metrics lists all metrics in the order they are exposed
+var metrics = []metric{httpRequests, httpDuration, logins, rateLimited,
+	ldapOperations, ldapErrors, ldapDuration, ldapConnections, ldapConnectionsOpen, directoryUsers, directoryGroups}
+
+// metric is a metric family that writes itself in the text exposition format
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter with labels
+type counterVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	values     map[string]float64 // by rendered label set
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+}
+
+// inc increments the counter for the given label values
+func (c *counterVec) inc(values ...string) {
+	key := renderLabels(c.labels, values)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedLabelSets(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// histogramVec is a histogram of latencies with labels
+type histogramVec struct {
+	name, help string
+	labels     []string
+	mu         sync.Mutex
+	series     map[string]*histogram // by rendered label set
+}
+
+type histogram struct {
+	labels  []string
+	buckets []uint64 // cumulative counts are computed when writing
+	count   uint64
+	sum     float64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: map[string]*histogram{}}
+}
+
+// observe records a duration for the given label values
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	key := renderLabels(h.labels, values)
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.series[key]
+	if s == nil {
+		s = &histogram{labels: values, buckets: make([]uint64, len(latencyBuckets))}
+		h.series[key] = s
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += seconds
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		names := append(append([]string{}, h.labels...), "le")
+		values := append(append([]string{}, s.labels...), "")
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += s.buckets[i]
+			values[len(values)-1] = formatFloat(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, renderLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, renderLabels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// gaugeFunc is a gauge whose value is computed on every scrape. Failing gauges are left out
+type gaugeFunc struct {
+	name, help string
+	value      func() (float64, error)
+}
+
+func newGaugeFunc(name, help string, value func() (float64, error)) *gaugeFunc {
+	return &gaugeFunc{name: name, help: help, value: value}
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	value, err := g.value()
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(value))
+}
+
+// atomicGauge is an integer that can be changed concurrently
+type atomicGauge struct {
+	mu    sync.Mutex
+	value int64
+}
+
+func (g *atomicGauge) add(delta int64) {
+	g.mu.Lock()
+	g.value += delta
+	g.mu.Unlock()
+}
+
+func (g *atomicGauge) get() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+var openLDAPConnections atomicGauge
+
+// renderLabels renders a label set as {name="value",...}
+func renderLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	for i, name := range names {
+		pairs[i] = name + `="` + escaper.Replace(values[i]) + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedLabelSets(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Metrics serves all metrics in the Prometheus text format
+func Metrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for _, m := range metrics {
+			m.write(w)
+		}
+	})
+}
+
+// MetricsTokenMiddleware protects the metrics with the bearer token MetricsToken, if it is set.
+// Scrapers cannot log in, so the JWT of the API is not used
+func MetricsTokenMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if configuration().MetricsToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(configuration().MetricsToken)) != 1 {
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Unauthorized access to this resource"))
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Flush supports streaming responses, e.g. exports
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// instrumentHandler counts the requests to route and records their latency
+func instrumentHandler(method, route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(recorder, r)
+		httpDuration.observe(time.Since(start), method, route)
+		httpRequests.inc(method, route, strconv.Itoa(recorder.status))
+	})
+}
+
+// instrumentedRouter registers routes with instrumentHandler and rateLimitHandler, labelled with their path pattern
+type instrumentedRouter struct {
+	*httprouter.Router
+}
+
+// Handler registers handler for method and path
+func (r instrumentedRouter) Handler(method, path string, handler http.Handler) {
+	r.Router.Handler(method, path, instrumentHandler(method, path, rateLimitHandler(path, handler)))
+}
+
+// GET registers handle for GET requests to path
+func (r instrumentedRouter) GET(path string, handle httprouter.Handle) {
+	r.Router.Handler("GET", path, instrumentHandler("GET", path, rateLimitHandler(path, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		handle(w, req, httprouter.ParamsFromContext(req.Context()))
+	}))))
+}
+
+// countLogin counts a login attempt by its outcome
+func countLogin(role string, authenticated bool, err error) {
+	switch {
+	case err != nil:
+		logins.inc(role, "error")
+	case authenticated:
+		logins.inc(role, "success")
+	default:
+		logins.inc(role, "failure")
+	}
+}
+
+// rateLimitRejected counts a request to route rejected by the rate limiter
+func rateLimitRejected(route string) {
+	rateLimited.inc(route)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/ldap.v2"
+)
+
+// Groups can be members of groups. Membership is resolved transitively from the uniqueMember
+// attributes, the memberOf overlay only knows about direct memberships.
+
+// errGroupCycle is returned when adding a group would make it a member of itself
+var errGroupCycle = errors.New("adding the group would create a cycle")
+
+// nestingMu serializes adding groups to groups, so that concurrent additions like A to B and
+// B to A cannot both pass the cycle check
+var nestingMu sync.Mutex
+
+// groupGraph is the membership graph of all groups. DNs are normalized with normalizeDN
+type groupGraph struct {
+	groups  map[string]*GroupEntry
+	parents map[string][]string // member dn -> dns of the groups it is a direct member of
+}
+
+// loadGroupGraph reads all groups from LDAP
+func loadGroupGraph(ctx context.Context) (*groupGraph, error) {
+	groups, err := LDAPListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newGroupGraph(groups), nil
+}
+
+func newGroupGraph(groups []GroupEntry) *groupGraph {
+	g := &groupGraph{groups: map[string]*GroupEntry{}, parents: map[string][]string{}}
+	for i := range groups {
+		dn := normalizeDN(groups[i].DN)
+		g.groups[dn] = &groups[i]
+		for _, member := range groups[i].Members {
+			member = normalizeDN(member)
+			g.parents[member] = append(g.parents[member], dn)
+		}
+	}
+	return g
+}
+
+// isGroup reports whether dn is a group. A nil graph has no groups
+func (g *groupGraph) isGroup(dn string) bool {
+	return g != nil && g.groups[normalizeDN(dn)] != nil
+}
+
+// group returns the group called name, or nil. Groups are looked up by name because they may have
+// been moved below LDAPBaseDN
+func (g *groupGraph) group(name string) *GroupEntry {
+	if g == nil {
+		return nil
+	}
+	for _, group := range g.groups {
+		if strings.EqualFold(group.Name, name) {
+			return group
+		}
+	}
+	return nil
+}
+
+// effectiveGroups returns the names of all groups dn is a direct or indirect member of
+func (g *groupGraph) effectiveGroups(dn string) []string {
+	seen := map[string]bool{}
+	queue := []string{normalizeDN(dn)}
+	for len(queue) != 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, parent := range g.parents[current] {
+			if !seen[parent] {
+				seen[parent] = true
+				queue = append(queue, parent)
+			}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for parent := range seen {
+		names = append(names, g.groups[parent].Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// contains reports whether dn is a direct or indirect member of the group ancestor
+func (g *groupGraph) contains(ancestor, dn string) bool {
+	target := normalizeDN(dn)
+	seen := map[string]bool{}
+	stack := []string{normalizeDN(ancestor)}
+	for len(stack) != 0 {
+		current := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		group := g.groups[current]
+		if group == nil || seen[current] {
+			continue
+		}
+		seen[current] = true
+		for _, member := range group.Members {
+			member = normalizeDN(member)
+			if member == target {
+				return true
+			}
+			stack = append(stack, member)
+		}
+	}
+	return false
+}
+
+// wouldCycle reports whether adding child as member of parent creates a cycle
+func (g *groupGraph) wouldCycle(parent, child string) bool {
+	return normalizeDN(parent) == normalizeDN(child) || g.contains(child, parent)
+}
+
+// splitMembers separates the members of group into users and groups, leaving out the placeholder member
+func (g *groupGraph) splitMembers(group GroupEntry) (users, groups []string) {
+	for _, dn := range group.Members {
+		switch {
+		case normalizeDN(dn) == normalizeDN(configuration().LDAPAdmin):
+			// placeholder member, added on group creation
+		case g.isGroup(dn):
+			groups = append(groups, dn)
+		default:
+			users = append(users, dn)
+		}
+	}
+	return users, groups
+}
+
+// LDAPAddGroupToGroup makes the group child a member of the group parent
+func LDAPAddGroupToGroup(ctx context.Context, child, parent string) error {
+	nestingMu.Lock()
+	defer nestingMu.Unlock()
+	graph, err := loadGroupGraph(ctx)
+	if err != nil {
+		return err
+	}
+	childGroup, parentGroup := graph.group(child), graph.group(parent)
+	if childGroup == nil || parentGroup == nil {
+		return errors.New("Invalid Groupname supplied!")
+	}
+	if graph.wouldCycle(parentGroup.DN, childGroup.DN) {
+		return errGroupCycle
+	}
+
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	mr := ldap.NewModifyRequest(parentGroup.DN)
+	mr.Add("uniqueMember", []string{childGroup.DN})
+	return l.Modify(mr)
+}
+
+// LDAPRemoveGroupFromGroup removes the group child from the members of the group parent
+func LDAPRemoveGroupFromGroup(ctx context.Context, child, parent string) error {
+	graph, err := loadGroupGraph(ctx)
+	if err != nil {
+		return err
+	}
+	childGroup, parentGroup := graph.group(child), graph.group(parent)
+	if childGroup == nil || parentGroup == nil {
+		return errors.New("Invalid Groupname supplied!")
+	}
+
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	mr := ldap.NewModifyRequest(parentGroup.DN)
+	mr.Delete("uniqueMember", []string{childGroup.DN})
+	return l.Modify(mr)
+}
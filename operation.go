@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+)
+
+// Operations that need several LDAP requests are run as a list of steps, each with a
+// compensating undo. If a step fails, the steps applied before it are undone in reverse order.
+
+// step states reported by operation.run
+const (
+	stepApplied    = "applied"
+	stepFailed     = "failed"
+	stepUndone     = "undone"
+	stepUndoFailed = "undo_failed"
+	stepSkipped    = "skipped"
+)
+
+// StepResult is the outcome of a single step of an operation
+type StepResult struct {
+	Step   string `json:"step"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type operationStep struct {
+	name string
+	do   func() error
+	undo func() error // nil if the step needs no compensation
+}
+
+// operation is a sequence of steps that is applied completely or not at all
+type operation struct {
+	name  string
+	steps []operationStep
+}
+
+func newOperation(name string) *operation {
+	return &operation{name: name}
+}
+
+// step appends a step. undo may be nil
+func (o *operation) step(name string, do, undo func() error) *operation {
+	o.steps = append(o.steps, operationStep{name, do, undo})
+	return o
+}
+
+// run applies the steps in order. On failure, the applied steps are undone and the error of the
+// failed step is returned. The results list every step with its final state
+func (o *operation) run() ([]StepResult, error) {
+	results := make([]StepResult, len(o.steps))
+	for i, step := range o.steps {
+		results[i] = StepResult{Step: step.name, Status: stepSkipped}
+	}
+
+	for i, step := range o.steps {
+		err := step.do()
+		if err == nil {
+			results[i].Status = stepApplied
+			continue
+		}
+		results[i].Status, results[i].Error = stepFailed, err.Error()
+
+		for j := i - 1; j >= 0; j-- {
+			if o.steps[j].undo == nil {
+				continue
+			}
+			if undoErr := o.steps[j].undo(); undoErr != nil {
+				results[j].Status, results[j].Error = stepUndoFailed, undoErr.Error()
+			} else {
+				results[j].Status = stepUndone
+			}
+		}
+		return results, err
+	}
+	return results, nil
+}
+
+// formatSteps renders step results for plain text error messages
+func formatSteps(results []StepResult) string {
+	lines := make([]string, len(results))
+	for i, result := range results {
+		lines[i] = result.Step + ": " + result.Status
+		if result.Error != "" {
+			lines[i] += " (" + result.Error + ")"
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOperationRun(t *testing.T) {
+	// a step is given by a letter, its outcome by the following characters:
+	// "+" applies, "-" fails, "u" adds an undo that succeeds, "x" an undo that fails
+	tests := []struct {
+		name     string
+		steps    []string
+		calls    []string
+		statuses []string
+		wantErr  bool
+	}{
+		{"applied", []string{"a+u", "b+u"}, []string{"do a", "do b"},
+			[]string{stepApplied, stepApplied}, false},
+		{"first fails", []string{"a-u", "b+u"}, []string{"do a"},
+			[]string{stepFailed, stepSkipped}, true},
+		{"undone in reverse order", []string{"a+u", "b+u", "c+u", "d-u", "e+u"},
+			[]string{"do a", "do b", "do c", "do d", "undo c", "undo b", "undo a"},
+			[]string{stepUndone, stepUndone, stepUndone, stepFailed, stepSkipped}, true},
+		{"without undo", []string{"a+u", "b+", "c-u"}, []string{"do a", "do b", "do c", "undo a"},
+			[]string{stepUndone, stepApplied, stepFailed}, true},
+		{"failed undo continues", []string{"a+u", "b+x", "c-"}, []string{"do a", "do b", "do c", "undo b", "undo a"},
+			[]string{stepUndone, stepUndoFailed, stepFailed}, true},
+	}
+	for _, test := range tests {
+		var calls []string
+		call := func(name string, fail bool) func() error {
+			return func() error {
+				calls = append(calls, name)
+				if fail {
+					return errors.New(name + " failed")
+				}
+				return nil
+			}
+		}
+		op := newOperation(test.name)
+		for _, s := range test.steps {
+			name := s[:1]
+			var undo func() error
+			if strings.ContainsAny(s, "ux") {
+				undo = call("undo "+name, strings.Contains(s, "x"))
+			}
+			op.step(name, call("do "+name, strings.Contains(s, "-")), undo)
+		}
+		results, err := op.run()
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%s: calls %q, want %q", test.name, calls, test.calls)
+		}
+		var statuses []string
+		for i, result := range results {
+			statuses = append(statuses, result.Status)
+			if result.Step != test.steps[i][:1] {
+				t.Errorf("%s: result %d for step %q", test.name, i, result.Step)
+			}
+			if failed := result.Status == stepFailed || result.Status == stepUndoFailed; failed != (result.Error != "") {
+				t.Errorf("%s: step %s %s with error %q", test.name, result.Step, result.Status, result.Error)
+			}
+		}
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Errorf("%s: statuses %q, want %q", test.name, statuses, test.statuses)
+		}
+	}
+}
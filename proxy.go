@@ -0,0 +1,283 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Deployment behind a reverse proxy and for browsers on other origins: the client address, scheme and host
+// reported by TrustedProxies, the PathPrefix the server is mounted under and CORS.
+
+// CORSConfig allows browsers to call the API from other origins
+type CORSConfig struct {
+	AllowedOrigins   []string `json:"allowedOrigins"` // e.g. https://example.com, or * for all; empty disables CORS
+	AllowedMethods   []string `json:"allowedMethods"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"` // let browsers send cookies and HTTP authentication
+	MaxAge           int      `json:"maxAge"`           // seconds browsers may cache a preflight response
+}
+
+// corsExposedHeaders are the response headers readable by scripts on other origins
+const corsExposedHeaders = "Location, Retry-After, X-Next-Cursor, X-Request-ID, X-Total-Count"
+
+// forwardedHop is what a proxy reports about the request it received
+type forwardedHop struct {
+	addr, proto, host string
+}
+
+// forwardedHops parses the Forwarded header or, without it, X-Forwarded-For, -Proto and -Host.
+// The client comes first, the hop reported by the proxy in front of the server last
+func forwardedHops(r *http.Request) []forwardedHop {
+	var hops []forwardedHop
+	if values := r.Header.Values("Forwarded"); len(values) != 0 {
+		for _, element := range splitHeader(values) {
+			var hop forwardedHop
+			for _, pair := range strings.Split(element, ";") {
+				equals := strings.Index(pair, "=")
+				if equals < 0 {
+					continue
+				}
+				value := strings.TrimSpace(pair[equals+1:])
+				if unquoted, err := strconv.Unquote(value); err == nil {
+					value = unquoted
+				}
+				switch strings.ToLower(strings.TrimSpace(pair[:equals])) {
+				case "for":
+					hop.addr = forwardedAddr(value)
+				case "proto":
+					hop.proto = strings.ToLower(value)
+				case "host":
+					hop.host = value
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	for _, addr := range splitHeader(r.Header.Values("X-Forwarded-For")) {
+		hops = append(hops, forwardedHop{addr: forwardedAddr(addr)})
+	}
+	if len(hops) != 0 {
+		// the scheme and host are those of the request to the proxy in front of the server
+		last := &hops[len(hops)-1]
+		if proto := splitHeader(r.Header.Values("X-Forwarded-Proto")); len(proto) != 0 {
+			last.proto = strings.ToLower(proto[len(proto)-1])
+		}
+		if host := splitHeader(r.Header.Values("X-Forwarded-Host")); len(host) != 0 {
+			last.host = host[len(host)-1]
+		}
+	}
+	return hops
+}
+
+// splitHeader splits comma separated header values
+func splitHeader(values []string) []string {
+	var items []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+// forwardedAddr strips the port and IPv6 brackets from an address, e.g. [2001:db8::1]:4711
+func forwardedAddr(value string) string {
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		return host
+	}
+	return strings.Trim(value, "[]")
+}
+
+// requestOrigin returns the address of the client and the scheme and host it requested. The forwarding
+// headers are only used if the request comes from one of the TrustedProxies; then the client is the
+// last address not belonging to a trusted proxy, and scheme and host are reported by the outermost trusted proxy
+func requestOrigin(r *http.Request) (addr, scheme, host string) {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	scheme, host = "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	proxies := trustedProxies(configuration().TrustedProxies)
+	if !proxies.contains(addr) {
+		return addr, scheme, host
+	}
+	hops := forwardedHops(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i].proto == "http" || hops[i].proto == "https" {
+			scheme = hops[i].proto
+		}
+		if hops[i].host != "" {
+			host = hops[i].host
+		}
+		if net.ParseIP(hops[i].addr) == nil {
+			break
+		}
+		addr = hops[i].addr
+		if !proxies.contains(addr) {
+			break
+		}
+	}
+	return addr, scheme, host
+}
+
+// clientIP is the address of the client, see requestOrigin
+func clientIP(r *http.Request) string {
+	addr, _, _ := requestOrigin(r)
+	return addr
+}
+
+// externalURL is the absolute URL of path as requested by the client, below the PathPrefix
+func externalURL(r *http.Request, path string) string {
+	_, scheme, host := requestOrigin(r)
+	return scheme + "://" + host + prefixed(path)
+}
+
+// prefixed returns path below the PathPrefix, for links and Location headers
+func prefixed(path string) string {
+	return configuration().PathPrefix + path
+}
+
+type proxyNetworks []*net.IPNet
+
+func (networks proxyNetworks) contains(address string) bool {
+	ip := net.ParseIP(address)
+	for _, network := range networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseTrustedProxy parses a CIDR or a single address
+func parseTrustedProxy(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
+
+var proxyCache struct {
+	sync.Mutex
+	values   []string
+	networks proxyNetworks
+}
+
+// trustedProxies parses values, which the config check has validated, once per configuration
+func trustedProxies(values []string) proxyNetworks {
+	proxyCache.Lock()
+	defer proxyCache.Unlock()
+	if strings.Join(values, ",") != strings.Join(proxyCache.values, ",") || proxyCache.networks == nil {
+		networks := proxyNetworks{}
+		for _, value := range values {
+			if network, err := parseTrustedProxy(value); err == nil {
+				networks = append(networks, network)
+			}
+		}
+		proxyCache.values, proxyCache.networks = values, networks
+	}
+	return proxyCache.networks
+}
+
+// PathPrefixMiddleware serves the routes below the PathPrefix, e.g. /usermanager/api/login, and nothing else
+func PathPrefixMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := configuration().PathPrefix
+		switch {
+		case prefix == "":
+			handler.ServeHTTP(w, r)
+		case r.URL.Path == prefix:
+			// the frontend loads its files relative to the page
+			target := prefix + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+		case strings.HasPrefix(r.URL.Path, prefix+"/"):
+			http.StripPrefix(prefix, handler).ServeHTTP(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// normalizeOrigin lower cases an origin and removes a trailing slash
+func normalizeOrigin(origin string) string {
+	return strings.ToLower(strings.TrimSuffix(origin, "/"))
+}
+
+// validOrigin reports whether origin is * or a scheme and host like https://example.com:8080
+func validOrigin(origin string) bool {
+	if origin == "*" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		strings.TrimSuffix(u.Path, "/") == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin, empty if it is not allowed
+func (cors CORSConfig) allowedOrigin(origin string) string {
+	for _, allowed := range cors.AllowedOrigins {
+		if allowed == "*" && !cors.AllowCredentials {
+			return "*"
+		}
+		if normalizeOrigin(allowed) == normalizeOrigin(origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// CORSMiddleware answers preflight requests and adds CORS headers for the configured origins
+func CORSMiddleware(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cors := configuration().CORS
+		origin := r.Header.Get("Origin")
+		if len(cors.AllowedOrigins) == 0 || origin == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := cors.allowedOrigin(origin)
+		if allowed == "" {
+			// without CORS headers the browser does not pass the response to the script
+			handler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", allowed)
+		if cors.AllowCredentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cors.AllowedMethods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(cors.AllowedHeaders, ", "))
+			if cors.MaxAge > 0 {
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cors.MaxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		handler.ServeHTTP(w, r)
+	})
+}
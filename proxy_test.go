@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestOrigin(t *testing.T) {
+	oldConf := *configuration()
+	defer setConfiguration(oldConf)
+	setConfiguration(ServerConfig{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32"}})
+
+	tests := []struct {
+		name               string
+		remote             string
+		tls                bool
+		header             map[string]string
+		addr, scheme, host string
+	}{
+		{"direct", "198.51.100.7:4711", false, nil, "198.51.100.7", "http", "um.example.com"},
+		{"direct TLS", "198.51.100.7:4711", true, nil, "198.51.100.7", "https", "um.example.com"},
+		{"untrusted proxy", "198.51.100.7:4711", false,
+			map[string]string{"X-Forwarded-For": "203.0.113.5", "X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com"},
+			"198.51.100.7", "http", "um.example.com"},
+		{"trusted proxy", "10.0.0.1:4711", false,
+			map[string]string{"X-Forwarded-For": "203.0.113.5", "X-Forwarded-Proto": "HTTPS", "X-Forwarded-Host": "users.example.com"},
+			"203.0.113.5", "https", "users.example.com"},
+		{"spoofed client", "10.0.0.1:4711", false,
+			map[string]string{"X-Forwarded-For": "198.51.100.9, 203.0.113.5, 10.0.0.2"},
+			"203.0.113.5", "http", "um.example.com"},
+		{"only proxies", "192.0.2.1:4711", false, map[string]string{"X-Forwarded-For": "10.0.0.3,10.0.0.2"},
+			"10.0.0.3", "http", "um.example.com"},
+		{"invalid proto", "10.0.0.1:4711", false, map[string]string{"X-Forwarded-For": "203.0.113.5", "X-Forwarded-Proto": "gopher"},
+			"203.0.113.5", "http", "um.example.com"},
+		{"forwarded", "192.0.2.1:4711", false,
+			map[string]string{"Forwarded": `for=198.51.100.7;proto=https;host=users.example.com, for="[2001:db8::1]:4711"`},
+			"198.51.100.7", "https", "users.example.com"},
+		{"forwarded before x-forwarded-for", "10.0.0.1:4711", false,
+			map[string]string{"Forwarded": "For=203.0.113.5", "X-Forwarded-For": "198.51.100.7"},
+			"203.0.113.5", "http", "um.example.com"},
+		{"obfuscated client", "10.0.0.1:4711", false, map[string]string{"Forwarded": "for=_hidden;proto=https"},
+			"10.0.0.1", "https", "um.example.com"},
+		{"IPv6 proxy", "[2001:db8::2]:443", false, map[string]string{"X-Forwarded-For": "[2001:db9::1]:4711"},
+			"2001:db9::1", "http", "um.example.com"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://um.example.com/api/users", nil)
+		r.RemoteAddr = test.remote
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for name, value := range test.header {
+			r.Header.Set(name, value)
+		}
+		addr, scheme, host := requestOrigin(r)
+		if addr != test.addr || scheme != test.scheme || host != test.host {
+			t.Errorf("%s: got %s, %s, %s, want %s, %s, %s", test.name, addr, scheme, host, test.addr, test.scheme, test.host)
+		}
+	}
+}
+
+func TestParseTrustedProxy(t *testing.T) {
+	tests := []struct {
+		value    string
+		network  string // empty if invalid
+		contains string
+	}{
+		{"192.0.2.1", "192.0.2.1/32", "192.0.2.1"},
+		{"10.0.0.0/8", "10.0.0.0/8", "10.255.0.1"},
+		{"10.1.2.3/8", "10.0.0.0/8", "10.0.0.1"},
+		{"2001:db8::1", "2001:db8::1/128", "2001:db8::1"},
+		{"2001:db8::/32", "2001:db8::/32", "2001:db8:ffff::1"},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", "192.0.2.1"},
+		{"proxy.example.com", "", ""},
+		{"10.0.0.0/33", "", ""},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		network, err := parseTrustedProxy(test.value)
+		if test.network == "" {
+			if err == nil {
+				t.Errorf("%q: parsed as %v", test.value, network)
+			}
+			continue
+		}
+		if err != nil || network.String() != test.network {
+			t.Errorf("%q: got %v, %v, want %s", test.value, network, err, test.network)
+			continue
+		}
+		if !(proxyNetworks{network}).contains(test.contains) {
+			t.Errorf("%q does not contain %s", test.value, test.contains)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	oldConf := *configuration()
+	defer setConfiguration(oldConf)
+
+	explicit := CORSConfig{
+		AllowedOrigins:   []string{"https://app.example.com/"},
+		AllowedMethods:   []string{"GET", "POST"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowCredentials: true,
+		MaxAge:           600,
+	}
+	wildcard := CORSConfig{AllowedOrigins: []string{"*"}, AllowedMethods: []string{"GET"}}
+	tests := []struct {
+		name          string
+		cors          CORSConfig
+		method        string
+		origin        string
+		requestMethod string // Access-Control-Request-Method
+		allowOrigin   string
+		handled       bool // passed to the handler instead of answered as preflight
+	}{
+		{"preflight", explicit, "OPTIONS", "https://app.example.com", "POST", "https://app.example.com", false},
+		{"preflight normalized origin", explicit, "OPTIONS", "HTTPS://App.Example.com", "POST", "HTTPS://App.Example.com", false},
+		{"preflight other origin", explicit, "OPTIONS", "https://evil.example.com", "POST", "", true},
+		{"preflight other port", explicit, "OPTIONS", "https://app.example.com:8443", "POST", "", true},
+		{"options without request method", explicit, "OPTIONS", "https://app.example.com", "", "https://app.example.com", true},
+		{"simple request", explicit, "GET", "https://app.example.com", "", "https://app.example.com", true},
+		{"without origin", explicit, "OPTIONS", "", "POST", "", true},
+		{"wildcard preflight", wildcard, "OPTIONS", "https://any.example.com", "GET", "*", false},
+		{"disabled", CORSConfig{}, "OPTIONS", "https://app.example.com", "POST", "", true},
+	}
+	for _, test := range tests {
+		setConfiguration(ServerConfig{CORS: test.cors})
+		handled := false
+		handler := CORSMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handled = true
+		}))
+		r := httptest.NewRequest(test.method, "/api/users", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.requestMethod != "" {
+			r.Header.Set("Access-Control-Request-Method", test.requestMethod)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		header := w.Header()
+		if handled != test.handled || header.Get("Access-Control-Allow-Origin") != test.allowOrigin {
+			t.Errorf("%s: handled %v, allowed origin %q", test.name, handled, header.Get("Access-Control-Allow-Origin"))
+			continue
+		}
+		if credentials := header.Get("Access-Control-Allow-Credentials") == "true"; credentials != (test.allowOrigin != "" && test.cors.AllowCredentials) {
+			t.Errorf("%s: allow credentials %v", test.name, credentials)
+		}
+		if len(test.cors.AllowedOrigins) != 0 && test.origin != "" && header.Get("Vary") != "Origin" {
+			t.Errorf("%s: vary %q", test.name, header.Values("Vary"))
+		}
+		if test.allowOrigin == "" {
+			continue
+		}
+		if test.handled {
+			if header.Get("Access-Control-Expose-Headers") != corsExposedHeaders || header.Get("Access-Control-Allow-Methods") != "" {
+				t.Errorf("%s: headers %v", test.name, header)
+			}
+			continue
+		}
+		if w.Code != http.StatusNoContent {
+			t.Errorf("%s: preflight status %d", test.name, w.Code)
+		}
+		methods, headers := header.Get("Access-Control-Allow-Methods"), header.Get("Access-Control-Allow-Headers")
+		if methods != strings.Join(test.cors.AllowedMethods, ", ") || headers != strings.Join(test.cors.AllowedHeaders, ", ") {
+			t.Errorf("%s: allowed methods %q, headers %q", test.name, methods, headers)
+		}
+		if maxAge := header.Get("Access-Control-Max-Age"); (maxAge != "") != (test.cors.MaxAge > 0) {
+			t.Errorf("%s: max age %q", test.name, maxAge)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/time/rate"
+)
+
+// Requests are rate limited per route, by client IP or by the username of a login request. Failed logins
+// additionally lock the account for a growing duration. All state is kept in memory and lost on restart.
+
+// RateLimit limits the requests to a route
+type RateLimit struct {
+	Route string  `json:"route"` // path pattern as registered, e.g. /api/v2/users/:name
+	Rate  float64 `json:"rate"`  // requests per second
+	Burst int     `json:"burst"` // requests allowed at once, default 1
+	Key   string  `json:"key"`   // ip (default) or username, the account a login request is for
+}
+
+// LoginLockout locks accounts after repeated failed logins
+type LoginLockout struct {
+	MaxFailures int    `json:"maxFailures"` // failed logins in a row before the account is locked, 0 disables lockouts
+	Duration    int    `json:"duration"`    // seconds of the first lockout, doubled with every further failure
+	MaxDuration int    `json:"maxDuration"` // upper bound of the lockout in seconds
+	Key         string `json:"key"`         // username (default) or client, failures are counted per account or per account and client IP
+}
+
+const (
+	rateLimitByIP       = "ip"
+	rateLimitByUsername = "username"
+
+	lockoutByUsername = "username"
+	lockoutByClient   = "client"
+
+	errCodeRateLimited     = "rate_limited"
+	errCodeLockoutNotFound = "lockout_not_found"
+)
+
+// limiterIdle is how long an unused limiter is kept
+const limiterIdle = 10 * time.Minute
+
+type limiterEntry struct {
+	limit   RateLimit
+	limiter *rate.Limiter
+	used    time.Time
+}
+
+// rateLimiters holds a token bucket per route, key and client or username
+var rateLimiters = struct {
+	sync.Mutex
+	entries map[string]*limiterEntry
+	swept   time.Time
+}{entries: map[string]*limiterEntry{}}
+
+// allowRequest takes a token from the bucket of value under limit and returns how long to wait if there is none
+func allowRequest(limit RateLimit, value string) (bool, time.Duration) {
+	rateLimiters.Lock()
+	defer rateLimiters.Unlock()
+
+	now := time.Now()
+	if now.Sub(rateLimiters.swept) > limiterIdle {
+		for id, entry := range rateLimiters.entries {
+			if now.Sub(entry.used) > limiterIdle {
+				delete(rateLimiters.entries, id)
+			}
+		}
+		rateLimiters.swept = now
+	}
+
+	id := limit.Route + " " + limit.Key + " " + value
+	entry := rateLimiters.entries[id]
+	if entry == nil || entry.limit != limit {
+		// new client, or the limit was changed by a reload
+		entry = &limiterEntry{limit: limit, limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		rateLimiters.entries[id] = entry
+	}
+	entry.used = now
+	reservation := entry.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// rateLimitHandler applies the configured limits of route to handler
+func rateLimitHandler(route string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, limit := range configuration().RateLimits {
+			if limit.Route != route {
+				continue
+			}
+			value := clientIP(r)
+			if limit.Key == rateLimitByUsername {
+				if value = strings.ToLower(loginUsername(w, r)); value == "" {
+					continue
+				}
+			}
+			if ok, delay := allowRequest(limit, value); !ok {
+				rateLimitRejected(route)
+				logDebug("rate limited", "route", route, "key", limit.Key, "value", value)
+				writeTooManyRequests(w, r, delay, "You have reached maximum request limit.")
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// writeTooManyRequests responds with 429 and Retry-After, as JSON error on v2 routes
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, retry time.Duration, message string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+	if strings.HasPrefix(r.URL.Path, "/api/v2/") {
+		writeAPIError(w, http.StatusTooManyRequests, errCodeRateLimited, message)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(message))
+}
+
+// maxLoginBody bounds the request bodies read by loginUsername
+const maxLoginBody = 64 << 10
+
+// loginUsername returns the username of a login form or JSON body, leaving the body readable for the handler
+func loginUsername(w http.ResponseWriter, r *http.Request) string {
+	if r.Body == nil {
+		return ""
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLoginBody))
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+	contentType := r.Header.Get("Content-Type")
+	if strings.Contains(contentType, "application/x-www-form-urlencoded") {
+		values, _ := url.ParseQuery(string(body))
+		return values.Get("username")
+	}
+	if strings.Contains(contentType, "application/json") {
+		var user User
+		json.Unmarshal(body, &user)
+		return user.Username
+	}
+	return ""
+}
+
+// Lockout is the failed login state of an account
+type Lockout struct {
+	Username    string     `json:"username"`
+	Client      string     `json:"client,omitempty"` // IP the failures came from, if counted per client
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"lastFailure"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"` // unset if the account is not locked
+}
+
+type failedLogins struct {
+	username    string
+	client      string
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// lockouts tracks failed logins by lockoutKey, for admin and user logins alike
+var lockouts = struct {
+	sync.Mutex
+	accounts map[string]*failedLogins
+}{accounts: map[string]*failedLogins{}}
+
+// lockoutKey returns the key failed logins to username are counted under, and the client IP if they are
+// counted per client. Per account, an attacker can lock out the owner, per client, a distributed attack gets
+// maxFailures attempts from every address
+func lockoutKey(r *http.Request, username string) (key, client string) {
+	key = strings.ToLower(username)
+	if configuration().LoginLockout.Key == lockoutByClient {
+		client = clientIP(r)
+		key += " " + client
+	}
+	return key, client
+}
+
+// lockedOut returns how long the account is still locked for the client of r
+func lockedOut(r *http.Request, username string) time.Duration {
+	key, _ := lockoutKey(r, username)
+	lockouts.Lock()
+	defer lockouts.Unlock()
+	if account := lockouts.accounts[key]; account != nil {
+		if wait := time.Until(account.lockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+// recordLogin resets the failures of an account on success, and locks it after too many failures
+func recordLogin(r *http.Request, username string, authenticated bool) {
+	settings := configuration().LoginLockout
+	name, client := lockoutKey(r, username)
+	lockouts.Lock()
+	defer lockouts.Unlock()
+	if authenticated || settings.MaxFailures == 0 {
+		delete(lockouts.accounts, name)
+		return
+	}
+
+	now := time.Now().UTC()
+	maxDuration := time.Duration(settings.MaxDuration) * time.Second
+	account := lockouts.accounts[name]
+	if account == nil || now.Sub(account.lastFailure) > maxDuration {
+		// failures are forgotten after the longest lockout
+		account = &failedLogins{username: username, client: client}
+		lockouts.accounts[name] = account
+	}
+	account.failures++
+	account.lastFailure = now
+	if excess := account.failures - settings.MaxFailures; excess >= 0 {
+		duration := maxDuration
+		if excess < 32 {
+			duration = time.Duration(settings.Duration) * time.Second << uint(excess)
+		}
+		if duration > maxDuration || duration <= 0 {
+			duration = maxDuration
+		}
+		account.lockedUntil = now.Add(duration)
+		logWarn("account locked after failed logins", "username", username, "client", client, "failures", account.failures, "until", account.lockedUntil)
+	}
+
+	// forget accounts that have not failed for a while
+	for key, other := range lockouts.accounts {
+		if now.Sub(other.lastFailure) > maxDuration && now.After(other.lockedUntil) {
+			delete(lockouts.accounts, key)
+		}
+	}
+}
+
+// checkLockout responds with 429 if the account of a login is locked, before its password is checked
+func checkLockout(w http.ResponseWriter, r *http.Request, username, role string) bool {
+	wait := lockedOut(r, username)
+	if wait <= 0 {
+		return true
+	}
+	logins.inc(role, "locked")
+	writeTooManyRequests(w, r, wait, "Too many failed logins, try again later")
+	return false
+}
+
+// V2LockoutsList lists the accounts with failed logins, locked or not
+func V2LockoutsList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lockouts.Lock()
+		items := make([]Lockout, 0, len(lockouts.accounts))
+		for _, account := range lockouts.accounts {
+			item := Lockout{Username: account.username, Client: account.client, Failures: account.failures, LastFailure: account.lastFailure}
+			if until := account.lockedUntil; time.Now().Before(until) {
+				item.LockedUntil = &until
+			}
+			items = append(items, item)
+		}
+		lockouts.Unlock()
+		sort.Slice(items, func(i, j int) bool {
+			if items[i].Username != items[j].Username {
+				return items[i].Username < items[j].Username
+			}
+			return items[i].Client < items[j].Client
+		})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"items": items})
+	})
+}
+
+// V2LockoutsClear clears the failed logins of an account, from all clients
+func V2LockoutsClear() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+		found := clearLockouts(name)
+		if !found {
+			writeAPIError(w, http.StatusNotFound, errCodeLockoutNotFound, "No failed logins recorded for this account")
+			return
+		}
+		auditLog(requestActor(r), "clearLockout", name, nil)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// clearLockouts forgets the failed logins of username and reports whether there were any
+func clearLockouts(username string) bool {
+	lockouts.Lock()
+	defer lockouts.Unlock()
+	found := false
+	for key, account := range lockouts.accounts {
+		if strings.EqualFold(account.username, username) {
+			delete(lockouts.accounts, key)
+			found = true
+		}
+	}
+	return found
+}
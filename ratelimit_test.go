@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginUsername(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{"form", "application/x-www-form-urlencoded", "username=bilbo&password=x", "bilbo"},
+		{"json", "application/json; charset=utf-8", `{"username": "bilbo", "password": "x"}`, "bilbo"},
+		{"other", "text/plain", "username=bilbo", ""},
+		{"invalid json", "application/json", `{"username": `, ""},
+		{"too large", "application/x-www-form-urlencoded", "username=bilbo&x=" + strings.Repeat("a", maxLoginBody), ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/api/login", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		if got := loginUsername(httptest.NewRecorder(), r); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+		if len(test.body) > maxLoginBody {
+			continue
+		}
+		// the handler can still read the body
+		if body, _ := ioutil.ReadAll(r.Body); string(body) != test.body {
+			t.Errorf("%s: body %q left for the handler", test.name, body)
+		}
+	}
+}
+
+func TestLoginUsernameTooLarge(t *testing.T) {
+	// the server closes the connection after an oversized body, which needs the real ResponseWriter
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(loginUsername(w, r)))
+	}))
+	defer server.Close()
+	res, err := http.Post(server.URL, "application/x-www-form-urlencoded",
+		strings.NewReader("username=bilbo&x="+strings.Repeat("a", 2*maxLoginBody)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if body, _ := ioutil.ReadAll(res.Body); len(body) != 0 || !res.Close {
+		t.Errorf("got %q, connection closed %v", body, res.Close)
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	limit := RateLimit{Route: "/test/allow", Rate: 1, Burst: 2, Key: rateLimitByIP}
+	tests := []struct {
+		client string
+		allow  bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.1", true},
+		{"192.0.2.1", false},
+		{"192.0.2.2", true},
+	}
+	for i, test := range tests {
+		allowed, delay := allowRequest(limit, test.client)
+		if allowed != test.allow || (allowed != (delay == 0)) {
+			t.Errorf("request %d from %s: allowed %v with delay %v, want %v", i, test.client, allowed, delay, test.allow)
+		}
+	}
+	// a reload that changes the limit starts a new bucket
+	limit.Burst = 3
+	if allowed, _ := allowRequest(limit, "192.0.2.1"); !allowed {
+		t.Error("changed limit still uses the old bucket")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	oldConf := *configuration()
+	defer setConfiguration(oldConf)
+
+	request := func(addr string) *http.Request {
+		r := httptest.NewRequest("POST", "/api/login", nil)
+		r.RemoteAddr = addr + ":1234"
+		return r
+	}
+	type login struct {
+		client        string
+		authenticated bool
+	}
+	tests := []struct {
+		name   string
+		key    string
+		logins []login
+		locked map[string]bool // by client
+	}{
+		{"below limit", lockoutByUsername, []login{{"192.0.2.1", false}},
+			map[string]bool{"192.0.2.1": false}},
+		{"per account", lockoutByUsername, []login{{"192.0.2.1", false}, {"192.0.2.2", false}},
+			map[string]bool{"192.0.2.1": true, "192.0.2.2": true, "192.0.2.3": true}},
+		{"success resets", lockoutByUsername, []login{{"192.0.2.1", false}, {"192.0.2.1", true}, {"192.0.2.1", false}},
+			map[string]bool{"192.0.2.1": false}},
+		{"per client", lockoutByClient, []login{{"192.0.2.1", false}, {"192.0.2.1", false}, {"192.0.2.2", false}},
+			map[string]bool{"192.0.2.1": true, "192.0.2.2": false, "192.0.2.3": false}},
+	}
+	for _, test := range tests {
+		clearLockouts("bilbo")
+		setConfiguration(ServerConfig{LoginLockout: LoginLockout{MaxFailures: 2, Duration: 60, MaxDuration: 3600, Key: test.key}})
+		for _, l := range test.logins {
+			recordLogin(request(l.client), "Bilbo", l.authenticated)
+		}
+		for client, locked := range test.locked {
+			wait := lockedOut(request(client), "bilbo")
+			if (wait > 0) != locked || wait > time.Minute {
+				t.Errorf("%s: client %s locked for %v, want locked %v", test.name, client, wait, locked)
+			}
+		}
+	}
+	if !clearLockouts("BILBO") || clearLockouts("bilbo") {
+		t.Error("clearing the failed logins of all clients")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Reconciliation of groups and memberships against a desired state file:
+//
+//	groups:
+//	  board:
+//	    members: [frodo, sam]
+//	  legacy:
+//	    unmanaged: true
+//	users:
+//	  backup:
+//	    unmanaged: true
+//
+// Declared groups are created if missing and declared members are added. With prune, members
+// that are not declared are removed. Unmanaged groups and users are never changed.
+
+// DesiredState is the parsed desired state file
+type DesiredState struct {
+	Groups         map[string]DesiredGroup
+	UnmanagedUsers map[string]bool
+}
+
+// DesiredGroup declares the members of a group
+type DesiredGroup struct {
+	Members   []string
+	Unmanaged bool
+}
+
+// reconcile actions
+const (
+	reconcileCreateGroup  = "create_group"
+	reconcileAddMember    = "add_member"
+	reconcileRemoveMember = "remove_member"
+)
+
+// ReconcileAction is a single change of a reconciliation plan
+type ReconcileAction struct {
+	Action string `json:"action"`
+	Group  string `json:"group"`
+	User   string `json:"user,omitempty"`
+	Status string `json:"status,omitempty"` // applied or failed, empty if not applied
+	Error  string `json:"error,omitempty"`
+}
+
+// ReconcilePlan lists the changes needed to reach the desired state
+type ReconcilePlan struct {
+	Actions  []ReconcileAction `json:"actions"`
+	Warnings []string          `json:"warnings,omitempty"`
+}
+
+// parseDesiredState reads a desired state YAML file
+func parseDesiredState(r io.Reader) (DesiredState, error) {
+	state := DesiredState{Groups: map[string]DesiredGroup{}, UnmanagedUsers: map[string]bool{}}
+	doc, err := parseYAML(r)
+	if err != nil {
+		return state, err
+	}
+	if doc == nil {
+		return state, nil
+	}
+	top, ok := doc.(map[string]interface{})
+	if !ok {
+		return state, errors.New("expected a mapping with groups and users")
+	}
+	for key := range top {
+		if key != "groups" && key != "users" {
+			return state, fmt.Errorf("unknown key %q", key)
+		}
+	}
+
+	groups, ok := top["groups"].(map[string]interface{})
+	if !ok && top["groups"] != nil {
+		return state, errors.New("groups must be a mapping of group names")
+	}
+	for name, value := range groups {
+		if !usernamePattern.MatchString(name) {
+			return state, fmt.Errorf("invalid group name %q", name)
+		}
+		var group DesiredGroup
+		fields, ok := value.(map[string]interface{})
+		if !ok && value != nil {
+			return state, fmt.Errorf("group %s: expected members and/or unmanaged", name)
+		}
+		for key, field := range fields {
+			switch key {
+			case "members":
+				members, ok := field.([]interface{})
+				if !ok && field != nil {
+					return state, fmt.Errorf("group %s: members must be a list", name)
+				}
+				for _, member := range members {
+					if member == nil {
+						return state, fmt.Errorf("group %s: empty member", name)
+					}
+					group.Members = append(group.Members, fmt.Sprint(member))
+				}
+			case "unmanaged":
+				if group.Unmanaged, ok = field.(bool); !ok {
+					return state, fmt.Errorf("group %s: unmanaged must be true or false", name)
+				}
+			default:
+				return state, fmt.Errorf("group %s: unknown key %q", name, key)
+			}
+		}
+		state.Groups[name] = group
+	}
+
+	users, ok := top["users"].(map[string]interface{})
+	if !ok && top["users"] != nil {
+		return state, errors.New("users must be a mapping of usernames")
+	}
+	for name, value := range users {
+		fields, ok := value.(map[string]interface{})
+		if !ok && value != nil {
+			return state, fmt.Errorf("user %s: expected unmanaged", name)
+		}
+		for key, field := range fields {
+			if key != "unmanaged" {
+				return state, fmt.Errorf("user %s: unknown key %q", name, key)
+			}
+			unmanaged, ok := field.(bool)
+			if !ok {
+				return state, fmt.Errorf("user %s: unmanaged must be true or false", name)
+			}
+			state.UnmanagedUsers[name] = unmanaged
+		}
+	}
+	return state, nil
+}
+
+// planReconcile compares state with the directory and returns the changes needed to reach it
+func planReconcile(ctx context.Context, state DesiredState, prune bool) (ReconcilePlan, error) {
+	plan := ReconcilePlan{Actions: []ReconcileAction{}}
+	users, err := LDAPListUsers(ctx)
+	if err != nil {
+		return plan, err
+	}
+	groups, err := LDAPListGroups(ctx)
+	if err != nil {
+		return plan, err
+	}
+
+	usernames := map[string]string{} // normalized dn -> username
+	exists := map[string]bool{}
+	for _, user := range users {
+		usernames[normalizeDN(user.DN)] = user.Username
+		exists[user.Username] = true
+	}
+	current := map[string]*GroupEntry{}
+	for i := range groups {
+		current[groups[i].Name] = &groups[i]
+	}
+	unmanaged := func(username string) bool {
+		return state.UnmanagedUsers[username] || isProtectedUser(username)
+	}
+
+	names := make([]string, 0, len(state.Groups))
+	for name := range state.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var unknown []string
+	for _, name := range names {
+		desired := state.Groups[name]
+		if desired.Unmanaged {
+			plan.Warnings = append(plan.Warnings, fmt.Sprintf("group %s is unmanaged, skipped", name))
+			continue
+		}
+		declared := map[string]bool{}
+		for _, member := range desired.Members {
+			if !exists[member] {
+				unknown = append(unknown, fmt.Sprintf("%s (group %s)", member, name))
+			}
+			declared[member] = true
+		}
+
+		members := map[string]bool{}
+		group := current[name]
+		if group == nil {
+			plan.Actions = append(plan.Actions, ReconcileAction{Action: reconcileCreateGroup, Group: name})
+		} else {
+			for _, dn := range group.Members {
+				if username, ok := usernames[normalizeDN(dn)]; ok {
+					members[username] = true
+				} else if normalizeDN(dn) != normalizeDN(configuration().LDAPAdmin) {
+					plan.Warnings = append(plan.Warnings, fmt.Sprintf("group %s: member %s is not a user, kept", name, dn))
+				}
+			}
+		}
+
+		for _, member := range sortedKeys(declared) {
+			if members[member] {
+				continue
+			}
+			if unmanaged(member) {
+				plan.Warnings = append(plan.Warnings, fmt.Sprintf("group %s: %s is unmanaged, not added", name, member))
+				continue
+			}
+			plan.Actions = append(plan.Actions, ReconcileAction{Action: reconcileAddMember, Group: name, User: member})
+		}
+		if !prune {
+			continue
+		}
+		for _, member := range sortedKeys(members) {
+			if declared[member] || unmanaged(member) {
+				continue
+			}
+			plan.Actions = append(plan.Actions, ReconcileAction{Action: reconcileRemoveMember, Group: name, User: member})
+		}
+	}
+	if len(unknown) != 0 {
+		return plan, fmt.Errorf("unknown users: %s", strings.Join(unknown, ", "))
+	}
+	return plan, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// applyReconcile executes the actions of plan in order and stops at the first failure.
+// Running the reconciliation again continues where it stopped
+func applyReconcile(ctx context.Context, plan *ReconcilePlan, actor string) error {
+	for i := range plan.Actions {
+		action := &plan.Actions[i]
+		dn := "cn=" + action.Group + "," + configuration().LDAPBaseDN
+		if action.Action != reconcileCreateGroup {
+			if groupDN, err := LDAPGroupDN(ctx, action.Group); err == nil {
+				dn = groupDN
+			}
+		}
+		var err error
+		switch action.Action {
+		case reconcileCreateGroup:
+			if err = LDAPAddGroup(ctx, dn); err == nil {
+				emitEvent(EventGroupCreated, map[string]string{"groupname": action.Group})
+			}
+		case reconcileAddMember:
+			if err = LDAPAddUserToGroup(ctx, action.User, action.Group); err == nil {
+				emitEvent(EventGroupMemberAdded, map[string]string{"username": action.User, "groupname": action.Group})
+			}
+		case reconcileRemoveMember:
+			if err = LDAPRemoveUserFromGroup(ctx, action.User, action.Group); err == nil {
+				emitEvent(EventGroupMemberRemoved, map[string]string{"username": action.User, "groupname": action.Group})
+			}
+		}
+		auditLog(actor, "reconcile."+action.Action, dn, err)
+		if err != nil {
+			action.Status, action.Error = "failed", err.Error()
+			return fmt.Errorf("%s %s %s: %v", action.Action, action.Group, action.User, err)
+		}
+		action.Status = "applied"
+	}
+	return nil
+}
+
+func (a ReconcileAction) String() string {
+	switch a.Action {
+	case reconcileCreateGroup:
+		return "+ group " + a.Group
+	case reconcileAddMember:
+		return "+ " + a.Group + ": " + a.User
+	case reconcileRemoveMember:
+		return "- " + a.Group + ": " + a.User
+	}
+	return a.Action
+}
+
+func cmdReconcile(args []string) error {
+	ctx := context.Background()
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	apply := flags.Bool("apply", false, "apply the plan (default: only print it)")
+	prune := flags.Bool("prune", false, "remove members that are not declared")
+	asJSON := flags.Bool("json", false, "print plan as JSON")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return errors.New("usage: usermanager reconcile [flags] FILE")
+	}
+
+	readConfig()
+	setupCLIWebhooks()
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	state, err := parseDesiredState(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(0), err)
+	}
+	plan, err := planReconcile(ctx, state, *prune)
+	if err != nil {
+		return err
+	}
+
+	var applyErr error
+	if *apply {
+		applyErr = applyReconcile(ctx, &plan, cliActor())
+	}
+
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(plan)
+		return applyErr
+	}
+	for _, warning := range plan.Warnings {
+		fmt.Println("warning:", warning)
+	}
+	counts := map[string]int{}
+	for _, action := range plan.Actions {
+		counts[action.Action]++
+		line := action.String()
+		if action.Status != "" {
+			line += "  (" + action.Status + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("\n%d groups to create, %d members to add, %d members to remove\n",
+		counts[reconcileCreateGroup], counts[reconcileAddMember], counts[reconcileRemoveMember])
+	if !*apply && len(plan.Actions) != 0 {
+		fmt.Println("run with -apply to make these changes")
+	}
+	return applyErr
+}
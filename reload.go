@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The configuration, the JWT keys and the TLS certificate are reloaded on SIGHUP and by
+// POST /api/v2/admin/reload. The new configuration is validated and its files are read before
+// anything is replaced, so an invalid configuration is rejected and the old one stays live.
+
+// restartSettings are read once at startup, changes to them take effect after a restart
+var restartSettings = map[string]bool{
+	"ServerBindAddr":        true,
+	"Webhooks":              true,
+	"WebhookQueueFile":      true,
+	"WebhookMaxAttempts":    true,
+	"AuditLogFile":          true,
+	"MembershipRequestFile": true,
+	"DirectoryCacheRefresh": true,
+	"DirectoryCacheSync":    true,
+}
+
+var (
+	reloadMu    sync.Mutex   // one reload at a time
+	certificate atomic.Value // *tls.Certificate served, unset without TLS
+)
+
+// ReloadResult lists the settings changed by a reload, by name. Values are not included, they may be secrets
+type ReloadResult struct {
+	Reloaded        time.Time `json:"reloaded"`
+	Changed         []string  `json:"changed"`
+	RestartRequired []string  `json:"restartRequired"`
+}
+
+// tlsConfigured reports whether conf enables TLS
+func tlsConfigured(conf ServerConfig) bool {
+	return conf.SSLCertificate != "" || conf.SSLKeyFile != ""
+}
+
+// loadCertificate reads the TLS certificate and key of conf. In dev mode, a missing certificate is generated
+func loadCertificate(conf ServerConfig) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(conf.SSLCertificate, conf.SSLKeyFile)
+	if err != nil && conf.DevMode && errors.Is(err, os.ErrNotExist) {
+		return ephemeralCertificate()
+	}
+	if err != nil {
+		return nil, errors.New("TLS certificate: " + err.Error())
+	}
+	return &cert, nil
+}
+
+// getCertificate returns the current certificate for every TLS handshake
+func getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := certificate.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return cert, nil
+}
+
+// reloadConfiguration reads and validates the configuration and its files and swaps them in.
+// The configuration is read like at startup, so deployments configured only by environment can reload
+func reloadConfiguration() (ReloadResult, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	conf, err := loadConfig()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	keys, err := loadJWTKeys(conf)
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	oldCert, _ := certificate.Load().(*tls.Certificate)
+	var cert *tls.Certificate
+	if oldCert != nil {
+		if !tlsConfigured(conf) {
+			return ReloadResult{}, errors.New("TLS cannot be disabled without a restart")
+		}
+		if cert, err = loadCertificate(conf); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+
+	old := *configuration()
+	result := ReloadResult{Reloaded: time.Now().UTC(), Changed: []string{}, RestartRequired: []string{}}
+	oldValue, newValue := reflect.ValueOf(old), reflect.ValueOf(conf)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			continue
+		}
+		name := oldValue.Type().Field(i).Name
+		result.Changed = append(result.Changed, name)
+		if restartSettings[name] || (oldCert == nil && (name == "SSLCertificate" || name == "SSLKeyFile")) {
+			result.RestartRequired = append(result.RestartRequired, name)
+		}
+	}
+	if oldKeys := currentJWTKeys(); keys.ephemeral && oldKeys != nil && oldKeys.ephemeral {
+		// keep the tokens of dev mode valid
+		keys = oldKeys
+	} else if !keys.equal(oldKeys) {
+		result.Changed = append(result.Changed, "JWT keys")
+	}
+	if cert != nil && !bytes.Equal(cert.Certificate[0], oldCert.Certificate[0]) {
+		result.Changed = append(result.Changed, "TLS certificate")
+	}
+
+	setConfiguration(conf)
+	configState.keys.Store(keys)
+	if cert != nil {
+		certificate.Store(cert)
+	}
+	setupLogging(conf)
+	// LDAP settings may have changed
+	readiness.mu.Lock()
+	readiness.report = nil
+	readiness.mu.Unlock()
+	invalidateDirectory()
+	return result, nil
+}
+
+// reloadOnSignal reloads the configuration on every SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		logReload(reloadConfiguration())
+	}
+}
+
+func logReload(result ReloadResult, err error) {
+	if err != nil {
+		logError("configuration reload rejected, keeping the current configuration", "error", err)
+		return
+	}
+	logInfo("configuration reloaded", "changed", result.Changed, "restart_required", result.RestartRequired)
+}
+
+// V2ReloadConfig reloads the configuration, responding with the changed settings
+func V2ReloadConfig() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result, err := reloadConfiguration()
+		logReload(result, err)
+		auditLog(requestActor(r), "reloadConfig", "", err)
+		if err != nil {
+			writeAPIError(w, http.StatusUnprocessableEntity, errCodeInvalidConfig, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+	})
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// reloadTestSetup configures the server like the Docker image: only by environment, without config file.
+// The returned function restores the previous state
+func reloadTestSetup(t *testing.T, env map[string]string) (dir string, restore func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFile, oldExplicit := configFile, configFileExplicit
+	oldConf, oldKeys := *configuration(), currentJWTKeys()
+	configFile, configFileExplicit = filepath.Join(dir, "config.conf"), false
+
+	env["UM_LDAP_ADMIN"] = "cn=admin,dc=example,dc=com"
+	env["UM_LDAP_PASS"] = "secret"
+	env["UM_LDAP_BASE_DN"] = "dc=example,dc=com"
+	env["UM_LDAP_ADMINFILTER"] = "(cn=admin)"
+	env["UM_JWT_PRIV"] = filepath.Join(dir, "jwt.key")
+	env["UM_JWT_PUB"] = filepath.Join(dir, "jwt.pub")
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	writeTestKeyPair(t, dir)
+
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadJWTKeys(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setConfiguration(conf)
+	configState.keys.Store(keys)
+
+	return dir, func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+		os.RemoveAll(dir)
+		configFile, configFileExplicit = oldFile, oldExplicit
+		setConfiguration(oldConf)
+		if oldKeys != nil {
+			configState.keys.Store(oldKeys)
+		}
+		setupLogging(ServerConfig{LogLevel: "info", LogFormat: "logfmt"})
+	}
+}
+
+// writeTestCertificate writes a new self-signed TLS certificate and its key to dir
+func writeTestCertificate(t *testing.T, dir string) {
+	t.Helper()
+	key, err := generateKey("ecdsa", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := certificateTemplate([]string{"localhost"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeKeyPair(key, filepath.Join(dir, "tls.key"), "", true); err != nil {
+		t.Fatal(err)
+	}
+	if err = writePEM(filepath.Join(dir, "tls.crt"), "CERTIFICATE", der, 0644, true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestKeyPair writes a new Ed25519 JWT key pair to dir
+func writeTestKeyPair(t *testing.T, dir string) {
+	t.Helper()
+	key, err := generateKey("ed25519", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = writeKeyPair(key, filepath.Join(dir, "jwt.key"), filepath.Join(dir, "jwt.pub"), true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadWithoutConfigFile(t *testing.T) {
+	dir, restore := reloadTestSetup(t, map[string]string{"UM_LOG_LEVEL": "info"})
+	defer restore()
+
+	os.Setenv("UM_LOG_LEVEL", "warn")
+	writeTestKeyPair(t, dir)
+	result, err := reloadConfiguration()
+	if err != nil {
+		t.Fatalf("reload without config file: %v", err)
+	}
+	if got := configuration().LogLevel; got != "warn" {
+		t.Errorf("LogLevel is %q after reload, want warn", got)
+	}
+	changed := map[string]bool{}
+	for _, name := range result.Changed {
+		changed[name] = true
+	}
+	if !changed["LogLevel"] || !changed["JWT keys"] || len(result.Changed) != 2 {
+		t.Errorf("changed %v, want LogLevel and JWT keys", result.Changed)
+	}
+
+	// a config file given with --config must exist, on reload as at startup
+	configFileExplicit = true
+	if _, err := reloadConfiguration(); err == nil {
+		t.Error("reload with a missing --config file succeeded")
+	}
+	if got := configuration().LogLevel; got != "warn" {
+		t.Errorf("rejected reload changed LogLevel to %q", got)
+	}
+}
+
+func TestReloadKeysAndCertificate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(t *testing.T, dir string)
+		changed []string // empty if the reload is rejected
+	}{
+		{"unchanged", func(*testing.T, string) {}, []string{}},
+		{"new JWT keys", writeTestKeyPair, []string{"JWT keys"}},
+		{"new certificate", writeTestCertificate, []string{"TLS certificate"}},
+		{"both", func(t *testing.T, dir string) {
+			writeTestKeyPair(t, dir)
+			writeTestCertificate(t, dir)
+		}, []string{"JWT keys", "TLS certificate"}},
+		{"mismatched JWT keys", func(t *testing.T, dir string) {
+			other := filepath.Join(dir, "other")
+			writeTestKeyPair(t, other)
+			if err := os.Rename(filepath.Join(other, "jwt.pub"), filepath.Join(dir, "jwt.pub")); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		{"invalid certificate", func(t *testing.T, dir string) {
+			if err := ioutil.WriteFile(filepath.Join(dir, "tls.crt"), []byte("not a certificate"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, nil},
+		{"TLS disabled", func(*testing.T, string) {
+			os.Unsetenv("UM_TLS_CERT")
+			os.Unsetenv("UM_TLS_KEY")
+		}, nil},
+	}
+	oldCert := certificate.Load()
+	defer func() {
+		if oldCert != nil {
+			certificate.Store(oldCert)
+		}
+	}()
+	for _, test := range tests {
+		func() {
+			env := map[string]string{}
+			dir, restore := reloadTestSetup(t, env)
+			defer restore()
+			// TLS settings come after the setup, which creates dir; listed in env, restore unsets them
+			os.Setenv("UM_TLS_CERT", filepath.Join(dir, "tls.crt"))
+			os.Setenv("UM_TLS_KEY", filepath.Join(dir, "tls.key"))
+			env["UM_TLS_CERT"], env["UM_TLS_KEY"] = "", ""
+			writeTestCertificate(t, dir)
+			conf, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := loadCertificate(conf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			setConfiguration(conf)
+			certificate.Store(cert)
+			keys := currentJWTKeys()
+
+			test.change(t, dir)
+			result, err := reloadConfiguration()
+			served, _ := getCertificate(nil)
+			if test.changed == nil {
+				if err == nil {
+					t.Errorf("%s: reload succeeded", test.name)
+				}
+				if currentJWTKeys() != keys || served != cert {
+					t.Errorf("%s: rejected reload swapped the keys or the certificate", test.name)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				return
+			}
+			changed := map[string]bool{}
+			for _, name := range result.Changed {
+				changed[name] = true
+			}
+			for _, name := range test.changed {
+				if !changed[name] {
+					t.Errorf("%s: changed %v, want %v", test.name, result.Changed, test.changed)
+				}
+			}
+			if len(result.Changed) != len(test.changed) || len(result.RestartRequired) != 0 {
+				t.Errorf("%s: changed %v, restart required for %v", test.name, result.Changed, result.RestartRequired)
+			}
+			if newKeys := currentJWTKeys(); newKeys.equal(keys) == changed["JWT keys"] {
+				t.Errorf("%s: JWT keys swapped %v", test.name, !newKeys.equal(keys))
+			}
+			if swapped := !bytes.Equal(served.Certificate[0], cert.Certificate[0]); swapped != changed["TLS certificate"] {
+				t.Errorf("%s: certificate swapped %v", test.name, swapped)
+			}
+		}()
+	}
+}
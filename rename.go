@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/ldap.v2"
+)
+
+// apiRename is the body of rename and move requests. Either field may be omitted
+type apiRename struct {
+	Name   string `json:"name"`   // new cn
+	Parent string `json:"parent"` // DN of the new parent entry, e.g. an OU below LDAPBaseDN
+}
+
+// dnReference is an attribute of a group that contains the DN of another entry
+type dnReference struct {
+	group     string
+	attribute string
+}
+
+// LDAPRenameEntry renames the entry dn to cn=newName and/or moves it below newParent, and
+// rewrites all uniqueMember and owner references to it. Empty arguments keep the current value.
+// If a step fails, the steps done so far are undone. Returns the new DN
+func LDAPRenameEntry(ctx context.Context, dn, newName, newParent string) (string, []StepResult, error) {
+	rdn, parent := splitDN(dn)
+	attr, name := splitRDN(rdn)
+	if newName == "" {
+		newName = name
+	}
+	superior, oldSuperior := "", ""
+	if newParent != "" && normalizeDN(newParent) != normalizeDN(parent) {
+		superior, oldSuperior = newParent, parent
+		parent = newParent
+	}
+	newRDN := attr + "=" + newName
+	newDN := newRDN + "," + parent
+
+	references, err := findDNReferences(ctx, dn)
+	if err != nil {
+		return "", nil, err
+	}
+	op := newOperation("rename")
+	op.step("rename "+dn+" to "+newDN,
+		func() error { return LDAPModifyDN(ctx, dn, newRDN, true, superior) },
+		func() error { return LDAPModifyDN(ctx, newDN, rdn, true, oldSuperior) })
+	for _, ref := range references {
+		ref := ref
+		op.step("update "+ref.attribute+" of "+ref.group,
+			func() error { return replaceDNReference(ctx, ref, dn, newDN) },
+			func() error { return replaceDNReference(ctx, ref, newDN, dn) })
+	}
+	steps, err := op.run()
+	if err != nil {
+		return "", steps, err
+	}
+	return newDN, steps, nil
+}
+
+// findDNReferences returns the group attributes that contain dn
+func findDNReferences(ctx context.Context, dn string) ([]dnReference, error) {
+	escaped := ldap.EscapeFilter(dn)
+	result, err := pLDAPSearch(ctx, []string{"uniqueMember", "owner"}, "(|(uniqueMember="+escaped+")(owner="+escaped+"))")
+	if err != nil {
+		return nil, err
+	}
+	var references []dnReference
+	for _, entry := range result {
+		for _, attribute := range []string{"uniqueMember", "owner"} {
+			for _, value := range entry.GetAttributeValues(attribute) {
+				if normalizeDN(value) == normalizeDN(dn) {
+					references = append(references, dnReference{entry.DN, attribute})
+					break
+				}
+			}
+		}
+	}
+	return references, nil
+}
+
+// replaceDNReference replaces the value from by to in the referencing attribute. An empty from only
+// adds to, an empty to only removes from. References that were already rewritten, e.g. by the refint
+// overlay, are left alone
+func replaceDNReference(ctx context.Context, ref dnReference, from, to string) error {
+	l, err := pLDAPConnectAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	mr := ldap.NewModifyRequest(ref.group)
+	if from != "" {
+		mr.Delete(ref.attribute, []string{from})
+	}
+	if to != "" {
+		mr.Add(ref.attribute, []string{to})
+	}
+	err = l.Modify(mr)
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) || ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) {
+		return nil
+	}
+	return err
+}
+
+// removeDNReference removes dn from the referencing attribute. groupOfUniqueNames needs at least one
+// member, so the last member is replaced by the placeholder member, as on group creation
+func removeDNReference(ctx context.Context, ref dnReference, dn string) error {
+	err := replaceDNReference(ctx, ref, dn, "")
+	if ref.attribute == "uniqueMember" && ldap.IsErrorWithCode(err, ldap.LDAPResultObjectClassViolation) {
+		return replaceDNReference(ctx, ref, dn, configuration().LDAPAdmin)
+	}
+	return err
+}
+
+// renameInRequests keeps the membership requests of a renamed group or user, which refer to it by name
+func renameInRequests(group bool, previous, name string) {
+	if membershipRequests == nil {
+		return
+	}
+	if err := membershipRequests.rename(group, previous, name); err != nil {
+		logError("could not update membership requests after rename", "previous", previous, "name", name, "error", err)
+	}
+}
+
+// validRenameTarget checks the new name and parent of a rename request
+func validRenameTarget(body apiRename) error {
+	if body.Name == "" && body.Parent == "" {
+		return fmt.Errorf("name or parent is required")
+	}
+	if body.Name != "" && !usernamePattern.MatchString(body.Name) {
+		return fmt.Errorf("invalid name %q", body.Name)
+	}
+	if body.Parent != "" && normalizeDN(body.Parent) != normalizeDN(configuration().LDAPBaseDN) {
+		return validateLDIFDN(body.Parent)
+	}
+	return nil
+}
+
+// V2UsersRename renames and/or moves a user, keeping its group memberships
+func V2UsersRename() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := v2FindUser(w, r)
+		if !ok {
+			return
+		}
+		var body apiRename
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		if err := validRenameTarget(body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		if isProtectedUser(user.Username) || isProtectedUser(body.Name) {
+			writeAPIError(w, http.StatusForbidden, errCodeProtected, "User is protected by divine spirits.")
+			return
+		}
+
+		newDN, steps, err := LDAPRenameEntry(r.Context(), user.DN, body.Name, body.Parent)
+		auditLog(requestActor(r), "user.rename", user.DN, err)
+		if err != nil {
+			writeOperationError(w, err, steps)
+			return
+		}
+		renamed, err := LDAPGetUser(r.Context(), rdnValue(newDN))
+		if err != nil || renamed == nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if renamed.Username != user.Username {
+			emitEvent(EventUserRenamed, map[string]string{"username": renamed.Username, "previous": user.Username})
+			renameInRequests(false, user.Username, renamed.Username)
+		}
+		w.Header().Set("Location", prefixed("/api/v2/users/"+renamed.Username))
+		writeJSON(w, http.StatusOK, toAPIUser(*renamed))
+	})
+}
+
+// V2GroupsRename renames and/or moves a group, keeping its memberships in other groups and its ownerships
+func V2GroupsRename() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindGroup(w, r)
+		if !ok {
+			return
+		}
+		var body apiRename
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		if err := validRenameTarget(body); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidValue, err.Error())
+			return
+		}
+		if isProtectedGroup(group.Name) || isProtectedGroup(body.Name) {
+			writeAPIError(w, http.StatusForbidden, errCodeProtected, "admin group cannot be renamed")
+			return
+		}
+
+		newDN, steps, err := LDAPRenameEntry(r.Context(), group.DN, body.Name, body.Parent)
+		auditLog(requestActor(r), "group.rename", group.DN, err)
+		if err != nil {
+			writeOperationError(w, err, steps)
+			return
+		}
+		renamed, err := LDAPGetGroup(r.Context(), rdnValue(newDN))
+		if err != nil || renamed == nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if !strings.EqualFold(renamed.Name, group.Name) {
+			emitEvent(EventGroupRenamed, map[string]string{"groupname": renamed.Name, "previous": group.Name})
+		}
+		if renamed.Name != group.Name {
+			renameInRequests(true, group.Name, renamed.Name)
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		w.Header().Set("Location", prefixed("/api/v2/groups/"+renamed.Name))
+		writeJSON(w, http.StatusOK, toAPIGroup(*renamed, graph))
+	})
+}
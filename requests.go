@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"gopkg.in/ldap.v2"
+)
+
+// Membership requests: a user asks to join a group, and an owner of the group (or an admin)
+// approves or rejects the request. Requests are kept in MembershipRequestFile.
+
+// membership request states
+const (
+	requestPending  = "pending"
+	requestApproved = "approved"
+	requestRejected = "rejected"
+)
+
+// error codes of the membership request endpoints
+const (
+	errCodeRequestNotFound = "request_not_found"
+	errCodeRequestExists   = "request_exists"
+	errCodeRequestDecided  = "request_decided"
+	errCodeAlreadyMember   = "already_member"
+)
+
+var (
+	errRequestExists   = errors.New("a pending request for this group exists already")
+	errRequestDecided  = errors.New("the request was decided already")
+	errRequestDeciding = errors.New("the request is being decided")
+)
+
+// MembershipRequest is the request of a user to join a group
+type MembershipRequest struct {
+	ID        string     `json:"id"`
+	Group     string     `json:"group"`
+	Username  string     `json:"username"`
+	Comment   string     `json:"comment,omitempty"`
+	Status    string     `json:"status"`
+	Created   time.Time  `json:"created"`
+	Decided   *time.Time `json:"decided,omitempty"`
+	DecidedBy string     `json:"decidedBy,omitempty"`
+}
+
+// requestStore keeps membership requests and persists them to a JSON file
+type requestStore struct {
+	mu       sync.Mutex
+	path     string
+	deciding map[string]bool      // ids of the requests being applied
+	Requests []*MembershipRequest `json:"requests"`
+}
+
+var membershipRequests *requestStore
+
+// newRequestStore loads the requests stored in path
+func newRequestStore(path string) (*requestStore, error) {
+	s := &requestStore{path: path, deciding: map[string]bool{}}
+	file, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(file, s); err != nil {
+		return nil, fmt.Errorf("could not parse membership requests %s: %v", path, err)
+	}
+	return s, nil
+}
+
+func (s *requestStore) save() error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// create adds a pending request. Only one pending request per user and group is allowed
+func (s *requestStore) create(group, username, comment string) (MembershipRequest, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, request := range s.Requests {
+		if request.Group == group && request.Username == username && request.Status == requestPending {
+			return MembershipRequest{}, errRequestExists
+		}
+	}
+	request := &MembershipRequest{
+		ID:       randomID(),
+		Group:    group,
+		Username: username,
+		Comment:  comment,
+		Status:   requestPending,
+		Created:  time.Now().UTC(),
+	}
+	s.Requests = append(s.Requests, request)
+	if err := s.save(); err != nil {
+		s.Requests = s.Requests[:len(s.Requests)-1]
+		return MembershipRequest{}, err
+	}
+	return *request, nil
+}
+
+// list returns copies of the requests matching keep, newest first
+func (s *requestStore) list(keep func(MembershipRequest) bool) []MembershipRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := []MembershipRequest{}
+	for i := len(s.Requests) - 1; i >= 0; i-- {
+		if keep(*s.Requests[i]) {
+			result = append(result, *s.Requests[i])
+		}
+	}
+	return result
+}
+
+// get returns a copy of the request with the given id
+func (s *requestStore) get(id string) (MembershipRequest, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, request := range s.Requests {
+		if request.ID == id {
+			return *request, true
+		}
+	}
+	return MembershipRequest{}, false
+}
+
+// decide approves or rejects a pending request. For approvals, apply is called first, without
+// holding the store lock, and the request stays pending if it fails. A request is decided only once,
+// concurrent decisions on the same request fail with errRequestDeciding
+func (s *requestStore) decide(id string, approve bool, actor string, apply func(MembershipRequest) error) (MembershipRequest, error) {
+	s.mu.Lock()
+	var request *MembershipRequest
+	for _, r := range s.Requests {
+		if r.ID == id {
+			request = r
+		}
+	}
+	if request == nil {
+		s.mu.Unlock()
+		return MembershipRequest{}, errors.New("request not found")
+	}
+	if request.Status != requestPending {
+		defer s.mu.Unlock()
+		return *request, errRequestDecided
+	}
+	if s.deciding[id] {
+		defer s.mu.Unlock()
+		return *request, errRequestDeciding
+	}
+	s.deciding[id] = true
+	pending := *request
+	s.mu.Unlock()
+
+	var err error
+	if approve {
+		err = apply(pending)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.deciding, id)
+	if err != nil {
+		return *request, err
+	}
+
+	now := time.Now().UTC()
+	request.Decided, request.DecidedBy = &now, actor
+	request.Status = requestRejected
+	if approve {
+		request.Status = requestApproved
+	}
+	return *request, s.save()
+}
+
+// rename replaces the name of a renamed group or user in all requests
+func (s *requestStore) rename(group bool, previous, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, request := range s.Requests {
+		field := &request.Username
+		if group {
+			field = &request.Group
+		}
+		if strings.EqualFold(*field, previous) {
+			*field = name
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return s.save()
+}
+
+// requestCaller returns the user that authenticated the request and whether it has an admin token
+func requestCaller(r *http.Request) (string, bool) {
+	token, err := parseToken(r)
+	if err != nil {
+		return "", false
+	}
+	return requestActor(r), tokenRole(token) == roleAdmin
+}
+
+// V2RequestsCreate lets the calling user ask to join a group
+func V2RequestsCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := requestCaller(r)
+		var body struct {
+			Comment string `json:"comment"`
+		}
+		// the body is optional
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+			writeAPIError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		user, err := LDAPGetUser(r.Context(), username)
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if user == nil {
+			writeAPIError(w, http.StatusForbidden, errCodeUserNotFound, "Only directory users can request memberships")
+			return
+		}
+		group, graph, ok := v2FindVisibleGroup(w, r, user.DN, false)
+		if !ok {
+			return
+		}
+		if graph.contains(group.DN, user.DN) {
+			writeAPIError(w, http.StatusConflict, errCodeAlreadyMember, "You are a member of "+group.Name+" already")
+			return
+		}
+
+		request, err := membershipRequests.create(group.Name, user.Username, body.Comment)
+		if err == errRequestExists {
+			writeAPIError(w, http.StatusConflict, errCodeRequestExists, err.Error())
+			return
+		} else if err != nil {
+			writeAPIError(w, http.StatusInternalServerError, errCodeLDAP, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, request)
+	})
+}
+
+// V2RequestsList lists the requests of a group for its owners and admins. Supports ?status=
+func V2RequestsList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindOwnedGroup(w, r)
+		if !ok {
+			return
+		}
+		status := r.URL.Query().Get("status")
+		writeJSON(w, http.StatusOK, membershipRequests.list(func(request MembershipRequest) bool {
+			return strings.EqualFold(request.Group, group.Name) && (status == "" || request.Status == status)
+		}))
+	})
+}
+
+// V2RequestsDecide approves or rejects a request. Only owners of the group and admins may decide
+func V2RequestsDecide(approve bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := v2FindOwnedGroup(w, r)
+		if !ok {
+			return
+		}
+		id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+		if request, ok := membershipRequests.get(id); !ok || !strings.EqualFold(request.Group, group.Name) {
+			writeAPIError(w, http.StatusNotFound, errCodeRequestNotFound, "Request "+id+" does not exist")
+			return
+		}
+
+		actor := requestActor(r)
+		request, err := membershipRequests.decide(id, approve, actor, func(request MembershipRequest) error {
+			err := LDAPAddUserToGroup(r.Context(), request.Username, request.Group)
+			if ldap.IsErrorWithCode(err, ldap.LDAPResultAttributeOrValueExists) {
+				// joined in the meantime
+				return nil
+			}
+			auditLog(actor, "request.approve", group.DN, err)
+			if err == nil {
+				emitEvent(EventGroupMemberAdded, map[string]string{"username": request.Username, "groupname": request.Group})
+			}
+			return err
+		})
+		if err == errRequestDecided {
+			writeAPIError(w, http.StatusConflict, errCodeRequestDecided, "Request "+id+" is "+request.Status+" already")
+			return
+		} else if err == errRequestDeciding {
+			writeAPIError(w, http.StatusConflict, errCodeRequestDecided, "Request "+id+" is being decided")
+			return
+		} else if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		if !approve {
+			auditLog(actor, "request.reject", group.DN, nil)
+		}
+		writeJSON(w, http.StatusOK, request)
+	})
+}
+
+// V2MyRequests lists the requests of the calling user
+func V2MyRequests() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := requestCaller(r)
+		writeJSON(w, http.StatusOK, membershipRequests.list(func(request MembershipRequest) bool {
+			return request.Username == username
+		}))
+	})
+}
+
+// V2AllRequests lists the requests of all groups for admins. Supports ?status=
+func V2AllRequests() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		writeJSON(w, http.StatusOK, membershipRequests.list(func(request MembershipRequest) bool {
+			return status == "" || request.Status == status
+		}))
+	})
+}
+
+// apiMyGroup is a group as shown to regular users
+type apiMyGroup struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Mail        string `json:"mail"`
+	Visibility  string `json:"visibility"`
+	Member      bool   `json:"member"`
+	Owner       bool   `json:"owner"`
+}
+
+// V2MyGroups lists the groups visible to the calling user
+func V2MyGroups() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username, _ := requestCaller(r)
+		user, err := LDAPGetUser(r.Context(), username)
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		dn := ""
+		if user != nil {
+			dn = user.DN
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			writeLDAPError(w, err)
+			return
+		}
+		result := []apiMyGroup{}
+		for _, group := range graph.groups {
+			if !isGroupVisible(graph, group, dn) {
+				continue
+			}
+			result = append(result, apiMyGroup{
+				Name:        group.Name,
+				Description: group.Description,
+				Mail:        group.Mail,
+				Visibility:  group.Visibility,
+				Member:      graph.contains(group.DN, dn),
+				Owner:       isGroupOwner(graph, group, dn),
+			})
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+		writeJSON(w, http.StatusOK, result)
+	})
+}
+
+// v2FindVisibleGroup looks up the group of the request. Private groups are reported as missing to users who may not see them
+func v2FindVisibleGroup(w http.ResponseWriter, r *http.Request, dn string, admin bool) (*GroupEntry, *groupGraph, bool) {
+	name := httprouter.ParamsFromContext(r.Context()).ByName("name")
+	graph, err := loadGroupGraph(r.Context())
+	if err != nil {
+		writeLDAPError(w, err)
+		return nil, nil, false
+	}
+	group := graph.group(name)
+	if group == nil || (!admin && !isGroupVisible(graph, group, dn)) {
+		writeAPIError(w, http.StatusNotFound, errCodeGroupNotFound, "Group "+name+" does not exist")
+		return nil, nil, false
+	}
+	return group, graph, true
+}
+
+// v2FindOwnedGroup looks up the group of the request and checks that the caller is an owner or admin
+func v2FindOwnedGroup(w http.ResponseWriter, r *http.Request) (*GroupEntry, bool) {
+	username, admin := requestCaller(r)
+	dn := ""
+	if !admin {
+		user, err := LDAPGetUser(r.Context(), username)
+		if err != nil {
+			writeLDAPError(w, err)
+			return nil, false
+		}
+		if user != nil {
+			dn = user.DN
+		}
+	}
+	group, graph, ok := v2FindVisibleGroup(w, r, dn, admin)
+	if !ok {
+		return nil, false
+	}
+	if !admin && !isGroupOwner(graph, group, dn) {
+		writeAPIError(w, http.StatusForbidden, errCodeForbidden, "Only owners of "+group.Name+" can manage its requests")
+		return nil, false
+	}
+	return group, true
+}
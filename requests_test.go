@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func requestTestStore(t *testing.T) (*requestStore, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newRequestStore(filepath.Join(dir, "requests.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func TestRequestDecide(t *testing.T) {
+	applyErr := errors.New("ldap down")
+	tests := []struct {
+		name       string
+		approve    bool
+		applyErr   error
+		wantErr    error
+		wantStatus string
+		wantApply  bool
+	}{
+		{"approve", true, nil, nil, requestApproved, true},
+		{"reject", false, nil, nil, requestRejected, false},
+		{"failed approval stays pending", true, applyErr, applyErr, requestPending, true},
+	}
+	for _, test := range tests {
+		s, cleanup := requestTestStore(t)
+		created, err := s.create("hobbits", "bilbo", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		applied := false
+		request, err := s.decide(created.ID, test.approve, "frodo", func(request MembershipRequest) error {
+			applied = true
+			// the store is not locked while the change is applied
+			s.list(func(MembershipRequest) bool { return true })
+			if _, err := s.decide(request.ID, true, "sam", nil); err != errRequestDeciding {
+				t.Errorf("%s: concurrent decision: %v", test.name, err)
+			}
+			return test.applyErr
+		})
+		if err != test.wantErr || request.Status != test.wantStatus || applied != test.wantApply {
+			t.Errorf("%s: got %s, %v, applied %v", test.name, request.Status, err, applied)
+		}
+		if test.wantStatus != requestPending {
+			if _, err := s.decide(created.ID, true, "sam", nil); err != errRequestDecided {
+				t.Errorf("%s: deciding twice: %v", test.name, err)
+			}
+		}
+		restored, err := newRequestStore(s.path)
+		if err != nil || len(restored.Requests) != 1 || restored.Requests[0].Status != test.wantStatus {
+			t.Errorf("%s: not persisted: %v", test.name, err)
+		}
+		cleanup()
+	}
+}
+
+func TestRequestRename(t *testing.T) {
+	s, cleanup := requestTestStore(t)
+	defer cleanup()
+	s.create("hobbits", "bilbo", "")
+	s.create("Hobbits", "frodo", "")
+	s.create("wizards", "bilbo", "")
+
+	if err := s.rename(true, "hobbits", "halflings"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.rename(false, "bilbo", "Bilbo"); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := newRequestStore(s.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][2]string{{"halflings", "Bilbo"}, {"halflings", "frodo"}, {"wizards", "Bilbo"}}
+	for i, request := range restored.Requests {
+		if request.Group != want[i][0] || request.Username != want[i][1] {
+			t.Errorf("request %d: %s of %s, want %s of %s", i, request.Username, request.Group, want[i][1], want[i][0])
+		}
+	}
+}
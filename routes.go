@@ -2,6 +2,7 @@ package main
 
 import (
 	"embed"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"strings"
@@ -35,9 +36,16 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
+	if !checkLockout(w, r, user.Username, roleAdmin) {
+		return
+	}
 
 	// LDAP Authentication
-	authenticated, err := LDAPAuthenticateAdmin(user)
+	authenticated, err := LDAPAuthenticateAdmin(r.Context(), user)
+	countLogin(roleAdmin, authenticated, err)
+	if err == nil {
+		recordLogin(r, user.Username, authenticated)
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintln(w, "Error while signing the token")
@@ -48,15 +56,55 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Invalid Credentials"))
 		return
 	}
+	writeToken(w, user.Username, roleAdmin)
+}
+
+// UserLogin issues tokens to regular directory users, for the self service endpoints
+func UserLogin(w http.ResponseWriter, r *http.Request) {
+	user, err := parseUser(r, userWithNamePassword)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !checkLockout(w, r, user.Username, roleUser) {
+		return
+	}
+	authenticated, err := LDAPAuthenticateUser(r.Context(), user)
+	countLogin(roleUser, authenticated, err)
+	if err == nil {
+		recordLogin(r, user.Username, authenticated)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Error occurred: " + err.Error()))
+		return
+	}
+	if !authenticated {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Invalid Credentials"))
+		return
+	}
+	writeToken(w, user.Username, roleUser)
+}
+
+// token roles. Admin tokens grant access to the whole API, user tokens only to the self service endpoints
+const (
+	roleAdmin = "admin"
+	roleUser  = "user"
+)
 
-	token := jwt.New(jwt.SigningMethodRS256)
+func writeToken(w http.ResponseWriter, username, role string) {
+	keys := currentJWTKeys()
+	token := jwt.New(keys.method)
 	claims := make(jwt.MapClaims)
 
 	claims["exp"] = time.Now().Add(time.Minute * time.Duration(10)).Unix()
 	claims["iat"] = time.Now().Unix()
+	claims["sub"] = username
+	claims["role"] = role
 	token.Claims = claims
 
-	tokenString, err := token.SignedString(signKey)
+	tokenString, err := token.SignedString(keys.sign)
 
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -72,18 +120,14 @@ func Login(w http.ResponseWriter, r *http.Request) {
 // ValidateTokenMiddleware validates the request token. Code from http://www.giantflyingsaucer.com/blog/?p=5994
 func ValidateTokenMiddleware(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		token, err := request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
-			func(token *jwt.Token) (interface{}, error) {
-				// Don't forget to validate the alg is what you expect:
-				if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-					return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-				}
-				return verifyKey, nil
-			})
-
+		token, err := parseToken(r)
 		if err == nil {
-			if token.Valid {
+			if token.Valid && tokenRole(token) == roleAdmin {
 				handler.ServeHTTP(w, r)
+			} else if token.Valid {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprint(w, "Access to this resource requires an admin token")
+				return
 			} else {
 				w.WriteHeader(http.StatusUnauthorized)
 				fmt.Fprint(w, "Token is not valid")
@@ -97,10 +141,77 @@ func ValidateTokenMiddleware(handler http.Handler) http.Handler {
 	})
 }
 
-// UsersList returns a List of all LDAP Users
+// requestActor returns the name of the admin that authenticated the request, for audit logging
+func requestActor(r *http.Request) string {
+	token, err := parseToken(r)
+	if err != nil {
+		return "unknown"
+	}
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if sub, ok := claims["sub"].(string); ok && sub != "" {
+			return sub
+		}
+	}
+	return "unknown"
+}
+
+// tokenRole returns the role claim of token. Tokens issued before roles were introduced are admin tokens
+func tokenRole(token *jwt.Token) string {
+	if claims, ok := token.Claims.(jwt.MapClaims); ok {
+		if role, ok := claims["role"].(string); ok {
+			return role
+		}
+	}
+	return roleAdmin
+}
+
+// parseToken parses and verifies the bearer token of a request
+func parseToken(r *http.Request) (*jwt.Token, error) {
+	return request.ParseFromRequest(r, request.AuthorizationHeaderExtractor,
+		func(token *jwt.Token) (interface{}, error) {
+			// Don't forget to validate the alg is what you expect:
+			keys := currentJWTKeys()
+			if token.Method.Alg() != keys.method.Alg() {
+				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+			}
+			return keys.verify, nil
+		})
+}
+
+// UsersList returns a List of all LDAP Users. Supports the search and pagination parameters of listQuery
 func UsersList() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		users, err := LDAPViewUsers()
+		if hasListParams(r) {
+			q, err := parseListQuery(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Error parsing query: " + err.Error()))
+				return
+			}
+			users, total, next, err := LDAPSearchUsers(r.Context(), q)
+			if isListQueryError(err) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Error parsing query: " + err.Error()))
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Error occurred: " + err.Error()))
+				return
+			}
+			result := make([]map[string]string, len(users))
+			for i, user := range users {
+				result[i] = map[string]string{
+					"name":   stripBaseDN(user.DN),
+					"groups": stripBaseDN(strings.Join(user.Groups, ";")),
+				}
+			}
+			writeListHeaders(w, total, next)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
+		users, err := LDAPViewUsers(r.Context())
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error occurred: " + err.Error()))
@@ -123,7 +234,7 @@ func UsersAdd() http.Handler {
 		}
 
 		// Check if already Registered
-		existing, err := pLDAPSearch(
+		existing, err := pLDAPSearch(r.Context(),
 			[]string{"dn"},
 			fmt.Sprintf("(&(objectClass=organizationalPerson)(cn=%s))", user.Username),
 		)
@@ -134,12 +245,13 @@ func UsersAdd() http.Handler {
 			return
 		}
 		// Add user to LDAP
-		err = LDAPAddUser("cn="+user.Username+","+configuration.LDAPBaseDN, user)
+		steps, err := addUserOperation(r.Context(), "cn="+user.Username+","+configuration().LDAPBaseDN, user).run()
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Error adding user: " + err.Error()))
+			w.Write([]byte("Error adding user: " + err.Error() + "\n" + formatSteps(steps)))
 			return
 		}
+		emitEvent(EventUserCreated, map[string]string{"username": user.Username, "groupname": user.Fs})
 		w.WriteHeader(http.StatusOK)
 	})
 }
@@ -154,26 +266,27 @@ func UsersRemove() http.Handler {
 			return
 		}
 
-		if user.Username == "admin" {
+		if isProtectedUser(user.Username) {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error deleting user: User is protected by divine spirits."))
 			return
 		}
 
 		// Validate User
-		sr, err := pLDAPSearch([]string{"dn"}, fmt.Sprintf(configuration.LDAPUserfilter, user.Username))
+		sr, err := pLDAPSearch(r.Context(), []string{"dn"}, fmt.Sprintf(configuration().LDAPUserfilter, user.Username))
 		if err != nil || len(sr) != 1 {
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("Error deleting user: User does not exist."))
 			return
 		}
 
-		err = LDAPDeleteDN(sr[0].DN)
+		steps, err := LDAPDeleteUser(r.Context(), sr[0].DN)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte("Error deleting user: " + err.Error()))
+			w.Write([]byte("Error deleting user: " + err.Error() + "\n" + formatSteps(steps)))
 			return
 		}
+		emitEvent(EventUserDeleted, map[string]string{"username": user.Username})
 		w.WriteHeader(http.StatusOK)
 	})
 }
@@ -187,17 +300,18 @@ func RemoveUserFromGroup() http.Handler {
 			w.Write([]byte("Error parsing Request Body: " + err.Error()))
 			return
 		}
-		if user.Username == "admin" {
+		if isProtectedUser(user.Username) {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error removing user: User is protected by divine spirits."))
 			return
 		}
-		err = LDAPRemoveUserFromGroup(user.Username, user.Group)
+		err = LDAPRemoveUserFromGroup(r.Context(), user.Username, user.Group)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error Removing User from Group: " + err.Error()))
 			return
 		}
+		emitEvent(EventGroupMemberRemoved, map[string]string{"username": user.Username, "groupname": user.Group})
 		w.WriteHeader(http.StatusOK)
 	})
 }
@@ -211,17 +325,18 @@ func AddUserToGroup() http.Handler {
 			w.Write([]byte("Error parsing Request Body: " + err.Error()))
 			return
 		}
-		if user.Username == "admin" {
+		if isProtectedUser(user.Username) {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error adding user: User is protected by divine spirits."))
 			return
 		}
-		err = LDAPAddUserToGroup(user.Username, user.Group)
+		err = LDAPAddUserToGroup(r.Context(), user.Username, user.Group)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error Adding User from Group: " + err.Error()))
 			return
 		}
+		emitEvent(EventGroupMemberAdded, map[string]string{"username": user.Username, "groupname": user.Group})
 		w.WriteHeader(http.StatusOK)
 	})
 }
@@ -236,14 +351,14 @@ func UsersChangePassword() http.Handler {
 			return
 		}
 
-		if user.Username == "admin" {
+		if isProtectedUser(user.Username) {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error changing password: User is protected by divine spirits."))
 			return
 		}
 
 		// Check if already Registered
-		existing, err := pLDAPSearch(
+		existing, err := pLDAPSearch(r.Context(),
 			[]string{"dn"},
 			fmt.Sprintf("(&(objectClass=organizationalPerson)(cn=%s))", user.Username),
 		)
@@ -254,20 +369,51 @@ func UsersChangePassword() http.Handler {
 			return
 		}
 
-		err = LDAPChangeUserPassword(user.Username, user.Password)
+		err = LDAPChangeUserPassword(r.Context(), user.Username, user.Password)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error changing password: " + err.Error()))
 			return
 		}
+		emitEvent(EventUserPasswordChanged, map[string]string{"username": user.Username})
 		w.WriteHeader(http.StatusOK)
 	})
 }
 
-// GroupsList lists all LDAP users
+// GroupsList lists all LDAP groups. Supports the search and pagination parameters of listQuery
 func GroupsList() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		groups, err := LDAPViewGroups()
+		if hasListParams(r) {
+			q, err := parseListQuery(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Error parsing query: " + err.Error()))
+				return
+			}
+			groups, total, next, err := LDAPSearchGroups(r.Context(), q)
+			if isListQueryError(err) {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte("Error parsing query: " + err.Error()))
+				return
+			} else if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte("Error occurred: " + err.Error()))
+				return
+			}
+			result := make([]map[string]string, len(groups))
+			for i, group := range groups {
+				result[i] = map[string]string{
+					"name":    stripBaseDN(group.DN),
+					"members": stripBaseDN(strings.Join(withoutPlaceholder(group.Members), ";")),
+				}
+			}
+			writeListHeaders(w, total, next)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(result)
+			return
+		}
+
+		groups, err := LDAPViewGroups(r.Context())
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error occurred: " + err.Error()))
@@ -290,7 +436,7 @@ func GroupsAdd() http.Handler {
 		}
 
 		// Check if already Registered
-		existing, err := pLDAPSearch(
+		existing, err := pLDAPSearch(r.Context(),
 			[]string{"dn"},
 			fmt.Sprintf("(&(objectClass=groupOfUniqueNames)(cn=%s))", group),
 		)
@@ -301,12 +447,13 @@ func GroupsAdd() http.Handler {
 			return
 		}
 		// Add user to LDAP
-		err = LDAPAddGroup("cn=" + group + "," + configuration.LDAPBaseDN)
+		err = LDAPAddGroup(r.Context(), "cn="+group+","+configuration().LDAPBaseDN)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error adding Group: " + err.Error()))
 			return
 		}
+		emitEvent(EventGroupCreated, map[string]string{"groupname": group})
 		w.WriteHeader(http.StatusOK)
 	})
 
@@ -322,17 +469,46 @@ func GroupsRemove() http.Handler {
 			return
 		}
 
-		if group == "admins" {
+		if isProtectedGroup(group) {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error deleting Group: admin group cannot be deleted"))
 			return
 		}
-		err = LDAPDeleteDN("cn=" + group + "," + configuration.LDAPBaseDN)
+		existing, err := LDAPGetGroup(r.Context(), group)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			w.Write([]byte("Error deleting Group: " + err.Error()))
 			return
 		}
+		if existing == nil {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Error deleting Group: group does not exist"))
+			return
+		}
+		if r.URL.Query().Get("force") != "true" && len(withoutPlaceholder(existing.Members)) != 0 {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte("Error deleting Group: group has members, remove them first or use ?force=true"))
+			return
+		}
+		steps, err := LDAPDeleteGroup(r.Context(), existing.DN)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("Error deleting Group: " + err.Error() + "\n" + formatSteps(steps)))
+			return
+		}
+		emitEvent(EventGroupDeleted, map[string]string{"groupname": group})
 		w.WriteHeader(http.StatusOK)
 	})
 }
+
+// WebhookDeliveries lists pending and past webhook deliveries, optionally filtered by ?status=
+func WebhookDeliveries() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveries := []*WebhookDelivery{}
+		if webhooks != nil {
+			deliveries = webhooks.deliveries(r.URL.Query().Get("status"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+	})
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// SCIM 2.0 (RFC 7643, RFC 7644) provisioning endpoints backed by the LDAP functions.
+// Users and groups are identified by their cn, which is used as SCIM id.
+
+const (
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaPatchOp      = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaSPConfig     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimSchemaResourceType = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema       = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+
+	scimMaxResults = 1000
+)
+
+func registerSCIMRoutes(router instrumentedRouter) {
+	router.Handler("GET", "/scim/v2/ServiceProviderConfig", ValidateTokenMiddleware(SCIMServiceProviderConfig()))
+	router.Handler("GET", "/scim/v2/ResourceTypes", ValidateTokenMiddleware(SCIMResourceTypes()))
+	router.Handler("GET", "/scim/v2/ResourceTypes/:id", ValidateTokenMiddleware(SCIMResourceTypes()))
+	router.Handler("GET", "/scim/v2/Schemas", ValidateTokenMiddleware(SCIMSchemas()))
+	router.Handler("GET", "/scim/v2/Schemas/:id", ValidateTokenMiddleware(SCIMSchemas()))
+
+	router.Handler("GET", "/scim/v2/Users", ValidateTokenMiddleware(SCIMUsersList()))
+	router.Handler("POST", "/scim/v2/Users", ValidateTokenMiddleware(SCIMUsersCreate()))
+	router.Handler("GET", "/scim/v2/Users/:id", ValidateTokenMiddleware(SCIMUsersGet()))
+	router.Handler("PUT", "/scim/v2/Users/:id", ValidateTokenMiddleware(SCIMUsersUpdate(false)))
+	router.Handler("PATCH", "/scim/v2/Users/:id", ValidateTokenMiddleware(SCIMUsersUpdate(true)))
+	router.Handler("DELETE", "/scim/v2/Users/:id", ValidateTokenMiddleware(SCIMUsersDelete()))
+
+	router.Handler("GET", "/scim/v2/Groups", ValidateTokenMiddleware(SCIMGroupsList()))
+	router.Handler("POST", "/scim/v2/Groups", ValidateTokenMiddleware(SCIMGroupsCreate()))
+	router.Handler("GET", "/scim/v2/Groups/:id", ValidateTokenMiddleware(SCIMGroupsGet()))
+	router.Handler("PUT", "/scim/v2/Groups/:id", ValidateTokenMiddleware(SCIMGroupsUpdate(false)))
+	router.Handler("PATCH", "/scim/v2/Groups/:id", ValidateTokenMiddleware(SCIMGroupsUpdate(true)))
+	router.Handler("DELETE", "/scim/v2/Groups/:id", ValidateTokenMiddleware(SCIMGroupsDelete()))
+}
+
+// SCIMUsersList lists users, supporting filter, startIndex and count
+func SCIMUsersList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		users, err := LDAPListUsers(r.Context())
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		resources := make([]map[string]interface{}, len(users))
+		for i := range users {
+			resources[i] = scimUserResource(r, users[i])
+		}
+		scimListResponse(w, r, resources)
+	})
+}
+
+// SCIMUsersGet returns a single user
+func SCIMUsersGet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := scimFindUser(w, r)
+		if !ok {
+			return
+		}
+		scimWrite(w, http.StatusOK, scimUserResource(r, *user))
+	})
+}
+
+// SCIMUsersCreate creates a user. Groups are assigned through the Groups endpoint
+func SCIMUsersCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resource map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+			return
+		}
+		username := scimString(resource, "userName")
+		if username == "" {
+			scimError(w, http.StatusBadRequest, "invalidValue", "userName is required")
+			return
+		}
+		if !usernamePattern.MatchString(username) {
+			scimError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("invalid userName %q", username))
+			return
+		}
+		if !scimActive(resource) {
+			scimError(w, http.StatusBadRequest, "mutability", "active is read-only, users cannot be deactivated")
+			return
+		}
+		existing, err := LDAPGetUser(r.Context(), username)
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		if existing != nil {
+			scimError(w, http.StatusConflict, "uniqueness", "User with given userName already exists")
+			return
+		}
+
+		user := User{
+			Username: username,
+			Name:     scimString(resource, "displayName"),
+			Mail:     scimPrimaryEmail(resource),
+			Password: hashPassword(randomID()),
+		}
+		if password := scimString(resource, "password"); password != "" {
+			user.Password = hashPassword(password)
+		}
+		if err = LDAPAddUser(r.Context(), "cn="+user.Username+","+configuration().LDAPBaseDN, user); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		emitEvent(EventUserCreated, map[string]string{"username": user.Username})
+
+		created, err := LDAPGetUser(r.Context(), username)
+		if err != nil || created == nil {
+			scimError(w, http.StatusInternalServerError, "", "user was created but could not be read back")
+			return
+		}
+		res := scimUserResource(r, *created)
+		w.Header().Set("Location", res["meta"].(map[string]interface{})["location"].(string))
+		scimWrite(w, http.StatusCreated, res)
+	})
+}
+
+// SCIMUsersUpdate replaces (PUT) or patches (PATCH) a user
+func SCIMUsersUpdate(patch bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := scimFindUser(w, r)
+		if !ok {
+			return
+		}
+		if isProtectedUser(user.Username) {
+			scimError(w, http.StatusForbidden, "mutability", "User is protected by divine spirits.")
+			return
+		}
+
+		resource, ok := scimReadUpdate(w, r, scimUserResource(r, *user), patch)
+		if !ok {
+			return
+		}
+		if name := scimString(resource, "userName"); name != "" && name != user.Username {
+			scimError(w, http.StatusBadRequest, "mutability", "userName cannot be changed")
+			return
+		}
+		if !scimActive(resource) {
+			scimError(w, http.StatusBadRequest, "mutability", "active is read-only, users cannot be deactivated")
+			return
+		}
+
+		attributes := map[string][]string{
+			"displayName": scimValues(scimString(resource, "displayName")),
+			"mail":        scimValues(scimPrimaryEmail(resource)),
+		}
+		if len(attributes["displayName"]) == 0 {
+			attributes["displayName"] = []string{user.Username}
+		}
+		if err := LDAPReplaceAttributes(r.Context(), user.DN, attributes); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		if password := scimString(resource, "password"); password != "" {
+			if err := LDAPChangeUserPassword(r.Context(), user.Username, hashPassword(password)); err != nil {
+				scimError(w, http.StatusInternalServerError, "", err.Error())
+				return
+			}
+			emitEvent(EventUserPasswordChanged, map[string]string{"username": user.Username})
+		}
+
+		updated, err := LDAPGetUser(r.Context(), user.Username)
+		if err != nil || updated == nil {
+			scimError(w, http.StatusInternalServerError, "", "user was updated but could not be read back")
+			return
+		}
+		scimWrite(w, http.StatusOK, scimUserResource(r, *updated))
+	})
+}
+
+// SCIMUsersDelete deletes a user
+func SCIMUsersDelete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := scimFindUser(w, r)
+		if !ok {
+			return
+		}
+		if isProtectedUser(user.Username) {
+			scimError(w, http.StatusForbidden, "mutability", "User is protected by divine spirits.")
+			return
+		}
+		if _, err := LDAPDeleteUser(r.Context(), user.DN); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		emitEvent(EventUserDeleted, map[string]string{"username": user.Username})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// SCIMGroupsList lists groups, supporting filter, startIndex and count
+func SCIMGroupsList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		groups, err := LDAPListGroups(r.Context())
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		graph := newGroupGraph(groups)
+		resources := make([]map[string]interface{}, len(groups))
+		for i := range groups {
+			resources[i] = scimGroupResource(r, groups[i], graph)
+		}
+		scimListResponse(w, r, resources)
+	})
+}
+
+// SCIMGroupsGet returns a single group
+func SCIMGroupsGet() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := scimFindGroup(w, r)
+		if !ok {
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		scimWrite(w, http.StatusOK, scimGroupResource(r, *group, graph))
+	})
+}
+
+// SCIMGroupsCreate creates a group with the given members
+func SCIMGroupsCreate() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var resource map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+			return
+		}
+		name := scimString(resource, "displayName")
+		if name == "" {
+			scimError(w, http.StatusBadRequest, "invalidValue", "displayName is required")
+			return
+		}
+		if !usernamePattern.MatchString(name) {
+			scimError(w, http.StatusBadRequest, "invalidValue", fmt.Sprintf("invalid displayName %q", name))
+			return
+		}
+		existing, err := LDAPGetGroup(r.Context(), name)
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		if existing != nil {
+			scimError(w, http.StatusConflict, "uniqueness", "Group with given displayName already exists")
+			return
+		}
+
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+
+		// the group is removed again if a member cannot be added, so the client can retry
+		dn := "cn=" + name + "," + configuration().LDAPBaseDN
+		op := newOperation("create group")
+		op.step("create group "+name,
+			func() error { return LDAPAddGroup(r.Context(), dn) },
+			func() error { return LDAPDeleteDN(r.Context(), dn) })
+		added, _, err := scimMemberSteps(r.Context(), op, name, nil, scimMembers(resource, graph))
+		if err != nil {
+			scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+		if results, err := op.run(); err != nil {
+			if results[0].Status == stepFailed {
+				scimError(w, http.StatusInternalServerError, "", err.Error())
+			} else {
+				scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+			}
+			return
+		}
+		emitEvent(EventGroupCreated, map[string]string{"groupname": name})
+		scimMemberEvents(name, added, nil)
+
+		if graph, err = loadGroupGraph(r.Context()); err != nil || graph.group(name) == nil {
+			scimError(w, http.StatusInternalServerError, "", "group was created but could not be read back")
+			return
+		}
+		res := scimGroupResource(r, *graph.group(name), graph)
+		w.Header().Set("Location", res["meta"].(map[string]interface{})["location"].(string))
+		scimWrite(w, http.StatusCreated, res)
+	})
+}
+
+// SCIMGroupsUpdate replaces (PUT) or patches (PATCH) a group. Only the members can be changed
+func SCIMGroupsUpdate(patch bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := scimFindGroup(w, r)
+		if !ok {
+			return
+		}
+		graph, err := loadGroupGraph(r.Context())
+		if err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		current := scimGroupResource(r, *group, graph)
+		resource, ok := scimReadUpdate(w, r, current, patch)
+		if !ok {
+			return
+		}
+		if name := scimString(resource, "displayName"); name != "" && name != group.Name {
+			scimError(w, http.StatusBadRequest, "mutability", "displayName cannot be changed")
+			return
+		}
+		if err := scimSetMembers(r.Context(), group.Name, scimMembers(current, graph), scimMembers(resource, graph)); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+
+		if graph, err = loadGroupGraph(r.Context()); err != nil || graph.group(group.Name) == nil {
+			scimError(w, http.StatusInternalServerError, "", "group was updated but could not be read back")
+			return
+		}
+		scimWrite(w, http.StatusOK, scimGroupResource(r, *graph.group(group.Name), graph))
+	})
+}
+
+// SCIMGroupsDelete deletes a group. The admin group cannot be removed
+func SCIMGroupsDelete() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		group, ok := scimFindGroup(w, r)
+		if !ok {
+			return
+		}
+		if isProtectedGroup(group.Name) {
+			scimError(w, http.StatusForbidden, "mutability", "admin group cannot be deleted")
+			return
+		}
+		// provisioning clients delete groups with members, SCIM has no notion of forcing
+		if _, err := LDAPDeleteGroup(r.Context(), group.DN); err != nil {
+			scimError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		emitEvent(EventGroupDeleted, map[string]string{"groupname": group.Name})
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// scimMember is a user or group in the members of a group resource
+type scimMember struct {
+	Value string
+	Group bool
+}
+
+func (m scimMember) key() string {
+	return fmt.Sprintf("%t:%s", m.Group, strings.ToLower(m.Value))
+}
+
+// scimSetMembers changes the members of group from current to desired, completely or not at all
+func scimSetMembers(ctx context.Context, group string, current, desired []scimMember) error {
+	op := newOperation("set members")
+	added, removed, err := scimMemberSteps(ctx, op, group, current, desired)
+	if err != nil {
+		return err
+	}
+	if _, err = op.run(); err != nil {
+		return err
+	}
+	scimMemberEvents(group, added, removed)
+	return nil
+}
+
+// scimMemberSteps appends the steps that change the members of group from current to desired to op
+func scimMemberSteps(ctx context.Context, op *operation, group string, current, desired []scimMember) (added, removed []scimMember, err error) {
+	have := map[string]bool{}
+	for _, member := range current {
+		have[member.key()] = true
+	}
+	want := map[string]bool{}
+	for _, member := range desired {
+		if want[member.key()] {
+			continue
+		}
+		want[member.key()] = true
+		if !have[member.key()] {
+			added = append(added, member)
+		}
+	}
+	for _, member := range current {
+		if !want[member.key()] {
+			if !member.Group && isProtectedUser(member.Value) {
+				return nil, nil, fmt.Errorf("%s is protected by divine spirits", member.Value)
+			}
+			removed = append(removed, member)
+		}
+	}
+
+	addMember := func(member scimMember) error {
+		if member.Group {
+			return LDAPAddGroupToGroup(ctx, member.Value, group)
+		}
+		return LDAPAddUserToGroup(ctx, member.Value, group)
+	}
+	removeMember := func(member scimMember) error {
+		if member.Group {
+			return LDAPRemoveGroupFromGroup(ctx, member.Value, group)
+		}
+		return LDAPRemoveUserFromGroup(ctx, member.Value, group)
+	}
+	for _, member := range added {
+		member := member
+		op.step("add "+member.Value+" to group "+group,
+			func() error {
+				if err := addMember(member); err != nil {
+					return fmt.Errorf("could not add %s: %v", member.Value, err)
+				}
+				return nil
+			},
+			func() error { return removeMember(member) })
+	}
+	for _, member := range removed {
+		member := member
+		op.step("remove "+member.Value+" from group "+group,
+			func() error {
+				if err := removeMember(member); err != nil {
+					return fmt.Errorf("could not remove %s: %v", member.Value, err)
+				}
+				return nil
+			},
+			func() error { return addMember(member) })
+	}
+	return added, removed, nil
+}
+
+// scimMemberEvents emits the events for members added to and removed from group
+func scimMemberEvents(group string, added, removed []scimMember) {
+	data := func(member scimMember) map[string]string {
+		if member.Group {
+			return map[string]string{"subgroup": member.Value, "groupname": group}
+		}
+		return map[string]string{"username": member.Value, "groupname": group}
+	}
+	for _, member := range added {
+		emitEvent(EventGroupMemberAdded, data(member))
+	}
+	for _, member := range removed {
+		emitEvent(EventGroupMemberRemoved, data(member))
+	}
+}
+
+func scimFindUser(w http.ResponseWriter, r *http.Request) (*UserEntry, bool) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	user, err := LDAPGetUser(r.Context(), id)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return nil, false
+	}
+	if user == nil {
+		scimError(w, http.StatusNotFound, "", "User "+id+" not found")
+		return nil, false
+	}
+	return user, true
+}
+
+func scimFindGroup(w http.ResponseWriter, r *http.Request) (*GroupEntry, bool) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	group, err := LDAPGetGroup(r.Context(), id)
+	if err != nil {
+		scimError(w, http.StatusInternalServerError, "", err.Error())
+		return nil, false
+	}
+	if group == nil {
+		scimError(w, http.StatusNotFound, "", "Group "+id+" not found")
+		return nil, false
+	}
+	return group, true
+}
+
+// scimReadUpdate reads the new representation of a resource from a PUT body,
+// or applies the operations of a PATCH body to current
+func scimReadUpdate(w http.ResponseWriter, r *http.Request, current map[string]interface{}, patch bool) (map[string]interface{}, bool) {
+	if !patch {
+		var resource map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&resource); err != nil {
+			scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+			return nil, false
+		}
+		return resource, true
+	}
+
+	var body struct {
+		Operations []scimPatchOp `json:"Operations"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidSyntax", err.Error())
+		return nil, false
+	}
+	// work on a copy, so current stays untouched
+	data, _ := json.Marshal(current)
+	var resource map[string]interface{}
+	json.Unmarshal(data, &resource)
+	if err := scimApplyPatch(resource, body.Operations); err != nil {
+		scimError(w, http.StatusBadRequest, "invalidPath", err.Error())
+		return nil, false
+	}
+	return resource, true
+}
+
+func scimUserResource(r *http.Request, user UserEntry) map[string]interface{} {
+	res := map[string]interface{}{
+		"schemas":     []interface{}{scimSchemaUser},
+		"id":          user.Username,
+		"userName":    user.Username,
+		"displayName": user.DisplayName,
+		"active":      true,
+		"meta": map[string]interface{}{
+			"resourceType": "User",
+			"location":     scimBaseURL(r) + "/Users/" + user.Username,
+		},
+	}
+	if user.Mail != "" {
+		res["emails"] = []interface{}{map[string]interface{}{"value": user.Mail, "primary": true}}
+	}
+	groups := []interface{}{}
+	for _, dn := range user.Groups {
+		name := rdnValue(dn)
+		groups = append(groups, map[string]interface{}{
+			"value":   name,
+			"display": name,
+			"$ref":    scimBaseURL(r) + "/Groups/" + name,
+		})
+	}
+	res["groups"] = groups
+	return res
+}
+
+// scimGroupResource returns group as SCIM resource. graph tells groups apart from users among the members
+func scimGroupResource(r *http.Request, group GroupEntry, graph *groupGraph) map[string]interface{} {
+	members := []interface{}{}
+	users, groups := graph.splitMembers(group)
+	for _, dn := range users {
+		name := rdnValue(dn)
+		members = append(members, map[string]interface{}{
+			"value":   name,
+			"display": name,
+			"type":    "User",
+			"$ref":    scimBaseURL(r) + "/Users/" + name,
+		})
+	}
+	for _, dn := range groups {
+		name := graph.groups[normalizeDN(dn)].Name
+		members = append(members, map[string]interface{}{
+			"value":   name,
+			"display": name,
+			"type":    "Group",
+			"$ref":    scimBaseURL(r) + "/Groups/" + name,
+		})
+	}
+	return map[string]interface{}{
+		"schemas":     []interface{}{scimSchemaGroup},
+		"id":          group.Name,
+		"displayName": group.Name,
+		"members":     members,
+		"meta": map[string]interface{}{
+			"resourceType": "Group",
+			"location":     scimBaseURL(r) + "/Groups/" + group.Name,
+		},
+	}
+}
+
+// scimListResponse filters, sorts and paginates resources and writes them as ListResponse
+func scimListResponse(w http.ResponseWriter, r *http.Request, resources []map[string]interface{}) {
+	query := r.URL.Query()
+	if expr := query.Get("filter"); expr != "" {
+		filter, err := parseSCIMFilter(expr)
+		if err != nil {
+			scimError(w, http.StatusBadRequest, "invalidFilter", err.Error())
+			return
+		}
+		matching := []map[string]interface{}{}
+		for _, res := range resources {
+			if filter.match(res) {
+				matching = append(matching, res)
+			}
+		}
+		resources = matching
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		return resources[i]["id"].(string) < resources[j]["id"].(string)
+	})
+
+	startIndex, count := 1, scimMaxResults
+	if v, err := strconv.Atoi(query.Get("startIndex")); err == nil && v > 1 {
+		startIndex = v
+	}
+	if v, err := strconv.Atoi(query.Get("count")); err == nil && v >= 0 && v < scimMaxResults {
+		count = v
+	}
+	total := len(resources)
+	from := startIndex - 1
+	if from > total {
+		from = total
+	}
+	to := from + count
+	if to > total {
+		to = total
+	}
+
+	scimWrite(w, http.StatusOK, map[string]interface{}{
+		"schemas":      []string{scimSchemaListResponse},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": to - from,
+		"Resources":    resources[from:to],
+	})
+}
+
+// SCIMServiceProviderConfig describes the supported SCIM features
+func SCIMServiceProviderConfig() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scimWrite(w, http.StatusOK, map[string]interface{}{
+			"schemas":          []string{scimSchemaSPConfig},
+			"documentationUri": "https://github.com/fs-geofs/UserManager",
+			"patch":            map[string]bool{"supported": true},
+			"bulk":             map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":           map[string]interface{}{"supported": true, "maxResults": scimMaxResults},
+			"changePassword":   map[string]bool{"supported": true},
+			"sort":             map[string]bool{"supported": false},
+			"etag":             map[string]bool{"supported": false},
+			"authenticationSchemes": []map[string]interface{}{{
+				"type":        "oauthbearertoken",
+				"name":        "JWT Bearer Token",
+				"description": "Token obtained from /api/login",
+				"primary":     true,
+			}},
+			"meta": map[string]string{"resourceType": "ServiceProviderConfig", "location": scimBaseURL(r) + "/ServiceProviderConfig"},
+		})
+	})
+}
+
+// SCIMResourceTypes lists the supported resource types
+func SCIMResourceTypes() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		types := []map[string]interface{}{}
+		for _, t := range []struct{ name, endpoint, schema string }{
+			{"User", "/Users", scimSchemaUser},
+			{"Group", "/Groups", scimSchemaGroup},
+		} {
+			types = append(types, map[string]interface{}{
+				"schemas":     []string{scimSchemaResourceType},
+				"id":          t.name,
+				"name":        t.name,
+				"endpoint":    t.endpoint,
+				"description": t.name,
+				"schema":      t.schema,
+				"meta":        map[string]string{"resourceType": "ResourceType", "location": scimBaseURL(r) + "/ResourceTypes/" + t.name},
+			})
+		}
+		scimWriteDiscovery(w, r, types)
+	})
+}
+
+// SCIMSchemas describes the attributes of the supported resources
+func SCIMSchemas() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attr := func(name, typ string, multi, required bool, mutability string, sub ...map[string]interface{}) map[string]interface{} {
+			a := map[string]interface{}{
+				"name": name, "type": typ, "multiValued": multi, "required": required,
+				"caseExact": false, "mutability": mutability, "returned": "default", "uniqueness": "none",
+			}
+			if name == "password" {
+				a["returned"] = "never"
+			}
+			if len(sub) != 0 {
+				a["subAttributes"] = sub
+			}
+			return a
+		}
+		ref := attr("value", "string", false, false, "immutable")
+		display := attr("display", "string", false, false, "readOnly")
+
+		schemas := []map[string]interface{}{
+			{
+				"id": scimSchemaUser, "name": "User", "description": "User Account",
+				"attributes": []map[string]interface{}{
+					attr("userName", "string", false, true, "immutable"),
+					attr("displayName", "string", false, false, "readWrite"),
+					attr("password", "string", false, false, "writeOnly"),
+					attr("active", "boolean", false, false, "readOnly"),
+					attr("emails", "complex", true, false, "readWrite", attr("value", "string", false, false, "readWrite"), attr("primary", "boolean", false, false, "readWrite")),
+					attr("groups", "complex", true, false, "readOnly", ref, display),
+				},
+			},
+			{
+				"id": scimSchemaGroup, "name": "Group", "description": "Group",
+				"attributes": []map[string]interface{}{
+					attr("displayName", "string", false, true, "immutable"),
+					attr("members", "complex", true, false, "readWrite", ref, display, attr("type", "string", false, false, "immutable")),
+				},
+			},
+		}
+		for _, schema := range schemas {
+			schema["schemas"] = []string{scimSchemaSchema}
+			schema["meta"] = map[string]string{"resourceType": "Schema", "location": scimBaseURL(r) + "/Schemas/" + schema["id"].(string)}
+		}
+		scimWriteDiscovery(w, r, schemas)
+	})
+}
+
+// scimWriteDiscovery writes either all discovery resources or the one selected by the :id parameter
+func scimWriteDiscovery(w http.ResponseWriter, r *http.Request, resources []map[string]interface{}) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if id == "" {
+		scimWrite(w, http.StatusOK, map[string]interface{}{
+			"schemas":      []string{scimSchemaListResponse},
+			"totalResults": len(resources),
+			"startIndex":   1,
+			"itemsPerPage": len(resources),
+			"Resources":    resources,
+		})
+		return
+	}
+	for _, res := range resources {
+		if res["id"] == id {
+			scimWrite(w, http.StatusOK, res)
+			return
+		}
+	}
+	scimError(w, http.StatusNotFound, "", id+" not found")
+}
+
+func scimBaseURL(r *http.Request) string {
+	return externalURL(r, "/scim/v2")
+}
+
+func scimWrite(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func scimError(w http.ResponseWriter, status int, scimType, detail string) {
+	body := map[string]interface{}{
+		"schemas": []string{scimSchemaError},
+		"status":  strconv.Itoa(status),
+		"detail":  detail,
+	}
+	if scimType != "" {
+		body["scimType"] = scimType
+	}
+	scimWrite(w, status, body)
+}
+
+// scimString returns the string attribute name of a resource
+func scimString(resource map[string]interface{}, name string) string {
+	key, _ := scimKey(resource, name)
+	s, _ := resource[key].(string)
+	return strings.TrimSpace(s)
+}
+
+// scimPrimaryEmail returns the primary email of a resource, or the first one if none is primary
+func scimPrimaryEmail(resource map[string]interface{}) string {
+	key, _ := scimKey(resource, "emails")
+	emails, _ := resource[key].([]interface{})
+	first := ""
+	for _, e := range emails {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, _ := m["value"].(string)
+		if primary, _ := m["primary"].(bool); primary {
+			return value
+		}
+		if first == "" {
+			first = value
+		}
+	}
+	return first
+}
+
+// scimMembers returns the members of a group resource. Members without type are groups
+// if a group of that name exists in graph, as users and groups share the cn
+func scimMembers(resource map[string]interface{}, graph *groupGraph) []scimMember {
+	key, _ := scimKey(resource, "members")
+	members, _ := resource[key].([]interface{})
+	result := []scimMember{}
+	for _, m := range members {
+		member, ok := m.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		value, _ := member["value"].(string)
+		if value == "" {
+			continue
+		}
+		typeKey, _ := scimKey(member, "type")
+		memberType, _ := member[typeKey].(string)
+		switch {
+		case strings.EqualFold(memberType, "Group"):
+			result = append(result, scimMember{Value: value, Group: true})
+		case strings.EqualFold(memberType, "User"):
+			result = append(result, scimMember{Value: value})
+		default:
+			result = append(result, scimMember{Value: value, Group: graph.group(value) != nil})
+		}
+	}
+	return result
+}
+
+// scimActive reports whether a user resource is active. Users cannot be deactivated.
+// Some clients send booleans as strings
+func scimActive(resource map[string]interface{}) bool {
+	key, _ := scimKey(resource, "active")
+	switch active := resource[key].(type) {
+	case bool:
+		return active
+	case string:
+		return !strings.EqualFold(active, "false")
+	}
+	return true
+}
+
+func scimValues(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+	return []string{value}
+}
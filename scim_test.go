@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func scimTestGraph() *groupGraph {
+	return newGroupGraph([]GroupEntry{
+		{DN: "cn=hobbits,dc=example,dc=com", Name: "hobbits", Members: []string{"cn=frodo,dc=example,dc=com", "cn=Burglars,dc=example,dc=com"}},
+		{DN: "cn=burglars,dc=example,dc=com", Name: "burglars", Members: []string{"cn=bilbo,dc=example,dc=com"}},
+	})
+}
+
+func TestSCIMMembers(t *testing.T) {
+	tests := []struct {
+		name     string
+		resource string
+		want     []scimMember
+	}{
+		{"none", `{}`, []scimMember{}},
+		{"typed", `{"members": [{"value": "frodo", "type": "User"}, {"value": "burglars", "type": "group"}]}`,
+			[]scimMember{{Value: "frodo"}, {Value: "burglars", Group: true}}},
+		{"untyped", `{"Members": [{"value": "frodo"}, {"value": "Burglars"}]}`,
+			[]scimMember{{Value: "frodo"}, {Value: "Burglars", Group: true}}},
+		{"type wins", `{"members": [{"value": "burglars", "TYPE": "User"}]}`, []scimMember{{Value: "burglars"}}},
+		{"invalid", `{"members": ["frodo", {"value": ""}, {"display": "frodo"}]}`, []scimMember{}},
+	}
+	for _, test := range tests {
+		got := scimMembers(scimTestResource(t, test.resource), scimTestGraph())
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSCIMGroupResource(t *testing.T) {
+	graph := scimTestGraph()
+	r := httptest.NewRequest("GET", "http://um.example.com/scim/v2/Groups/hobbits", nil)
+	members := scimGroupResource(r, *graph.group("hobbits"), graph)["members"].([]interface{})
+	want := []interface{}{
+		map[string]interface{}{"value": "frodo", "display": "frodo", "type": "User", "$ref": "http://um.example.com/scim/v2/Users/frodo"},
+		map[string]interface{}{"value": "burglars", "display": "burglars", "type": "Group", "$ref": "http://um.example.com/scim/v2/Groups/burglars"},
+	}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("members %v, want %v", members, want)
+	}
+}
+
+func TestSCIMMemberSteps(t *testing.T) {
+	frodo, bilbo, admin := scimMember{Value: "frodo"}, scimMember{Value: "bilbo"}, scimMember{Value: "admin"}
+	burglars := scimMember{Value: "burglars", Group: true}
+	tests := []struct {
+		name             string
+		current, desired []scimMember
+		steps            []string
+		wantError        bool
+	}{
+		{"unchanged", []scimMember{frodo, burglars}, []scimMember{{Value: "Frodo"}, burglars}, nil, false},
+		{"add", []scimMember{frodo}, []scimMember{frodo, bilbo, bilbo, burglars},
+			[]string{"add bilbo to group hobbits", "add burglars to group hobbits"}, false},
+		{"replace", []scimMember{frodo, burglars}, []scimMember{bilbo},
+			[]string{"add bilbo to group hobbits", "remove frodo from group hobbits", "remove burglars from group hobbits"}, false},
+		{"user and group of the same name", []scimMember{{Value: "burglars"}}, []scimMember{burglars},
+			[]string{"add burglars to group hobbits", "remove burglars from group hobbits"}, false},
+		{"protected", []scimMember{admin, frodo}, []scimMember{frodo}, nil, true},
+	}
+	for _, test := range tests {
+		op := newOperation("set members")
+		_, _, err := scimMemberSteps(context.Background(), op, "hobbits", test.current, test.desired)
+		if (err != nil) != test.wantError {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		var steps []string
+		for _, step := range op.steps {
+			steps = append(steps, step.name)
+		}
+		if !reflect.DeepEqual(steps, test.steps) {
+			t.Errorf("%s: steps %q, want %q", test.name, steps, test.steps)
+		}
+	}
+}
+
+func TestSCIMActive(t *testing.T) {
+	tests := []struct {
+		resource string
+		active   bool
+	}{
+		{`{}`, true},
+		{`{"active": true}`, true},
+		{`{"active": false}`, false},
+		{`{"Active": "False"}`, false},
+		{`{"active": "true"}`, true},
+	}
+	for _, test := range tests {
+		if got := scimActive(scimTestResource(t, test.resource)); got != test.active {
+			t.Errorf("%s: active %v, want %v", test.resource, got, test.active)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// scimFilter is a parsed SCIM filter expression (RFC 7644, section 3.4.2.2)
+type scimFilter interface {
+	match(resource map[string]interface{}) bool
+}
+
+type scimAnd struct{ left, right scimFilter }
+type scimOr struct{ left, right scimFilter }
+type scimNot struct{ filter scimFilter }
+
+// scimCompare is an attribute expression like `userName eq "bilbo"` or `emails pr`
+type scimCompare struct {
+	path  string
+	op    string
+	value interface{}
+}
+
+// scimValuePath is a filter on the elements of a multi-valued attribute like `emails[type eq "work"]`
+type scimValuePath struct {
+	attr   string
+	filter scimFilter
+}
+
+func (f scimAnd) match(r map[string]interface{}) bool { return f.left.match(r) && f.right.match(r) }
+func (f scimOr) match(r map[string]interface{}) bool  { return f.left.match(r) || f.right.match(r) }
+func (f scimNot) match(r map[string]interface{}) bool { return !f.filter.match(r) }
+
+func (f scimValuePath) match(r map[string]interface{}) bool {
+	for _, v := range scimLookup(r, f.attr) {
+		if elem, ok := v.(map[string]interface{}); ok && f.filter.match(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f scimCompare) match(r map[string]interface{}) bool {
+	values := scimLookup(r, f.path)
+	if f.op == "pr" {
+		for _, v := range values {
+			if v != nil && v != "" {
+				return true
+			}
+		}
+		return false
+	}
+	for _, v := range values {
+		if scimCompareValue(v, f.op, f.value) {
+			return true
+		}
+	}
+	// `ne` also matches resources that lack the attribute
+	return f.op == "ne" && len(values) == 0
+}
+
+func scimCompareValue(actual interface{}, op string, expected interface{}) bool {
+	switch a := actual.(type) {
+	case string:
+		e, ok := expected.(string)
+		if !ok {
+			return op == "ne"
+		}
+		a, e = strings.ToLower(a), strings.ToLower(e)
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		case "co":
+			return strings.Contains(a, e)
+		case "sw":
+			return strings.HasPrefix(a, e)
+		case "ew":
+			return strings.HasSuffix(a, e)
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case float64:
+		e, ok := expected.(float64)
+		if !ok {
+			return op == "ne"
+		}
+		switch op {
+		case "eq":
+			return a == e
+		case "ne":
+			return a != e
+		case "gt":
+			return a > e
+		case "ge":
+			return a >= e
+		case "lt":
+			return a < e
+		case "le":
+			return a <= e
+		}
+	case bool:
+		switch op {
+		case "eq":
+			return a == expected
+		case "ne":
+			return a != expected
+		}
+	}
+	return false
+}
+
+// scimLookup resolves an attribute path like `name.familyName` or `emails.value` on a resource.
+// Multi-valued attributes are flattened, so the result contains every value found on the path.
+func scimLookup(resource map[string]interface{}, path string) []interface{} {
+	path = scimStripSchema(path)
+	current := []interface{}{resource}
+	for _, part := range strings.Split(path, ".") {
+		var next []interface{}
+		for _, c := range current {
+			m, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			key, ok := scimKey(m, part)
+			if !ok {
+				continue
+			}
+			if list, ok := m[key].([]interface{}); ok {
+				next = append(next, list...)
+			} else {
+				next = append(next, m[key])
+			}
+		}
+		current = next
+	}
+	return current
+}
+
+// scimStripSchema removes a schema URN prefix from an attribute path
+func scimStripSchema(path string) string {
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		if i := strings.LastIndex(path, ":"); i >= 0 {
+			return path[i+1:]
+		}
+	}
+	return path
+}
+
+// scimKey finds the key of m matching name case-insensitively, as SCIM attribute names are case-insensitive
+func scimKey(m map[string]interface{}, name string) (string, bool) {
+	if _, ok := m[name]; ok {
+		return name, true
+	}
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return name, false
+}
+
+// parseSCIMFilter parses a filter query parameter
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := scimTokenize(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &scimFilterParser{tokens: tokens}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in filter", p.tokens[p.pos])
+	}
+	return f, nil
+}
+
+type scimFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *scimFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *scimFilterParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *scimFilterParser) parseOr() (scimFilter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = scimOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseAnd() (scimFilter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = scimAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *scimFilterParser) parseUnary() (scimFilter, error) {
+	switch t := p.next(); {
+	case t == "":
+		return nil, fmt.Errorf("unexpected end of filter")
+	case strings.EqualFold(t, "not"):
+		if p.next() != "(" {
+			return nil, fmt.Errorf("expected ( after not")
+		}
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return scimNot{f}, nil
+	case t == "(":
+		f, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return f, nil
+	case t == ")" || t == "[" || t == "]":
+		return nil, fmt.Errorf("unexpected %q in filter", t)
+	default:
+		if p.peek() == "[" {
+			p.next()
+			f, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if p.next() != "]" {
+				return nil, fmt.Errorf("missing ]")
+			}
+			return scimValuePath{attr: t, filter: f}, nil
+		}
+		op := strings.ToLower(p.next())
+		switch op {
+		case "pr":
+			return scimCompare{path: t, op: op}, nil
+		case "eq", "ne", "co", "sw", "ew", "gt", "ge", "lt", "le":
+			var value interface{}
+			if err := json.Unmarshal([]byte(p.next()), &value); err != nil {
+				return nil, fmt.Errorf("invalid comparison value for %s", t)
+			}
+			return scimCompare{path: t, op: op, value: value}, nil
+		}
+		return nil, fmt.Errorf("invalid operator %q", op)
+	}
+}
+
+func scimTokenize(filter string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(filter) && filter[j] != '"'; j++ {
+				if filter[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(filter) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			tokens = append(tokens, filter[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(filter) && !strings.ContainsRune(" \t()[]\"", rune(filter[j])); j++ {
+			}
+			tokens = append(tokens, filter[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// scimPatchOp is a single operation of a PATCH request (RFC 7644, section 3.5.2)
+type scimPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// scimApplyPatch applies PATCH operations to the JSON representation of a resource
+func scimApplyPatch(resource map[string]interface{}, ops []scimPatchOp) error {
+	for _, op := range ops {
+		var err error
+		switch strings.ToLower(op.Op) {
+		case "add":
+			err = scimPatchSet(resource, op.Path, op.Value, true)
+		case "replace":
+			err = scimPatchSet(resource, op.Path, op.Value, false)
+		case "remove":
+			err = scimPatchRemove(resource, op.Path, op.Value)
+		default:
+			err = fmt.Errorf("invalid op %q", op.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scimParsePath splits `members[value eq "x"].display` into attribute, filter and sub-attribute
+func scimParsePath(path string) (attr string, filter scimFilter, sub string, err error) {
+	path = scimStripSchema(path)
+	if i := strings.Index(path, "["); i >= 0 {
+		j := strings.LastIndex(path, "]")
+		if j < i {
+			return "", nil, "", fmt.Errorf("invalid path %q", path)
+		}
+		if filter, err = parseSCIMFilter(path[i+1 : j]); err != nil {
+			return "", nil, "", err
+		}
+		attr, sub = path[:i], strings.TrimPrefix(path[j+1:], ".")
+		return
+	}
+	if i := strings.Index(path, "."); i >= 0 {
+		return path[:i], nil, path[i+1:], nil
+	}
+	return path, nil, "", nil
+}
+
+func scimPatchSet(resource map[string]interface{}, path string, value interface{}, add bool) error {
+	if path == "" {
+		values, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("value must be an object when no path is given")
+		}
+		for k, v := range values {
+			if err := scimPatchSet(resource, k, v, add); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	attr, filter, sub, err := scimParsePath(path)
+	if err != nil {
+		return err
+	}
+	key, _ := scimKey(resource, attr)
+
+	if filter != nil {
+		list, _ := resource[key].([]interface{})
+		matched := false
+		for i, elem := range list {
+			m, ok := elem.(map[string]interface{})
+			if !ok || !filter.match(m) {
+				continue
+			}
+			matched = true
+			if sub != "" {
+				subKey, _ := scimKey(m, sub)
+				m[subKey] = value
+			} else {
+				list[i] = value
+			}
+		}
+		if !matched {
+			return fmt.Errorf("no values matched path %q", path)
+		}
+		return nil
+	}
+
+	if sub != "" {
+		m, ok := resource[key].(map[string]interface{})
+		if !ok {
+			m = map[string]interface{}{}
+			resource[key] = m
+		}
+		subKey, _ := scimKey(m, sub)
+		m[subKey] = value
+		return nil
+	}
+
+	existing, isList := resource[key].([]interface{})
+	if add && isList {
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			if !scimContains(existing, v) {
+				existing = append(existing, v)
+			}
+		}
+		resource[key] = existing
+		return nil
+	}
+	resource[key] = value
+	return nil
+}
+
+func scimPatchRemove(resource map[string]interface{}, path string, value interface{}) error {
+	if path == "" {
+		return fmt.Errorf("path is required for remove")
+	}
+	attr, filter, sub, err := scimParsePath(path)
+	if err != nil {
+		return err
+	}
+	key, ok := scimKey(resource, attr)
+	if !ok {
+		return nil
+	}
+
+	list, isList := resource[key].([]interface{})
+	switch {
+	case filter != nil && isList:
+		kept := []interface{}{}
+		for _, elem := range list {
+			m, ok := elem.(map[string]interface{})
+			if !ok || !filter.match(m) {
+				kept = append(kept, elem)
+			} else if sub != "" {
+				subKey, _ := scimKey(m, sub)
+				delete(m, subKey)
+				kept = append(kept, m)
+			}
+		}
+		resource[key] = kept
+	case sub != "":
+		if m, ok := resource[key].(map[string]interface{}); ok {
+			subKey, _ := scimKey(m, sub)
+			delete(m, subKey)
+		}
+	case isList && value != nil:
+		// some clients send the members to remove as value instead of a filter
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		kept := []interface{}{}
+		for _, elem := range list {
+			if !scimContains(values, elem) {
+				kept = append(kept, elem)
+			}
+		}
+		resource[key] = kept
+	default:
+		delete(resource, key)
+	}
+	return nil
+}
+
+// scimContains checks whether list contains v. Complex values are compared by their `value` attribute
+func scimContains(list []interface{}, v interface{}) bool {
+	for _, elem := range list {
+		if reflect.DeepEqual(elem, v) {
+			return true
+		}
+		a, aok := elem.(map[string]interface{})
+		b, bok := v.(map[string]interface{})
+		if aok && bok && a["value"] != nil && reflect.DeepEqual(a["value"], b["value"]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func scimTestResource(t *testing.T, text string) map[string]interface{} {
+	t.Helper()
+	var resource map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &resource); err != nil {
+		t.Fatal(err)
+	}
+	return resource
+}
+
+func TestSCIMFilterMatch(t *testing.T) {
+	user := scimTestResource(t, `{
+		"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+		"userName": "Bilbo",
+		"active": true,
+		"name": {"familyName": "Baggins", "givenName": "Bilbo"},
+		"emails": [{"value": "bilbo@shire.example", "type": "work"}, {"value": "b@home.example", "type": "home"}],
+		"meta": {"version": 3}
+	}`)
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "bilbo"`, true},
+		{`USERNAME Eq "BILBO"`, true},
+		{`userName ne "bilbo"`, false},
+		{`userName co "lb"`, true},
+		{`userName sw "bi"`, true},
+		{`userName ew "bo"`, true},
+		{`userName gt "a"`, true},
+		{`userName lt "a"`, false},
+		{`userName ge "bilbo" and userName le "bilbo"`, true},
+		{`name.familyName eq "Baggins"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "bilbo"`, true},
+		{`emails.value eq "b@home.example"`, true},
+		{`emails[type eq "work" and value co "shire"]`, true},
+		{`emails[type eq "work" and value co "home"]`, false},
+		{`emails pr`, true},
+		{`title pr`, false},
+		{`title ne "x"`, true},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`meta.version gt 2`, true},
+		{`meta.version eq "3"`, false},
+		{`userName eq "frodo" or userName eq "bilbo"`, true},
+		{`userName eq "frodo" or userName eq "sam" and active eq true`, false},
+		{`(userName eq "frodo" or userName eq "bilbo") and active eq true`, true},
+		{`not (userName eq "bilbo")`, false},
+		{`userName eq "say \"hi\""`, false},
+	}
+	for _, test := range tests {
+		filter, err := parseSCIMFilter(test.filter)
+		if err != nil {
+			t.Errorf("%s: %v", test.filter, err)
+			continue
+		}
+		if got := filter.match(user); got != test.match {
+			t.Errorf("%s: match = %v, want %v", test.filter, got, test.match)
+		}
+	}
+}
+
+func TestSCIMFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName eq "bilbo`,
+		`userName eq bilbo`,
+		`userName is "bilbo"`,
+		`(userName eq "bilbo"`,
+		`userName eq "bilbo")`,
+		`emails[type eq "work"`,
+		`not userName eq "bilbo"`,
+		`userName eq "bilbo" and`,
+		`] userName pr`,
+	} {
+		if _, err := parseSCIMFilter(filter); err == nil {
+			t.Errorf("%q: expected an error", filter)
+		}
+	}
+}
+
+func TestSCIMApplyPatch(t *testing.T) {
+	group := `{"displayName": "hobbits", "members": [{"value": "bilbo"}, {"value": "frodo"}]}`
+	tests := []struct {
+		name string
+		ops  string
+		want string
+	}{
+		{"add member", `[{"op": "add", "path": "members", "value": [{"value": "sam"}, {"value": "bilbo"}]}]`,
+			`{"displayName": "hobbits", "members": [{"value": "bilbo"}, {"value": "frodo"}, {"value": "sam"}]}`},
+		{"remove by filter", `[{"op": "remove", "path": "members[value eq \"bilbo\"]"}]`,
+			`{"displayName": "hobbits", "members": [{"value": "frodo"}]}`},
+		{"remove by value", `[{"op": "Remove", "path": "members", "value": [{"value": "frodo"}]}]`,
+			`{"displayName": "hobbits", "members": [{"value": "bilbo"}]}`},
+		{"remove all", `[{"op": "remove", "path": "members"}]`,
+			`{"displayName": "hobbits"}`},
+		{"replace", `[{"op": "replace", "path": "members", "value": [{"value": "sam"}]}]`,
+			`{"displayName": "hobbits", "members": [{"value": "sam"}]}`},
+		{"replace without path", `[{"op": "replace", "value": {"displayName": "halflings"}}]`,
+			`{"displayName": "halflings", "members": [{"value": "bilbo"}, {"value": "frodo"}]}`},
+		{"sub-attribute of filtered value", `[{"op": "replace", "path": "members[value eq \"frodo\"].display", "value": "Frodo"}]`,
+			`{"displayName": "hobbits", "members": [{"value": "bilbo"}, {"value": "frodo", "display": "Frodo"}]}`},
+		{"sub-attribute", `[{"op": "add", "path": "meta.location", "value": "x"}]`,
+			`{"displayName": "hobbits", "members": [{"value": "bilbo"}, {"value": "frodo"}], "meta": {"location": "x"}}`},
+	}
+	for _, test := range tests {
+		resource := scimTestResource(t, group)
+		var ops []scimPatchOp
+		if err := json.Unmarshal([]byte(test.ops), &ops); err != nil {
+			t.Fatal(err)
+		}
+		if err := scimApplyPatch(resource, ops); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if want := scimTestResource(t, test.want); !reflect.DeepEqual(resource, want) {
+			t.Errorf("%s: got %v, want %v", test.name, resource, want)
+		}
+	}
+}
+
+func TestSCIMApplyPatchErrors(t *testing.T) {
+	for _, ops := range []string{
+		`[{"op": "move", "path": "members"}]`,
+		`[{"op": "remove"}]`,
+		`[{"op": "replace", "value": "x"}]`,
+		`[{"op": "replace", "path": "members[value eq \"sam\"]", "value": {"value": "x"}}]`,
+		`[{"op": "replace", "path": "members]value eq \"sam\"[", "value": "x"}]`,
+	} {
+		resource := scimTestResource(t, `{"members": [{"value": "bilbo"}]}`)
+		var parsed []scimPatchOp
+		if err := json.Unmarshal([]byte(ops), &parsed); err != nil {
+			t.Fatal(err)
+		}
+		if err := scimApplyPatch(resource, parsed); err == nil {
+			t.Errorf("%s: expected an error", ops)
+		}
+	}
+}
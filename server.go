@@ -1,55 +1,103 @@
 package main
 
 import (
-	"crypto/rsa"
 	"crypto/tls"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
-	"github.com/didip/tollbooth"
 	"github.com/julienschmidt/httprouter"
 )
 
-var (
-	verifyKey     *rsa.PublicKey
-	signKey       *rsa.PrivateKey
-	configuration ServerConfig
-)
-
 func main() {
-	readConfig(&configuration)
-	verifyKey, signKey = readJWTKeys(configuration)
-	router := httprouter.New()
-	ratelimiter := tollbooth.NewLimiter(0.2, nil) // allow one request every 5 seconds per IP
+	if args := parseGlobalFlags(os.Args[1:]); len(args) > 0 {
+		runCommand(args)
+	}
+
+	readConfig()
+	setupLogging(*configuration())
+	if configuration().DevMode {
+		logWarn("dev mode: missing keys and certificates are generated, do not use in production")
+	}
+	readJWTKeys()
+	go reloadOnSignal()
+	if len(configuration().Webhooks) != 0 {
+		var err error
+		if webhooks, err = newWebhookDispatcher(*configuration()); err != nil {
+			log.Fatal(err)
+		}
+		webhooks.run()
+	}
+	var err error
+	if membershipRequests, err = newRequestStore(configuration().MembershipRequestFile); err != nil {
+		log.Fatal(err)
+	}
+	if configuration().DirectoryCacheRefresh > 0 {
+		directory = newDirectoryCache(time.Duration(configuration().DirectoryCacheRefresh) * time.Second)
+		go directory.run()
+		if configuration().DirectoryCacheSync {
+			go directory.watch()
+		}
+	}
+	router := instrumentedRouter{httprouter.New()}
 
 	// Frontend
 	router.GET("/", EmbeddedStaticFilesMiddleware)
 	router.GET("/static/*filepath", EmbeddedStaticFilesMiddleware)
 
 	// API
-	router.Handler("POST", "/api/login", tollbooth.LimitFuncHandler(ratelimiter, Login))
+	router.Handler("POST", "/api/login", http.HandlerFunc(Login))
+	router.Handler("POST", "/api/login/user", http.HandlerFunc(UserLogin))
 	router.Handler("POST", "/api/users/add", ValidateTokenMiddleware(UsersAdd()))
 	router.Handler("POST", "/api/users/remove", ValidateTokenMiddleware(UsersRemove()))
 	router.Handler("POST", "/api/users/removeFromGroup", ValidateTokenMiddleware(RemoveUserFromGroup()))
 	router.Handler("POST", "/api/users/addToGroup", ValidateTokenMiddleware(AddUserToGroup()))
 	router.Handler("POST", "/api/users/changePassword", ValidateTokenMiddleware(UsersChangePassword()))
 	router.Handler("GET", "/api/users/list", ValidateTokenMiddleware(UsersList()))
+	router.Handler("POST", "/api/users/import", ValidateTokenMiddleware(UsersImport()))
 	router.Handler("POST", "/api/groups/add", ValidateTokenMiddleware(GroupsAdd()))
 	router.Handler("POST", "/api/groups/remove", ValidateTokenMiddleware(GroupsRemove()))
 	router.Handler("GET", "/api/groups/list", ValidateTokenMiddleware(GroupsList()))
+	router.Handler("GET", "/api/export", ValidateTokenMiddleware(Export()))
+	router.Handler("POST", "/api/ldif", ValidateTokenMiddleware(LDIFApply()))
+	router.Handler("GET", "/api/webhooks/deliveries", ValidateTokenMiddleware(WebhookDeliveries()))
+
+	// API v2
+	registerV2Routes(router)
+
+	// SCIM 2.0 provisioning
+	registerSCIMRoutes(router)
+
+	// probes, unauthenticated
+	router.Handler("GET", "/healthz", Healthz())
+	router.Handler("GET", "/readyz", Readyz())
+
+	// Prometheus metrics
+	router.Handler("GET", "/metrics", MetricsTokenMiddleware(Metrics()))
 
 	srv := &http.Server{
-		Addr:         configuration.ServerBindAddr,
-		Handler:      router,
+		Addr:         configuration().ServerBindAddr,
+		Handler:      RequestLogMiddleware(CORSMiddleware(PathPrefixMiddleware(InvalidateCacheMiddleware(router)))),
 		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler), 0),
 	}
 
 	// Start Server.
-	if configuration.SSLCertificate == "" && configuration.SSLKeyFile == "" {
-		log.Println("listening (http) on", configuration.ServerBindAddr)
-		log.Fatal(srv.ListenAndServe())
-	} else {
-		log.Println("listening (https) on", configuration.ServerBindAddr)
-		log.Fatal(srv.ListenAndServeTLS(configuration.SSLCertificate, configuration.SSLKeyFile))
+	listener, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+	useTLS := tlsConfigured(*configuration())
+	if useTLS {
+		cert, err := loadCertificate(*configuration())
+		if err != nil {
+			log.Fatal(err)
+		}
+		certificate.Store(cert)
+		srv.TLSConfig = &tls.Config{GetCertificate: getCertificate}
+	}
+	logInfo("listening", "addr", listener.Addr().String(), "tls", useTLS)
+	if err = serve(srv, listener, useTLS); err != nil {
+		log.Fatal(err)
 	}
 }
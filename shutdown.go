@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// The server stops gracefully on SIGTERM and SIGINT: it stops accepting connections, reports not ready,
+// and waits up to ShutdownTimeout for running requests, e.g. bulk imports, and webhook deliveries before exiting.
+// With systemd socket activation, the listening socket stays open across restarts, so no connection is refused.
+
+// shuttingDown is set once a shutdown signal was received
+var shuttingDown int32
+
+// systemdListener returns the socket passed by systemd socket activation (sd_listen_fds), or nil
+// if the server was not socket activated
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	if count > 1 {
+		return nil, errors.New("socket activation passed " + strconv.Itoa(count) + " sockets, expected one")
+	}
+	// not inherited by child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	const firstFD = 3 // SD_LISTEN_FDS_START
+	file := os.NewFile(firstFD, "systemd socket")
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// listen returns the socket activated listener or listens on ServerBindAddr
+func listen() (net.Listener, error) {
+	listener, err := systemdListener()
+	if err != nil || listener != nil {
+		return listener, err
+	}
+	return net.Listen("tcp", configuration().ServerBindAddr)
+}
+
+// serve serves srv on listener until a shutdown signal is received and running requests finished
+func serve(srv *http.Server, listener net.Listener, useTLS bool) error {
+	errs := make(chan error, 1)
+	go func() {
+		if useTLS {
+			errs <- srv.ServeTLS(listener, "", "") // certificates from srv.TLSConfig.GetCertificate
+		} else {
+			errs <- srv.Serve(listener)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-signals:
+		logInfo("shutting down", "signal", sig.String(), "timeout", configuration().ShutdownTimeout)
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+	signal.Stop(signals)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(configuration().ShutdownTimeout)*time.Second)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if directory != nil {
+		directory.stop()
+	}
+	// after the requests, so the events they emitted are queued
+	if webhooks != nil {
+		if saveErr := webhooks.stop(ctx); saveErr != nil {
+			logError("could not persist webhook queue", "error", saveErr)
+		}
+	}
+	if err != nil {
+		return errors.New("requests still running after ShutdownTimeout: " + err.Error())
+	}
+	logInfo("stopped")
+	return nil
+}
@@ -14,6 +14,33 @@ type ServerConfig struct {
 	LDAPBaseDN       string
 	LDAPAdminfilter  string
 	LDAPUserfilter   string
+
+	Webhooks           []WebhookConfig
+	WebhookQueueFile   string
+	WebhookMaxAttempts int
+
+	BulkImportParallelism int
+	AuditLogFile          string
+	MembershipRequestFile string
+
+	DirectoryCacheRefresh int  // seconds between reloads of the directory cache, 0 disables the cache
+	DirectoryCacheSync    bool // invalidate the cache on changes reported by content synchronization
+
+	MetricsToken string // bearer token required for /metrics, open if empty
+
+	ShutdownTimeout int // seconds to wait for running requests on shutdown
+
+	LogFormat string // logfmt or json
+	LogLevel  string // debug, info, warn or error
+
+	DevMode bool // generate missing JWT keys and TLS certificates in memory, for development only
+
+	RateLimits     []RateLimit  // per route request limits, by client IP or login username
+	LoginLockout   LoginLockout // lock accounts after failed logins
+	TrustedProxies []string     // CIDRs or addresses of reverse proxies whose Forwarded and X-Forwarded-* headers are used
+
+	PathPrefix string     // path the server is mounted under, e.g. /usermanager
+	CORS       CORSConfig // origins allowed to call the API from browsers
 }
 
 // User is the internal Representation of User to be added/removed/edited
@@ -22,9 +49,31 @@ type User struct {
 	Password string `json:"password"`
 	Fs       string `json:"fs"`
 	Group    string `json:"groupname"`
+	Name     string `json:"name"`
+	Mail     string `json:"mail"`
 }
 
 // Group is the internal Representation of Group to be added/removed
 type Group struct {
 	Name string `json:"groupname"`
 }
+
+// UserEntry is a user as read from LDAP
+type UserEntry struct {
+	DN          string   `json:"dn"`
+	Username    string   `json:"username"`
+	DisplayName string   `json:"displayName"`
+	Mail        string   `json:"mail,omitempty"`
+	Groups      []string `json:"groups"` // group DNs
+}
+
+// GroupEntry is a group as read from LDAP
+type GroupEntry struct {
+	DN          string   `json:"dn"`
+	Name        string   `json:"name"`
+	Members     []string `json:"members"` // member DNs
+	Description string   `json:"description,omitempty"`
+	Owners      []string `json:"owners,omitempty"` // owner DNs, users or groups
+	Mail        string   `json:"mail,omitempty"`
+	Visibility  string   `json:"visibility"` // public or private
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Parser for the subset of TOML used in config files: key/value pairs with bare or quoted keys,
+// [tables], [[arrays of tables]], basic and literal strings, integers, floats, booleans, arrays
+// (also across lines) and inline tables. Dotted keys, multi-line strings and dates are not supported.
+// Values are returned like parseYAML returns them.
+
+type tomlParser struct {
+	text    string
+	pos     int
+	defined map[uintptr]bool // tables opened by a header, which cannot be opened again
+	inline  map[uintptr]bool // inline tables, which cannot be extended
+}
+
+// parseTOML parses a TOML document into a map[string]interface{}
+func parseTOML(r io.Reader) (map[string]interface{}, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &tomlParser{text: strings.Replace(string(data), "\r\n", "\n", -1), defined: map[uintptr]bool{}, inline: map[uintptr]bool{}}
+	root := map[string]interface{}{}
+	current := root
+	for {
+		p.skipSpace(true)
+		if p.pos >= len(p.text) {
+			return root, nil
+		}
+		if p.text[p.pos] == '[' {
+			if current, err = p.table(root); err != nil {
+				return nil, err
+			}
+		} else if err = p.keyValue(current); err != nil {
+			return nil, err
+		}
+		if err = p.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	line := strings.Count(p.text[:p.pos], "\n") + 1
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips blanks and comments, and line breaks if newlines is set
+func (p *tomlParser) skipSpace(newlines bool) {
+	for p.pos < len(p.text) {
+		switch c := p.text[p.pos]; {
+		case c == ' ' || c == '\t' || (newlines && c == '\n'):
+			p.pos++
+		case c == '#':
+			for p.pos < len(p.text) && p.text[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace(false)
+	if p.pos < len(p.text) && p.text[p.pos] != '\n' {
+		return p.errorf("expected end of line")
+	}
+	return nil
+}
+
+// table parses a [table] or [[array of tables]] header and returns the table it opens
+func (p *tomlParser) table(root map[string]interface{}) (map[string]interface{}, error) {
+	array := strings.HasPrefix(p.text[p.pos:], "[[")
+	closing := "]"
+	p.pos++
+	if array {
+		closing = "]]"
+		p.pos++
+	}
+	end := strings.Index(p.text[p.pos:], closing)
+	if end < 0 || strings.Contains(p.text[p.pos:p.pos+end], "\n") {
+		return nil, p.errorf("unterminated table header")
+	}
+	names := strings.Split(p.text[p.pos:p.pos+end], ".")
+	p.pos += end + len(closing)
+
+	table := root
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		if unquoted, err := strconv.Unquote(name); err == nil {
+			name = unquoted
+		}
+		if name == "" {
+			return nil, p.errorf("empty table name")
+		}
+		last := i == len(names)-1
+		switch existing := table[name].(type) {
+		case nil:
+			if last && array {
+				next := map[string]interface{}{}
+				table[name] = []interface{}{next}
+				table = next
+			} else {
+				next := map[string]interface{}{}
+				table[name] = next
+				table = next
+			}
+		case map[string]interface{}:
+			if last && array {
+				return nil, p.errorf("%s is a table, not an array of tables", name)
+			}
+			if ptr := reflect.ValueOf(existing).Pointer(); p.inline[ptr] || (last && p.defined[ptr]) {
+				return nil, p.errorf("duplicate key %q", name)
+			}
+			table = existing
+		case []interface{}:
+			if last && array {
+				next := map[string]interface{}{}
+				table[name] = append(existing, next)
+				table = next
+				continue
+			}
+			if last || len(existing) == 0 {
+				return nil, p.errorf("duplicate key %q", name)
+			}
+			next, ok := existing[len(existing)-1].(map[string]interface{})
+			if !ok {
+				return nil, p.errorf("%s is not a table", name)
+			}
+			table = next
+		default:
+			return nil, p.errorf("duplicate key %q", name)
+		}
+	}
+	p.defined[reflect.ValueOf(table).Pointer()] = true
+	return table, nil
+}
+
+// keyValue parses key = value into table
+func (p *tomlParser) keyValue(table map[string]interface{}) error {
+	key, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpace(false)
+	if p.pos >= len(p.text) || p.text[p.pos] != '=' {
+		return p.errorf("expected = after key %q", key)
+	}
+	p.pos++
+	p.skipSpace(false)
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	if _, exists := table[key]; exists {
+		return p.errorf("duplicate key %q", key)
+	}
+	table[key] = value
+	return nil
+}
+
+func (p *tomlParser) key() (string, error) {
+	if p.pos < len(p.text) && (p.text[p.pos] == '"' || p.text[p.pos] == '\'') {
+		return p.str()
+	}
+	start := p.pos
+	for p.pos < len(p.text) {
+		c := p.text[p.pos]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected key")
+	}
+	if p.pos < len(p.text) && p.text[p.pos] == '.' {
+		return "", p.errorf("dotted keys are not supported")
+	}
+	return p.text[start:p.pos], nil
+}
+
+// str parses a basic "..." or literal '...' string on a single line
+func (p *tomlParser) str() (string, error) {
+	quote := p.text[p.pos]
+	if strings.HasPrefix(p.text[p.pos:], strings.Repeat(string(quote), 3)) {
+		return "", p.errorf("multi-line strings are not supported")
+	}
+	for end := p.pos + 1; end < len(p.text) && p.text[end] != '\n'; end++ {
+		if quote == '"' && p.text[end] == '\\' {
+			end++
+			continue
+		}
+		if p.text[end] == quote {
+			raw := p.text[p.pos : end+1]
+			p.pos = end + 1
+			if quote == '\'' {
+				return raw[1 : len(raw)-1], nil
+			}
+			value, err := strconv.Unquote(raw)
+			if err != nil {
+				return "", p.errorf("invalid string %s", raw)
+			}
+			return value, nil
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	if p.pos >= len(p.text) {
+		return nil, p.errorf("expected value")
+	}
+	switch p.text[p.pos] {
+	case '"', '\'':
+		return p.str()
+	case '[':
+		return p.array()
+	case '{':
+		return p.inlineTable()
+	}
+	start := p.pos
+	for p.pos < len(p.text) && !strings.ContainsRune(" \t\n#,]}", rune(p.text[p.pos])) {
+		p.pos++
+	}
+	text := p.text[start:p.pos]
+	switch text {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	number := strings.Replace(text, "_", "", -1)
+	if i, err := strconv.ParseInt(number, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil {
+		return f, nil
+	}
+	p.pos = start
+	return nil, p.errorf("invalid value %q", text)
+}
+
+func (p *tomlParser) array() (interface{}, error) {
+	p.pos++
+	result := []interface{}{}
+	for {
+		p.skipSpace(true)
+		if p.pos < len(p.text) && p.text[p.pos] == ']' {
+			p.pos++
+			return result, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+		p.skipSpace(true)
+		if p.pos < len(p.text) && p.text[p.pos] == ',' {
+			p.pos++
+		} else if p.pos >= len(p.text) || p.text[p.pos] != ']' {
+			return nil, p.errorf("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() (interface{}, error) {
+	p.pos++
+	result := map[string]interface{}{}
+	for {
+		p.skipSpace(false)
+		if p.pos < len(p.text) && p.text[p.pos] == '}' {
+			p.pos++
+			p.inline[reflect.ValueOf(result).Pointer()] = true
+			return result, nil
+		}
+		if err := p.keyValue(result); err != nil {
+			return nil, err
+		}
+		p.skipSpace(false)
+		if p.pos < len(p.text) && p.text[p.pos] == ',' {
+			p.pos++
+		} else if p.pos >= len(p.text) || p.text[p.pos] != '}' {
+			return nil, p.errorf("expected , or } in inline table")
+		}
+	}
+}
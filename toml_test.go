@@ -0,0 +1,132 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		want yamlMap
+	}{
+		{"empty", "# nothing\n\n", yamlMap{}},
+		{"scalars", `
+string = "hello world"
+literal = 'C:\path'
+escapes = "tab\there \"quoted\""
+int = 42
+negative = -7
+underscores = 1_000
+hex = 0x1f
+float = 1.5
+exponent = 1e3
+bool = true
+off = false
+"quoted key" = 1
+'literal key' = 2
+`, yamlMap{"string": "hello world", "literal": `C:\path`, "escapes": "tab\there \"quoted\"", "int": int64(42),
+			"negative": int64(-7), "underscores": int64(1000), "hex": int64(31), "float": 1.5, "exponent": float64(1000),
+			"bool": true, "off": false, "quoted key": int64(1), "literal key": int64(2)}},
+		{"comments", `
+# full line
+a = 1 # trailing
+b = "#1" #trailing
+`, yamlMap{"a": int64(1), "b": "#1"}},
+		{"tables", `
+LogLevel = "debug"
+
+[LoginLockout]
+MaxFailures = 5
+
+[CORS]
+AllowedOrigins = ["https://a.example.com"]
+
+[a.b]
+c = 1
+[a."d"]
+e = 2
+`, yamlMap{"LogLevel": "debug", "LoginLockout": yamlMap{"MaxFailures": int64(5)},
+			"CORS": yamlMap{"AllowedOrigins": yamlList{"https://a.example.com"}},
+			"a":    yamlMap{"b": yamlMap{"c": int64(1)}, "d": yamlMap{"e": int64(2)}}}},
+		{"arrays of tables", `
+[[Webhooks]]
+url = "https://wiki.example.com/hook"
+events = ["user.created", "user.deleted"]
+
+[[Webhooks]]
+url = "https://lists.example.com/hook"
+
+[Webhooks.headers]
+X-Token = "t"
+`, yamlMap{"Webhooks": yamlList{
+			yamlMap{"url": "https://wiki.example.com/hook", "events": yamlList{"user.created", "user.deleted"}},
+			yamlMap{"url": "https://lists.example.com/hook", "headers": yamlMap{"X-Token": "t"}},
+		}}},
+		{"arrays", `
+empty = []
+mixed = [1, "two", 3.0, true]
+nested = [[1, 2], ["a"]]
+multiline = [
+  "a", # first
+  "b",
+]
+`, yamlMap{"empty": yamlList{}, "mixed": yamlList{int64(1), "two", 3.0, true},
+			"nested": yamlList{yamlList{int64(1), int64(2)}, yamlList{"a"}}, "multiline": yamlList{"a", "b"}}},
+		{"inline tables", `
+limit = {Route = "/api/login", Rate = 0.2, Burst = 1}
+empty = {}
+nested = {a = {b = [1]}}
+`, yamlMap{"limit": yamlMap{"Route": "/api/login", "Rate": 0.2, "Burst": int64(1)}, "empty": yamlMap{},
+			"nested": yamlMap{"a": yamlMap{"b": yamlList{int64(1)}}}}},
+		{"CRLF", "a = 1\r\n[t]\r\nb = 'x'\r\n", yamlMap{"a": int64(1), "t": yamlMap{"b": "x"}}},
+	}
+	for _, test := range tests {
+		got, err := parseTOML(strings.NewReader(test.toml))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	tests := []struct {
+		toml, err string
+	}{
+		{"a = 1\nb 2\n", "line 2: expected = after key \"b\""},
+		{"a = 1\na = 2\n", `line 2: duplicate key "a"`},
+		{"a = 1\n\n= 2\n", "line 3: expected key"},
+		{"a.b = 1\n", "line 1: dotted keys are not supported"},
+		{"a = 1 2\n", "line 1: expected end of line"},
+		{"a =\n", "line 1: invalid value \"\""},
+		{"a = yes\n", `line 1: invalid value "yes"`},
+		{"\na = \"open\n", "line 2: unterminated string"},
+		{"a = \"\\q\"\n", `line 1: invalid string "\q"`},
+		{"a = \"\"\"\nmulti\n\"\"\"\n", "line 1: multi-line strings are not supported"},
+		{"a = [1, 2\nb = 3\n", "line 2: expected , or ] in array"},
+		{"a = {b = 1\n", "line 1: expected , or } in inline table"},
+		{"a = {b = 1, b = 2}\n", `line 1: duplicate key "b"`},
+		{"[t\na = 1\n", "line 1: unterminated table header"},
+		{"[]\n", "line 1: empty table name"},
+		{"[t]\n[t]\n", `line 2: duplicate key "t"`},
+		{"[t.u]\n[t]\n[t]\n", `line 3: duplicate key "t"`},
+		{"t = {a = 1}\n[t]\n", `line 2: duplicate key "t"`},
+		{"t = {a = 1}\n[t.u]\n", `line 2: duplicate key "t"`},
+		{"t = 1\n[t]\n", `line 2: duplicate key "t"`},
+		{"[t]\n[[t]]\n", "line 2: t is a table, not an array of tables"},
+		{"[[t]]\n[t]\n", `line 2: duplicate key "t"`},
+		{"t = [1]\n[t.u]\n", "line 2: t is not a table"},
+	}
+	for _, test := range tests {
+		_, err := parseTOML(strings.NewReader(test.toml))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %s", test.toml, err, test.err)
+		}
+	}
+}
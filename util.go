@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/sha512"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -17,7 +18,9 @@ func parseUser(r *http.Request, required map[string]struct{}) (User, error) {
 		password := r.PostForm.Get("password")
 		fs := r.PostForm.Get("fs")
 		group := r.PostForm.Get("groupname")
-		uc = User{username, password, fs, group}
+		name := r.PostForm.Get("name")
+		mail := r.PostForm.Get("mail")
+		uc = User{username, password, fs, group, name, mail}
 	} else if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
 		decoder := json.NewDecoder(r.Body)
 		decoder.Decode(&uc)
@@ -75,3 +78,24 @@ func ldapEncodePassword(password string) ([]string, error) {
 
 	return []string{"{SHA512}" + encoded}, nil
 }
+
+// hashPassword returns the hex-encoded SHA512 hash of a cleartext password, as the frontend sends it
+func hashPassword(password string) string {
+	sum := sha512.Sum512([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// isProtectedUser checks whether the user must not be modified or deleted through the API
+func isProtectedUser(username string) bool {
+	return username == "admin"
+}
+
+// isProtectedGroup checks whether the group must not be deleted through the API
+func isProtectedGroup(name string) bool {
+	return name == "admins"
+}
+
+// stripBaseDN removes the configured base DN from all DNs in s, as the v1 listings do
+func stripBaseDN(s string) string {
+	return strings.Replace(s, ","+configuration().LDAPBaseDN, "", -1)
+}
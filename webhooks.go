@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types that can be subscribed to by webhooks
+const (
+	EventUserCreated         = "user.created"
+	EventUserDeleted         = "user.deleted"
+	EventUserPasswordChanged = "user.password_changed"
+	EventUserRenamed         = "user.renamed"
+	EventGroupCreated        = "group.created"
+	EventGroupDeleted        = "group.deleted"
+	EventGroupRenamed        = "group.renamed"
+	EventGroupMemberAdded    = "group.member_added"
+	EventGroupMemberRemoved  = "group.member_removed"
+)
+
+const (
+	webhookHistorySize = 500
+	webhookMinBackoff  = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+// WebhookConfig describes a single webhook subscription
+type WebhookConfig struct {
+	ID     string   `json:"id"` // identifies the hook in deliveries, defaults to the url
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // empty or "*" subscribes to all events
+}
+
+// Event is the payload sent to webhook subscribers
+type Event struct {
+	ID   string            `json:"id"`
+	Type string            `json:"type"`
+	Time time.Time         `json:"time"`
+	Data map[string]string `json:"data"`
+}
+
+// WebhookDelivery tracks delivery of one event to one webhook
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	Hook        string          `json:"hook"` // ID of the webhook
+	Event       string          `json:"event"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"` // pending, delivered or failed
+	Attempts    int             `json:"attempts"`
+	StatusCode  int             `json:"statusCode,omitempty"`
+	LastError   string          `json:"lastError,omitempty"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	UpdatedAt   time.Time       `json:"updatedAt"`
+}
+
+// webhookDispatcher queues events and delivers them to the configured webhooks, each hook
+// by its own worker so a slow endpoint does not delay the others. The queue and the delivery
+// history are persisted to disk, so pending deliveries survive a restart.
+type webhookDispatcher struct {
+	mu          sync.Mutex
+	path        string
+	hooks       []WebhookConfig
+	maxAttempts int
+	client      *http.Client
+	wake        map[string]chan struct{} // by hook ID
+	done        chan struct{}            // closed by stop
+	ctx         context.Context          // of the requests, canceled if stop times out
+	cancel      context.CancelFunc
+	workers     sync.WaitGroup
+
+	Queue   []*WebhookDelivery `json:"queue"`
+	History []*WebhookDelivery `json:"history"`
+}
+
+var webhooks *webhookDispatcher
+
+// newWebhookDispatcher creates a dispatcher and restores its state from conf.WebhookQueueFile
+func newWebhookDispatcher(conf ServerConfig) (*webhookDispatcher, error) {
+	d := newDispatcher(conf.Webhooks, conf.WebhookMaxAttempts)
+	d.path = conf.WebhookQueueFile
+	file, err := ioutil.ReadFile(d.path)
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(file, d); err != nil {
+		return nil, fmt.Errorf("could not parse webhook queue %s: %v", d.path, err)
+	}
+	for _, delivery := range d.Queue {
+		// queued before deliveries had a hook ID, which defaults to the url
+		if delivery.Hook == "" {
+			delivery.Hook = delivery.URL
+		}
+	}
+	return d, nil
+}
+
+func newDispatcher(hooks []WebhookConfig, maxAttempts int) *webhookDispatcher {
+	d := &webhookDispatcher{
+		hooks:       hooks,
+		maxAttempts: maxAttempts,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		wake:        map[string]chan struct{}{},
+		done:        make(chan struct{}),
+	}
+	d.ctx, d.cancel = context.WithCancel(context.Background())
+	for _, hook := range hooks {
+		d.wake[hook.ID] = make(chan struct{}, 1)
+	}
+	return d
+}
+
+// setupCLIWebhooks lets a command emit events. The queue file belongs to the server, so a command
+// keeps its deliveries in memory and attempts each of them once before it exits, in runCommand
+func setupCLIWebhooks() {
+	if len(configuration().Webhooks) != 0 {
+		webhooks = newDispatcher(configuration().Webhooks, 1)
+	}
+}
+
+// emitEvent notifies all webhooks subscribed to the given event type
+func emitEvent(eventType string, data map[string]string) {
+	if webhooks == nil {
+		return
+	}
+	if err := webhooks.enqueue(eventType, data); err != nil {
+		logError("could not enqueue webhook event", "event", eventType, "error", err)
+	}
+}
+
+func (d *webhookDispatcher) enqueue(eventType string, data map[string]string) error {
+	now := time.Now().UTC()
+	event := Event{ID: randomID(), Type: eventType, Time: now, Data: data}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var queued []string
+	for _, hook := range d.hooks {
+		if !hook.subscribedTo(eventType) {
+			continue
+		}
+		d.Queue = append(d.Queue, &WebhookDelivery{
+			ID:          randomID(),
+			Hook:        hook.ID,
+			Event:       eventType,
+			URL:         hook.URL,
+			Payload:     payload,
+			Status:      "pending",
+			NextAttempt: now,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+		})
+		queued = append(queued, hook.ID)
+	}
+	if len(queued) == 0 {
+		return nil
+	}
+	for _, id := range queued {
+		select {
+		case d.wake[id] <- struct{}{}:
+		default:
+		}
+	}
+	return d.save()
+}
+
+func (hook WebhookConfig) subscribedTo(eventType string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (hook WebhookConfig) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(hook.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// run starts a worker for every webhook, delivering until stop is called. Queued deliveries
+// of webhooks that are no longer configured fail
+func (d *webhookDispatcher) run() {
+	d.mu.Lock()
+	for _, delivery := range append([]*WebhookDelivery{}, d.Queue...) {
+		if _, ok := d.hook(delivery.Hook); !ok {
+			delivery.Status = "failed"
+			delivery.LastError = fmt.Sprintf("webhook %s is no longer configured", delivery.Hook)
+			delivery.UpdatedAt = time.Now().UTC()
+			d.finish(delivery)
+		}
+	}
+	if err := d.save(); err != nil {
+		logError("could not persist webhook queue", "error", err)
+	}
+	d.mu.Unlock()
+
+	for _, hook := range d.hooks {
+		d.workers.Add(1)
+		go d.work(hook)
+	}
+}
+
+// work delivers the events of a single webhook
+func (d *webhookDispatcher) work(hook WebhookConfig) {
+	defer d.workers.Done()
+	for {
+		wait := d.deliverDue(hook)
+		select {
+		case <-d.wake[hook.ID]:
+		case <-time.After(wait):
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// stop ends the workers after their current delivery and saves the queue. Deliveries still running
+// when ctx is done are canceled and stay queued, to be attempted again after a restart
+func (d *webhookDispatcher) stop(ctx context.Context) error {
+	close(d.done)
+	finished := make(chan struct{})
+	go func() {
+		d.workers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		d.cancel()
+		<-finished
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.save()
+}
+
+// stopping reports whether stop was called
+func (d *webhookDispatcher) stopping() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// hook returns the webhook with the given ID
+func (d *webhookDispatcher) hook(id string) (WebhookConfig, bool) {
+	for _, hook := range d.hooks {
+		if hook.ID == id {
+			return hook, true
+		}
+	}
+	return WebhookConfig{}, false
+}
+
+// deliverAll attempts the due deliveries of all webhooks once, for commands
+func (d *webhookDispatcher) deliverAll() {
+	for _, hook := range d.hooks {
+		d.deliverDue(hook)
+	}
+}
+
+// deliverDue attempts the deliveries to hook that are due and returns the time until the next one is
+func (d *webhookDispatcher) deliverDue(hook WebhookConfig) time.Duration {
+	d.mu.Lock()
+	var due []*WebhookDelivery
+	now := time.Now()
+	for _, delivery := range d.Queue {
+		if delivery.Hook == hook.ID && !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		}
+	}
+	d.mu.Unlock()
+
+	for _, delivery := range due {
+		if d.stopping() {
+			break
+		}
+		statusCode, err := d.deliver(hook, delivery)
+		if d.ctx.Err() != nil {
+			// canceled by stop, not an attempt
+			break
+		}
+
+		d.mu.Lock()
+		delivery.Attempts++
+		delivery.StatusCode = statusCode
+		delivery.UpdatedAt = time.Now().UTC()
+		if err == nil {
+			delivery.Status = "delivered"
+			delivery.LastError = ""
+			d.finish(delivery)
+		} else {
+			delivery.LastError = err.Error()
+			if delivery.Attempts >= d.maxAttempts {
+				delivery.Status = "failed"
+				d.finish(delivery)
+				logError("webhook delivery failed permanently", "delivery", delivery.ID, "url", delivery.URL, "attempts", delivery.Attempts, "error", err)
+			} else {
+				delivery.NextAttempt = delivery.UpdatedAt.Add(webhookBackoff(delivery.Attempts))
+			}
+		}
+		if err := d.save(); err != nil {
+			logError("could not persist webhook queue", "error", err)
+		}
+		d.mu.Unlock()
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	wait := webhookMaxBackoff
+	for _, delivery := range d.Queue {
+		if delivery.Hook != hook.ID {
+			continue
+		}
+		if until := time.Until(delivery.NextAttempt); until < wait {
+			wait = until
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// deliver POSTs the payload of delivery to hook
+func (d *webhookDispatcher) deliver(hook WebhookConfig, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(d.ctx, "POST", hook.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "UserManager-Webhook")
+	req.Header.Set("X-UserManager-Event", delivery.Event)
+	req.Header.Set("X-UserManager-Delivery", delivery.ID)
+	req.Header.Set("X-UserManager-Signature", hook.sign(delivery.Payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return res.StatusCode, nil
+}
+
+// finish moves a delivery from the queue to the history. Caller must hold d.mu.
+func (d *webhookDispatcher) finish(delivery *WebhookDelivery) {
+	for i := range d.Queue {
+		if d.Queue[i] == delivery {
+			d.Queue = append(d.Queue[:i], d.Queue[i+1:]...)
+			break
+		}
+	}
+	d.History = append(d.History, delivery)
+	if len(d.History) > webhookHistorySize {
+		d.History = d.History[len(d.History)-webhookHistorySize:]
+	}
+}
+
+// save persists queue and history. Caller must hold d.mu. Dispatchers of commands have no file
+func (d *webhookDispatcher) save() error {
+	if d.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// deliveries returns pending and finished deliveries, newest first
+func (d *webhookDispatcher) deliveries(status string) []*WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := []*WebhookDelivery{}
+	all := append(append([]*WebhookDelivery{}, d.History...), d.Queue...)
+	for i := len(all) - 1; i >= 0; i-- {
+		if status == "" || all[i].Status == status {
+			copied := *all[i]
+			result = append(result, &copied)
+		}
+	}
+	return result
+}
+
+// webhookBackoff returns the delay before the next attempt, doubling with each attempt
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookMinBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
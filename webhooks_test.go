@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, 10 * time.Second},
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{9, 2560 * time.Second},
+		{10, time.Hour},
+		{100, time.Hour},
+	}
+	for _, test := range tests {
+		if got := webhookBackoff(test.attempts); got != test.want {
+			t.Errorf("backoff after %d attempts: got %v, want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		header = r.Header
+	}))
+	defer server.Close()
+
+	d := newDispatcher([]WebhookConfig{{ID: "wiki", URL: server.URL, Secret: "s3cr3t"}}, 3)
+	if err := d.enqueue(EventUserCreated, map[string]string{"username": "frodo"}); err != nil {
+		t.Fatal(err)
+	}
+	d.deliverAll()
+
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); header.Get("X-UserManager-Signature") != want {
+		t.Errorf("signature %q, want %q", header.Get("X-UserManager-Signature"), want)
+	}
+	if header.Get("X-UserManager-Event") != EventUserCreated {
+		t.Errorf("event header %q", header.Get("X-UserManager-Event"))
+	}
+	var event Event
+	if err := json.Unmarshal(body, &event); err != nil || event.Data["username"] != "frodo" {
+		t.Errorf("payload %s: %v", body, err)
+	}
+	deliveries := d.deliveries("delivered")
+	if len(deliveries) != 1 || deliveries[0].Hook != "wiki" || deliveries[0].ID != header.Get("X-UserManager-Delivery") {
+		t.Errorf("deliveries %+v", deliveries)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		statuses    []int
+		maxAttempts int
+		want        []string // status of the delivery after each attempt
+	}{
+		{"delivered", []int{200}, 3, []string{"delivered"}},
+		{"retried", []int{500, 503, 204}, 3, []string{"pending", "pending", "delivered"}},
+		{"failed", []int{500, 500}, 2, []string{"pending", "failed"}},
+		{"redirects are failures", []int{302}, 1, []string{"failed"}},
+	}
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.statuses[requests])
+			requests++
+		}))
+		hook := WebhookConfig{ID: server.URL, URL: server.URL}
+		d := newDispatcher([]WebhookConfig{hook}, test.maxAttempts)
+		if err := d.enqueue(EventGroupCreated, map[string]string{"groupname": "hobbits"}); err != nil {
+			t.Fatal(err)
+		}
+		for attempt, want := range test.want {
+			wait := d.deliverDue(hook)
+			delivery := d.deliveries("")[0]
+			if delivery.Status != want || delivery.Attempts != attempt+1 || delivery.StatusCode != test.statuses[attempt] {
+				t.Errorf("%s: attempt %d: got %s after %d attempts with status %d, want %s", test.name, attempt+1,
+					delivery.Status, delivery.Attempts, delivery.StatusCode, want)
+			}
+			if want != "pending" {
+				continue
+			}
+			if backoff := delivery.NextAttempt.Sub(delivery.UpdatedAt); backoff != webhookBackoff(attempt+1) {
+				t.Errorf("%s: attempt %d: next attempt after %v, want %v", test.name, attempt+1, backoff, webhookBackoff(attempt+1))
+			}
+			if wait <= 0 || wait > webhookBackoff(attempt+1) {
+				t.Errorf("%s: attempt %d: waiting %v", test.name, attempt+1, wait)
+			}
+			// not due yet
+			d.deliverDue(hook)
+			if requests != attempt+1 {
+				t.Errorf("%s: delivery attempted before its backoff elapsed", test.name)
+			}
+			d.mu.Lock()
+			d.Queue[0].NextAttempt = time.Now()
+			d.mu.Unlock()
+		}
+		server.Close()
+	}
+}
+
+func TestWebhookQueuePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	conf := ServerConfig{
+		WebhookQueueFile:   filepath.Join(dir, "webhooks.json"),
+		WebhookMaxAttempts: 3,
+		Webhooks: []WebhookConfig{
+			{ID: "wiki", URL: "http://127.0.0.1:1/hook", Events: []string{EventUserCreated}},
+			{ID: "lists", URL: "http://127.0.0.1:1/hook"},
+		},
+	}
+	d, err := newWebhookDispatcher(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.enqueue(EventUserCreated, map[string]string{"username": "frodo"})
+	d.enqueue(EventUserDeleted, map[string]string{"username": "frodo"})
+
+	restored, err := newWebhookDispatcher(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks := map[string]int{}
+	for _, delivery := range restored.deliveries("pending") {
+		hooks[delivery.Hook]++
+	}
+	if len(restored.Queue) != 3 || hooks["wiki"] != 1 || hooks["lists"] != 2 {
+		t.Errorf("restored queue %+v", restored.Queue)
+	}
+
+	// deliveries of removed webhooks fail when the server starts
+	conf.Webhooks = nil
+	restored, err = newWebhookDispatcher(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.run()
+	if failed := restored.deliveries("failed"); len(failed) != 3 {
+		t.Errorf("%d failed deliveries, want 3", len(failed))
+	}
+	if restarted, err := newWebhookDispatcher(conf); err != nil || len(restarted.Queue) != 0 || len(restarted.History) != 3 {
+		t.Errorf("queue not saved after failing deliveries: %v", err)
+	}
+}
+
+func TestWebhookSlowHook(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	delivered := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer fast.Close()
+
+	d := newDispatcher([]WebhookConfig{{ID: "slow", URL: slow.URL}, {ID: "fast", URL: fast.URL}}, 3)
+	d.run()
+	d.enqueue(EventUserCreated, map[string]string{"username": "frodo"})
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Error("a slow webhook delayed the delivery to another one")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	d.stop(ctx)
+}
+
+func TestWebhookStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	release := make(chan struct{})
+	requests := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the server notices a canceled request only once the body is read
+		ioutil.ReadAll(r.Body)
+		requests <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		release  bool
+		status   string
+		attempts int
+	}{
+		{"drained", time.Minute, true, "delivered", 1},
+		{"canceled", 50 * time.Millisecond, false, "pending", 0},
+	}
+	for _, test := range tests {
+		conf := ServerConfig{
+			WebhookQueueFile:   filepath.Join(dir, test.name+".json"),
+			WebhookMaxAttempts: 3,
+			Webhooks:           []WebhookConfig{{ID: "wiki", URL: server.URL}},
+		}
+		d, err := newWebhookDispatcher(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.run()
+		d.enqueue(EventUserCreated, map[string]string{"username": "frodo"})
+		<-requests
+
+		ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+		if test.release {
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				release <- struct{}{}
+			}()
+		}
+		if err := d.stop(ctx); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		cancel()
+
+		restored, err := newWebhookDispatcher(conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deliveries := restored.deliveries("")
+		if len(deliveries) != 1 || deliveries[0].Status != test.status || deliveries[0].Attempts != test.attempts {
+			t.Errorf("%s: saved deliveries %+v", test.name, deliveries)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Parser for the subset of YAML used in usermanager files: block mappings and sequences,
+// flow sequences and mappings of scalars, plain and quoted scalars and comments.
+// Anchors, tags, multi-line scalars and multiple documents are not supported.
+// Mappings are returned as map[string]interface{}, sequences as []interface{} and
+// scalars as string, bool, int64, float64 or nil.
+
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseYAML parses a YAML document. An empty document is returned as nil
+func parseYAML(r io.Reader) (interface{}, error) {
+	p := &yamlParser{}
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		raw := strings.TrimRight(scanner.Text(), "\r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", number)
+		}
+		text = strings.TrimRight(yamlStripComment(text), " \t")
+		if text == "" || (len(p.lines) == 0 && text == "---") {
+			continue
+		}
+		p.lines = append(p.lines, yamlLine{number, len(raw) - len(strings.TrimLeft(raw, " ")), text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+
+	value, err := p.node(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return value, nil
+}
+
+func (p *yamlParser) errorf(format string, args ...interface{}) error {
+	line := p.lines[len(p.lines)-1].number
+	if p.pos < len(p.lines) {
+		line = p.lines[p.pos].number
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+// node parses the block starting at the current line, which is indented by indent
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	if yamlIsSequenceItem(p.lines[p.pos].text) {
+		return p.sequence(indent)
+	}
+	if _, _, ok := yamlSplitKey(p.lines[p.pos].text); ok {
+		return p.mapping(indent)
+	}
+	value, err := yamlFlowValue(p.lines[p.pos].text)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	p.pos++
+	return value, nil
+}
+
+// nested parses the value of a key or sequence item that is on the following lines
+func (p *yamlParser) nested(indent int, allowSequence bool) (interface{}, error) {
+	if p.pos >= len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || (allowSequence && next.indent == indent && yamlIsSequenceItem(next.text)) {
+		return p.node(next.indent)
+	}
+	return nil, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	result := map[string]interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		key, rest, ok := yamlSplitKey(p.lines[p.pos].text)
+		if !ok {
+			return nil, p.errorf("expected key: value")
+		}
+		if _, exists := result[key]; exists {
+			return nil, p.errorf("duplicate key %q", key)
+		}
+		var value interface{}
+		var err error
+		if rest == "" {
+			p.pos++
+			value, err = p.nested(indent, true)
+		} else {
+			value, err = yamlFlowValue(rest)
+			if err != nil {
+				return nil, p.errorf("%v", err)
+			}
+			p.pos++
+		}
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return result, nil
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	result := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && yamlIsSequenceItem(p.lines[p.pos].text) {
+		line := p.lines[p.pos]
+		item := strings.TrimLeft(line.text[1:], " ")
+		if item == "" {
+			p.pos++
+			value, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+			continue
+		}
+		// the item starts on the same line, e.g. `- name: x`. Parse it as if it was on its own line
+		p.lines[p.pos] = yamlLine{line.number, indent + len(line.text) - len(item), item}
+		value, err := p.node(p.lines[p.pos].indent)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+	}
+	if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+		return nil, p.errorf("unexpected indentation")
+	}
+	return result, nil
+}
+
+func yamlIsSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlSplitKey splits `key: value` at the first colon outside of quotes that is followed by a space
+func yamlSplitKey(text string) (key, rest string, ok bool) {
+	end := yamlScan(text, func(i int) bool {
+		return text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ')
+	})
+	if end <= 0 || text[0] == '[' || text[0] == '{' {
+		return "", "", false
+	}
+	// keys are names: only quoted keys are resolved, `null: x` and `true: x` keep their text
+	key = strings.TrimSpace(text[:end])
+	if key[0] == '"' || key[0] == '\'' {
+		k, err := yamlScalar(key)
+		if err != nil {
+			return "", "", false
+		}
+		key = k.(string)
+	}
+	return key, strings.TrimSpace(text[end+1:]), true
+}
+
+// yamlScan returns the index of the first byte outside of quotes for which match is true, or -1
+func yamlScan(text string, match func(i int) bool) int {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '\'' && c == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			// '' is an escaped quote
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [{,:", text[i-1]) >= 0):
+			quote = c
+		case match(i):
+			return i
+		}
+	}
+	return -1
+}
+
+func yamlStripComment(text string) string {
+	i := yamlScan(text, func(i int) bool {
+		return text[i] == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t')
+	})
+	if i < 0 {
+		return text
+	}
+	return text[:i]
+}
+
+// yamlFlowValue parses a scalar, `[a, b]` or `{a: b}` given on a single line
+func yamlFlowValue(text string) (interface{}, error) {
+	switch {
+	case text == "|" || text == ">" || strings.HasPrefix(text, "|") || strings.HasPrefix(text, ">"):
+		return nil, fmt.Errorf("multi-line scalars are not supported")
+	case strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*") || strings.HasPrefix(text, "!"):
+		return nil, fmt.Errorf("anchors, aliases and tags are not supported")
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("unterminated flow sequence")
+		}
+		result := []interface{}{}
+		for _, item := range yamlSplitFlow(text[1 : len(text)-1]) {
+			value, err := yamlScalar(item)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value)
+		}
+		return result, nil
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, fmt.Errorf("unterminated flow mapping")
+		}
+		result := map[string]interface{}{}
+		for _, item := range yamlSplitFlow(text[1 : len(text)-1]) {
+			key, rest, ok := yamlSplitKey(item)
+			if !ok {
+				return nil, fmt.Errorf("expected key: value in flow mapping")
+			}
+			value, err := yamlScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = value
+		}
+		return result, nil
+	}
+	return yamlScalar(text)
+}
+
+// yamlSplitFlow splits the content of a flow collection at commas outside of quotes
+func yamlSplitFlow(text string) []string {
+	var items []string
+	for strings.TrimSpace(text) != "" {
+		i := yamlScan(text, func(i int) bool { return text[i] == ',' || text[i] == '[' || text[i] == '{' })
+		if i < 0 {
+			items = append(items, strings.TrimSpace(text))
+			break
+		}
+		if text[i] != ',' {
+			// nested collections are not supported, let yamlScalar reject the item
+			items = append(items, strings.TrimSpace(text))
+			break
+		}
+		items = append(items, strings.TrimSpace(text[:i]))
+		text = text[i+1:]
+	}
+	return items
+}
+
+// yamlScalar resolves a plain or quoted scalar
+func yamlScalar(text string) (interface{}, error) {
+	if text == "" {
+		return nil, nil
+	}
+	switch text[0] {
+	case '"':
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid double quoted string %s", text)
+		}
+		return value, nil
+	case '\'':
+		if len(text) < 2 || text[len(text)-1] != '\'' {
+			return nil, fmt.Errorf("invalid single quoted string %s", text)
+		}
+		return strings.Replace(text[1:len(text)-1], "''", "'", -1), nil
+	case '[', '{', ']', '}':
+		return nil, fmt.Errorf("nested flow collections are not supported")
+	}
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(text, 64); err == nil && strings.ContainsAny(text[:1], "0123456789+-.") {
+		return f, nil
+	}
+	return text, nil
+}
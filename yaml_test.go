@@ -0,0 +1,137 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type yamlMap = map[string]interface{}
+type yamlList = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want interface{}
+	}{
+		{"empty", "", nil},
+		{"only comments", "# nothing\n\n  # here\n", nil},
+		{"scalars", `
+string: hello world
+int: 42
+negative: -7
+float: 1.5
+exponent: 1e3
+bool: true
+False: FALSE
+null: ~
+empty:
+version: 1.2.3
+dotted: .hidden
+`, yamlMap{"string": "hello world", "int": int64(42), "negative": int64(-7), "float": 1.5, "exponent": float64(1000),
+			"bool": true, "False": false, "null": nil, "empty": nil, "version": "1.2.3", "dotted": ".hidden"}},
+		{"quoting", `
+double: "a: b # not a comment"
+escapes: "tab\there \"quoted\""
+single: 'it''s # here'
+number: "42"
+bool: 'true'
+"quoted key": 1
+url: http://example.com/a#b
+`, yamlMap{"double": "a: b # not a comment", "escapes": "tab\there \"quoted\"", "single": "it's # here",
+			"number": "42", "bool": "true", "quoted key": int64(1), "url": "http://example.com/a#b"}},
+		{"comments", `
+--- # document start
+a: 1 # trailing
+# full line
+b: "#1" #trailing
+`, yamlMap{"a": int64(1), "b": "#1"}},
+		{"block sequence", `
+- a
+- 2
+-
+- "c"
+`, yamlList{"a", int64(2), nil, "c"}},
+		{"nested mappings", `
+server:
+  bind: :8443
+  tls:
+    cert: tls.crt
+    key: tls.key
+log: json
+`, yamlMap{"server": yamlMap{"bind": ":8443", "tls": yamlMap{"cert": "tls.crt", "key": "tls.key"}}, "log": "json"}},
+		{"sequence of mappings", `
+Webhooks:
+  - url: https://wiki.example.com/hook
+    secret: s3cr3t
+    events:
+      - user.created
+      - user.deleted
+  - url: https://lists.example.com/hook
+`, yamlMap{"Webhooks": yamlList{
+			yamlMap{"url": "https://wiki.example.com/hook", "secret": "s3cr3t", "events": yamlList{"user.created", "user.deleted"}},
+			yamlMap{"url": "https://lists.example.com/hook"},
+		}}},
+		{"sequence at the key's indentation", `
+events:
+- user.created
+- user.deleted
+other: x
+`, yamlMap{"events": yamlList{"user.created", "user.deleted"}, "other": "x"}},
+		{"nested sequences", `
+- - a
+  - b
+-
+  - c
+`, yamlList{yamlList{"a", "b"}, yamlList{"c"}}},
+		{"flow collections", `
+list: [a, "b, c", 3, true]
+empty: []
+map: {url: "https://x", retries: 3}
+`, yamlMap{"list": yamlList{"a", "b, c", int64(3), true}, "empty": yamlList{},
+			"map": yamlMap{"url": "https://x", "retries": int64(3)}}},
+		{"CRLF", "a: 1\r\nb:\r\n  - x\r\n", yamlMap{"a": int64(1), "b": yamlList{"x"}}},
+		{"scalar document", "hello", "hello"},
+	}
+	for _, test := range tests {
+		got, err := parseYAML(strings.NewReader(test.yaml))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		yaml, err string
+	}{
+		{"a: 1\n\tb: 2\n", "line 2: tabs are not allowed"},
+		{"a: 1\na: 2\n", `line 2: duplicate key "a"`},
+		{"a:\n  b: 1\n    c: 2\n", "line 3: unexpected indentation"},
+		{"a: 1\n  b: 2\n", "line 2: unexpected indentation"},
+		{"a: 1\n- b\n", "line 2: expected key: value"},
+		{"- a\n  - b\n", "line 2: unexpected indentation"},
+		{"a: 1\njust text\n", "line 2: expected key: value"},
+		{"a: |\n  text\n", "line 1: multi-line scalars are not supported"},
+		{"a: &anchor 1\n", "line 1: anchors, aliases and tags are not supported"},
+		{"a: *anchor\n", "line 1: anchors, aliases and tags are not supported"},
+		{"a: !!str 1\n", "line 1: anchors, aliases and tags are not supported"},
+		{"a: [1, 2\n", "line 1: unterminated flow sequence"},
+		{"a: {b: 1\n", "line 1: unterminated flow mapping"},
+		{"a: {b}\n", "line 1: expected key: value in flow mapping"},
+		{"a: [[1], 2]\n", "line 1: nested flow collections are not supported"},
+		{"a: \"unterminated\n", "line 1: invalid double quoted string"},
+		{"a: 'unterminated\n", "line 1: invalid single quoted string"},
+	}
+	for _, test := range tests {
+		_, err := parseYAML(strings.NewReader(test.yaml))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %s", test.yaml, err, test.err)
+		}
+	}
+}